@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kfsoftware/externalbuilder/cmd/internal/digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultAuditLogMaxSize    = 100 << 20 // 100 MiB
+	defaultAuditLogMaxBackups = 10
+)
+
+// auditEvent is a line of the audit log
+type auditEvent struct {
+	Time      time.Time `json:"time"`
+	ClientIP  string    `json:"client_ip"`
+	Identity  string    `json:"identity,omitempty"` // Subject of the client certificate
+	Method    string    `json:"method"`
+	Operation string    `json:"operation"`
+	Path      string    `json:"path"`
+	Tenant    string    `json:"tenant,omitempty"`
+	BuildID   string    `json:"build_id,omitempty"`
+	Artifact  string    `json:"artifact,omitempty"`
+	Received  int64     `json:"bytes_received"`
+	Sent      int64     `json:"bytes_sent"`
+	Digest    string    `json:"sha256,omitempty"`
+	Status    int       `json:"status"`
+	Result    string    `json:"result"` // success, denied or failure
+	Duration  float64   `json:"duration_seconds"`
+}
+
+// auditLog writes the audit events as JSON lines to stdout or to a file,
+// which is rotated once it exceeds maxSize
+type auditLog struct {
+	mu         sync.Mutex
+	w          io.Writer
+	file       *os.File
+	path       string
+	size       int64
+	maxSize    int64
+	maxBackups int
+}
+
+// newAuditLogFromEnv writes the audit log to AUDIT_LOG_FILE, or to stdout if it's not set.
+// The file is rotated after AUDIT_LOG_MAX_SIZE bytes, keeping AUDIT_LOG_MAX_BACKUPS files.
+func newAuditLogFromEnv() (*auditLog, error) {
+	path := os.Getenv("AUDIT_LOG_FILE")
+	if path == "" {
+		return &auditLog{w: os.Stdout}, nil
+	}
+
+	maxSize := int64(defaultAuditLogMaxSize)
+	if value := os.Getenv("AUDIT_LOG_MAX_SIZE"); value != "" {
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size <= 0 {
+			return nil, errors.Errorf("invalid AUDIT_LOG_MAX_SIZE %q", value)
+		}
+		maxSize = size
+	}
+	maxBackups := defaultAuditLogMaxBackups
+	if value := os.Getenv("AUDIT_LOG_MAX_BACKUPS"); value != "" {
+		backups, err := strconv.Atoi(value)
+		if err != nil || backups < 0 {
+			return nil, errors.Errorf("invalid AUDIT_LOG_MAX_BACKUPS %q", value)
+		}
+		maxBackups = backups
+	}
+	return newAuditLogFile(path, maxSize, maxBackups)
+}
+
+func newAuditLogFile(path string, maxSize int64, maxBackups int) (*auditLog, error) {
+	a := &auditLog{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	err := a.open()
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "opening audit log")
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "opening audit log")
+	}
+	a.file = f
+	a.w = f
+	a.size = fi.Size()
+	return nil
+}
+
+// rotate renames the audit log to <path>.1, shifting the older files
+func (a *auditLog) rotate() error {
+	err := a.file.Close()
+	if err != nil {
+		return errors.Wrap(err, "closing audit log")
+	}
+	if a.maxBackups == 0 {
+		err = os.Remove(a.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", a.path, a.maxBackups))
+		for i := a.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+		}
+		err = os.Rename(a.path, a.path+".1")
+	}
+	if err != nil {
+		return errors.Wrap(err, "rotating audit log")
+	}
+	return a.open()
+}
+
+// Write appends an event to the audit log
+func (a *auditLog) Write(e *auditEvent) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "marshaling audit event")
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file != nil && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		err = a.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := a.w.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// Close closes the audit log file
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// Record writes the audit event of a request. Only requests involving artifacts
+// or the administrative API are recorded.
+func (a *auditLog) Record(r *http.Request, status int, received int64, sent int64, header http.Header, duration time.Duration) {
+	e := &auditEvent{
+		Time:     time.Now().UTC(),
+		ClientIP: r.RemoteAddr,
+		Method:   r.Method,
+		Path:     r.URL.Path, // Without the query, which holds the signature
+		Received: received,
+		Sent:     sent,
+		Status:   status,
+		Duration: duration.Seconds(),
+	}
+	if !e.describe() {
+		return
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		e.ClientIP = host
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		e.Identity = r.TLS.PeerCertificates[0].Subject.String()
+	}
+	if value := header.Get(digest.Header); value != "" {
+		e.Digest, _ = digest.ParseSHA256(value)
+	}
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		e.Result = "denied"
+	case status >= http.StatusBadRequest:
+		e.Result = "failure"
+	default:
+		e.Result = "success"
+	}
+
+	err := a.Write(e)
+	if err != nil {
+		log.Printf("Writing audit log: %s", err)
+	}
+}
+
+// describe sets the operation, build and artifact of an event from its request,
+// returning false for requests that are not audited
+func (e *auditEvent) describe() bool {
+	path := e.Path
+	if rest := strings.TrimPrefix(path, "/"+tenantsPrefix); rest != path {
+		if i := strings.Index(rest, "/"); i >= 0 {
+			e.Tenant, path = rest[:i], rest[i:]
+		}
+	}
+	switch {
+	case path == "/metrics" || path == "/healthz" || path == "/readyz":
+		return false
+	case strings.HasPrefix(path, "/api/replicate/"):
+		e.BuildID, e.Artifact, _ = parseArtifactPath(strings.TrimPrefix(path, "/api/replicate"))
+		e.Operation = map[string]string{
+			http.MethodPut:    "replica_upload",
+			http.MethodDelete: "replica_delete",
+		}[e.Method]
+		if e.Operation == "" {
+			e.Operation = "replica_download"
+		}
+	case path == "/api/builds":
+		e.Operation = "list_builds"
+	case strings.HasPrefix(path, "/api/builds/"):
+		e.BuildID = strings.TrimPrefix(path, "/api/builds/")
+		e.Operation = "get_build"
+		if e.Method == http.MethodDelete {
+			e.Operation = "delete_build"
+		}
+	case path == "/api/gc":
+		e.Operation = "gc"
+	case path == "/api/keys/rotate":
+		e.Operation = "rotate_keys"
+	case path == "/api/events":
+		e.Operation = "events"
+	case path == "/api/usage":
+		e.Operation = "usage"
+	default:
+		e.BuildID, e.Artifact, _ = parseArtifactPath(path)
+		e.Operation = "download"
+		if e.Method == http.MethodPost || e.Method == http.MethodPut {
+			e.Operation = "upload"
+		}
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kfsoftware/externalbuilder/cmd/internal/digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAuditLog(t *testing.T, path string) []auditEvent {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var events []auditEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e auditEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		events = append(events, e)
+	}
+	require.NoError(t, scanner.Err())
+	return events
+}
+
+func TestAuditLog(t *testing.T) {
+	s, cleanup := newTestFileServer(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	s.audit, err = newAuditLogFile(path, defaultAuditLogMaxSize, 1)
+	require.NoError(t, err)
+	defer s.audit.Close()
+	s.secret = []byte("secret")
+	s.adminToken = "admin"
+	h := s.routes()
+	// sha256 of "0123456789"
+	sum := "sha-256=hNiYd/DUBB77a/kaFvAkjy/Vc+avBcGflr7bn4gveII="
+
+	doRequest(t, h, "POST", "/build1/chaincode-source.tar", "0123456789", nil)
+	s.secret = nil
+	doRequest(t, h, "POST", "/build1/chaincode-source.tar?signature=abc", "0123456789", nil)
+	doRequest(t, h, "GET", "/build1/chaincode-source.tar", "", nil)
+	doRequest(t, h, "GET", "/build2/chaincode-output.tar", "", nil)
+	doRequest(t, h, "DELETE", "/api/builds/build1", "", map[string]string{"Authorization": "Bearer admin"})
+	doRequest(t, h, "GET", "/healthz", "", nil)
+
+	events := readAuditLog(t, path)
+	require.Len(t, events, 5)
+	for _, e := range events {
+		assert.Equal(t, "192.0.2.1", e.ClientIP)
+		assert.False(t, e.Time.IsZero())
+	}
+
+	assert.Equal(t, "upload", events[0].Operation)
+	assert.Equal(t, "denied", events[0].Result)
+	assert.Equal(t, http.StatusUnauthorized, events[0].Status)
+
+	assert.Equal(t, "upload", events[1].Operation)
+	assert.Equal(t, "/build1/chaincode-source.tar", events[1].Path)
+	assert.Equal(t, "build1", events[1].BuildID)
+	assert.Equal(t, "chaincode-source.tar", events[1].Artifact)
+	assert.EqualValues(t, 10, events[1].Received)
+	assert.Equal(t, "success", events[1].Result)
+	expected, err := digest.ParseSHA256(sum)
+	require.NoError(t, err)
+	assert.Equal(t, expected, events[1].Digest)
+
+	assert.Equal(t, "download", events[2].Operation)
+	assert.EqualValues(t, 10, events[2].Sent)
+	assert.Equal(t, expected, events[2].Digest)
+
+	assert.Equal(t, "failure", events[3].Result)
+	assert.Equal(t, http.StatusNotFound, events[3].Status)
+
+	assert.Equal(t, "delete_build", events[4].Operation)
+	assert.Equal(t, "build1", events[4].BuildID)
+	assert.Equal(t, "success", events[4].Result)
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	a, err := newAuditLogFile(path, 500, 2)
+	require.NoError(t, err)
+	defer a.Close()
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, a.Write(&auditEvent{Operation: "download", BuildID: "build1", Result: "success"}))
+	}
+	for _, name := range []string{"audit.log", "audit.log.1", "audit.log.2"} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		require.NoError(t, err, name)
+		assert.True(t, fi.Size() <= 500, name)
+		assert.NotEmpty(t, readAuditLog(t, filepath.Join(dir, name)), name)
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// Appends to the existing file when reopened
+	events := len(readAuditLog(t, path))
+	require.NoError(t, a.Close())
+	a, err = newAuditLogFile(path, defaultAuditLogMaxSize, 2)
+	require.NoError(t, err)
+	defer a.Close()
+	require.NoError(t, a.Write(&auditEvent{Operation: "gc"}))
+	assert.Len(t, readAuditLog(t, path), events+1)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kfsoftware/externalbuilder/cmd/internal/signedurl"
+)
+
+// authorize checks the signed URL of the request, writing a 401 or 403 response
+// and returning false if the request is not allowed.
+// Authorization is disabled when no secret is configured.
+func authorize(secret []byte, buildID string, w http.ResponseWriter, r *http.Request) bool {
+	if len(secret) == 0 {
+		return true
+	}
+
+	op := signedurl.Read
+	if r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodDelete {
+		op = signedurl.Write
+	}
+
+	err := signedurl.Verify(secret, buildID, op, r.URL.Query(), time.Now())
+	switch err {
+	case nil:
+		return true
+	case signedurl.ErrMissingSignature:
+		log.Printf("Rejecting %s %s: %s", r.Method, r.URL.Path, err)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	default:
+		log.Printf("Rejecting %s %s: %s", r.Method, r.URL.Path, err)
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}
+	return false
+}
+
+// authorizeAdmin checks the bearer token of requests to the administrative API,
+// writing a 401 or 403 response and returning false if the request is not allowed.
+// Without an admin token the API is only open if requests are not authenticated at all.
+func authorizeAdmin(adminToken string, authEnabled bool, w http.ResponseWriter, r *http.Request) bool {
+	if adminToken == "" {
+		if authEnabled {
+			log.Printf("Rejecting %s %s: ADMIN_TOKEN is not set", r.Method, r.URL.Path)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		log.Printf("Rejecting %s %s: missing admin token", r.Method, r.URL.Path)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		log.Printf("Rejecting %s %s: invalid admin token", r.Method, r.URL.Path)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// buildEntry lists the artifacts stored for a build
+type buildEntry struct {
+	Tenant    string             `json:"tenant,omitempty"`
+	BuildID   string             `json:"build_id"`
+	Artifacts []ArtifactMetadata `json:"artifacts"`
+}
+
+// groupByBuild groups artifacts by build, sorted by tenant, build ID and artifact name
+func groupByBuild(artifacts []Artifact) []buildEntry {
+	builds := map[string]*buildEntry{}
+	for _, a := range artifacts {
+		id := a.Metadata.Tenant + "/" + a.Metadata.BuildID
+		b, ok := builds[id]
+		if !ok {
+			b = &buildEntry{Tenant: a.Metadata.Tenant, BuildID: a.Metadata.BuildID}
+			builds[id] = b
+		}
+		b.Artifacts = append(b.Artifacts, a.Metadata)
+	}
+
+	entries := []buildEntry{}
+	for _, b := range builds {
+		sort.Slice(b.Artifacts, func(i, j int) bool {
+			return b.Artifacts[i].Artifact < b.Artifacts[j].Artifact
+		})
+		entries = append(entries, *b)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Tenant != entries[j].Tenant {
+			return entries[i].Tenant < entries[j].Tenant
+		}
+		return entries[i].BuildID < entries[j].BuildID
+	})
+	return entries
+}
+
+// serveBuilds lists all builds, GET /api/builds
+func (s *fileServer) serveBuilds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeAdmin(s.adminToken, len(s.secret) > 0, w, r) {
+		return
+	}
+	artifacts, err := listArtifacts(r.Context(), s.storage, "")
+	if err != nil {
+		log.Printf("Listing artifacts: %s", err)
+		http.Error(w, "listing artifacts failed", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, groupByBuild(artifacts))
+}
+
+// serveBuild returns or deletes the artifacts of a build, GET or DELETE /api/builds/<buildID>
+func (s *fileServer) serveBuild(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeAdmin(s.adminToken, len(s.secret) > 0, w, r) {
+		return
+	}
+	buildID := strings.TrimPrefix(r.URL.Path, "/api/builds/")
+	if !validBuildID(buildID) {
+		http.Error(w, "invalid build ID", http.StatusBadRequest)
+		return
+	}
+
+	artifacts, err := listArtifacts(r.Context(), s.storage, buildID+"/")
+	if err != nil {
+		log.Printf("Listing artifacts of %s: %s", buildID, err)
+		http.Error(w, "listing artifacts failed", http.StatusInternalServerError)
+		return
+	}
+	if len(artifacts) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, groupByBuild(artifacts)[0])
+		return
+	}
+
+	for _, a := range artifacts {
+		unlock := s.lockArtifact(a.Key)
+		err := deleteArtifact(r.Context(), s.storage, a.Key)
+		unlock()
+		if err != nil && err != ErrNotFound {
+			log.Printf("Deleting %s: %s", a.Key, err)
+			http.Error(w, "deleting artifacts failed", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Deleted %s", a.Key)
+		s.publish(eventDeleted, &a.Metadata)
+		s.replicator.Delete(r.Context(), a.Key)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteFromPeers removes an artifact deleted by the garbage collector from the peers,
+// with the replicator of its tenant
+func (s *fileServer) deleteFromPeers(ctx context.Context, md *ArtifactMetadata) {
+	server := s
+	if md.Tenant != "" {
+		t, ok := s.tenants[md.Tenant]
+		if !ok {
+			log.Printf("Deleting %s/%s of unknown tenant %s from the peers", md.BuildID, md.Artifact, md.Tenant)
+			return
+		}
+		server = t
+	}
+	server.replicator.Delete(ctx, artifactKey(md.BuildID, md.Artifact))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatalog(t *testing.T) {
+	s, cleanup := newTestFileServer(t)
+	defer cleanup()
+	s.adminToken = "admin"
+	h := s.routes()
+	admin := map[string]string{"Authorization": "Bearer admin"}
+
+	for _, upload := range []struct{ path, body string }{
+		{"/build2/chaincode-source.tar", "source2"},
+		{"/build1/chaincode-source.tar", "source1"},
+		{"/build1/chaincode-output.tar", "output1"},
+	} {
+		rec := doRequest(t, h, "POST", upload.path, upload.body, map[string]string{labelHeader: "fabcar_1"})
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	rec := doRequest(t, h, "GET", "/api/builds", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// Builds are sorted by ID, their artifacts by name
+	rec = doRequest(t, h, "GET", "/api/builds", "", admin)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var builds []buildEntry
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &builds))
+	require.Len(t, builds, 2)
+	assert.Equal(t, "build1", builds[0].BuildID)
+	assert.Equal(t, "build2", builds[1].BuildID)
+	require.Len(t, builds[0].Artifacts, 2)
+	assert.Equal(t, "chaincode-output.tar", builds[0].Artifacts[0].Artifact)
+	assert.Equal(t, "chaincode-source.tar", builds[0].Artifacts[1].Artifact)
+	assert.EqualValues(t, 7, builds[0].Artifacts[0].Size)
+	assert.Equal(t, "fabcar_1", builds[0].Artifacts[0].Label)
+	assert.False(t, builds[0].Artifacts[0].UploadedAt.IsZero())
+
+	rec = doRequest(t, h, "GET", "/api/builds/build1", "", admin)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var build buildEntry
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &build))
+	assert.Equal(t, builds[0], build)
+
+	rec = doRequest(t, h, "GET", "/api/builds/build3", "", admin)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = doRequest(t, h, "GET", "/api/builds/build_1", "", admin)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doRequest(t, h, "POST", "/api/builds/build1", "", admin)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	// Deleting a build removes its artifacts along with their metadata
+	rec = doRequest(t, h, "DELETE", "/api/builds/build1", "", admin)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, rec.Body.String())
+	for _, key := range []string{"build1/chaincode-source.tar", "build1/chaincode-output.tar"} {
+		_, err := s.storage.Stat(context.Background(), key)
+		assert.Equal(t, ErrNotFound, err)
+		_, err = readMetadata(context.Background(), s.storage, key)
+		assert.Equal(t, ErrNotFound, err)
+	}
+	rec = doRequest(t, h, "GET", "/build1/chaincode-output.tar", "", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = doRequest(t, h, "DELETE", "/api/builds/build1", "", admin)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = doRequest(t, h, "GET", "/api/builds", "", admin)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &builds))
+	require.Len(t, builds, 1)
+	assert.Equal(t, "build2", builds[0].BuildID)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The subcommands work on the storage directly, configured by the same environment
+// variables as the server
+
+// listCommand prints the stored builds, ls [-json] [-tenant <tenant>] [<buildID>]
+func listCommand(args []string) error {
+	flags := flag.NewFlagSet("ls", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the builds as JSON")
+	tenant := flags.String("tenant", "", "only list the builds of a tenant")
+	flags.Parse(args)
+
+	storage, _, err := openStorage()
+	if err != nil {
+		return err
+	}
+	prefix := ""
+	if *tenant != "" {
+		prefix = tenantsPrefix + *tenant + "/"
+	}
+	if flags.NArg() > 0 {
+		prefix += flags.Arg(0) + "/"
+	}
+	return listBuilds(context.Background(), storage, prefix, *asJSON, os.Stdout)
+}
+
+// listBuilds writes the builds whose key starts with prefix to w, as a table or as JSON
+func listBuilds(ctx context.Context, storage Storage, prefix string, asJSON bool, w io.Writer) error {
+	artifacts, err := listArtifacts(ctx, storage, prefix)
+	if err != nil {
+		return err
+	}
+	builds := groupByBuild(artifacts)
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(builds)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TENANT\tBUILD ID\tARTIFACT\tSIZE\tLABEL\tUPLOADED\tSHA256")
+	for _, b := range builds {
+		for _, a := range b.Artifacts {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\n", valueOrDash(b.Tenant), b.BuildID, a.Artifact,
+				a.Size, valueOrDash(a.Label), a.UploadedAt.UTC().Format(time.RFC3339), valueOrDash(a.Digest))
+		}
+	}
+	return tw.Flush()
+}
+
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// gcCommand runs the garbage collector once with the configured policy, gc [-dry-run]
+func gcCommand(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only report what would be removed")
+	flags.Parse(args)
+
+	storage, _, err := openStorage()
+	if err != nil {
+		return err
+	}
+	policy, _, err := getGCConfig()
+	if err != nil {
+		return err
+	}
+	gc := &garbageCollector{storage: storage, policy: policy}
+	report, err := gc.Run(context.Background(), *dryRun)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// verifyReport is the outcome of the verification of the stored artifacts
+type verifyReport struct {
+	Verified int
+	Failed   int
+	Skipped  int // Artifacts without a recorded digest
+}
+
+// verifyCommand re-hashes the stored artifacts and compares them against the digests recorded
+// at upload, verify [<prefix>]. It fails if any artifact doesn't match.
+func verifyCommand(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.Parse(args)
+
+	storage, _, err := openStorage()
+	if err != nil {
+		return err
+	}
+	report, err := verifyArtifacts(context.Background(), storage, flags.Arg(0), os.Stdout)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d verified, %d failed, %d without digest\n", report.Verified, report.Failed, report.Skipped)
+	if report.Failed > 0 {
+		return errors.Errorf("%d artifacts failed verification", report.Failed)
+	}
+	return nil
+}
+
+// verifyArtifacts checks the artifacts whose key starts with prefix, writing the ones
+// that fail or can't be verified to w
+func verifyArtifacts(ctx context.Context, storage Storage, prefix string, w io.Writer) (*verifyReport, error) {
+	artifacts, err := listArtifacts(ctx, storage, prefix)
+	if err != nil {
+		return nil, err
+	}
+	report := &verifyReport{}
+	for _, a := range artifacts {
+		md := a.Metadata
+		if md.Digest == "" {
+			fmt.Fprintf(w, "SKIPPED %s: no digest recorded\n", a.Key)
+			report.Skipped++
+			continue
+		}
+		size, sum, err := hashArtifact(ctx, storage, a.Key, md.Encoding)
+		switch {
+		case err != nil:
+			fmt.Fprintf(w, "FAILED %s: %s\n", a.Key, err)
+		case size != md.Size:
+			fmt.Fprintf(w, "FAILED %s: size is %d, expected %d\n", a.Key, size, md.Size)
+		case sum != md.Digest:
+			fmt.Fprintf(w, "FAILED %s: sha256 is %s, expected %s\n", a.Key, sum, md.Digest)
+		default:
+			report.Verified++
+			continue
+		}
+		report.Failed++
+	}
+	return report, nil
+}
+
+// hashArtifact returns the stored size of an artifact and the SHA-256 of its decompressed content
+func hashArtifact(ctx context.Context, storage Storage, key string, encoding string) (int64, string, error) {
+	obj, _, err := storage.Get(ctx, key)
+	if err != nil {
+		return 0, "", errors.Wrap(err, "reading artifact")
+	}
+	defer obj.Close()
+	content := newContentDigest(encoding)
+	n, err := io.Copy(content, obj)
+	contentErr := content.Close()
+	if err != nil {
+		return 0, "", errors.Wrap(err, "reading artifact")
+	}
+	if contentErr != nil {
+		return 0, "", errors.Wrap(contentErr, "decompressing artifact")
+	}
+	return n, content.Sum(), nil
+}
+
+// exportCommand writes the whole store to a tar archive, export [-o <file>]
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	output := flags.String("o", "-", "archive to write, - for stdout")
+	flags.Parse(args)
+
+	storage, _, err := openStorage()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if *output == "-" {
+		n, err := exportArtifacts(ctx, storage, os.Stdout)
+		if err != nil {
+			return err
+		}
+		log.Printf("Exported %d objects", n)
+		return nil
+	}
+	// The archive holds the artifacts decrypted
+	f, err := os.OpenFile(*output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "creating archive")
+	}
+	n, err := exportArtifacts(ctx, storage, f)
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return errors.Wrap(closeErr, "closing archive")
+	}
+	log.Printf("Exported %d objects", n)
+	return nil
+}
+
+// exportArtifacts writes all objects of the storage, artifacts and their metadata, to a tar
+// archive named by their keys. It returns the number of objects written.
+func exportArtifacts(ctx context.Context, storage Storage, w io.Writer) (int, error) {
+	objects, err := storage.List(ctx, "")
+	if err != nil {
+		return 0, errors.Wrap(err, "listing storage")
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	tw := tar.NewWriter(w)
+	n := 0
+	for _, o := range objects {
+		r, info, err := storage.Get(ctx, o.Key)
+		if err == ErrNotFound {
+			// Deleted in the meantime
+			continue
+		}
+		if err != nil {
+			return n, errors.Wrapf(err, "reading %s", o.Key)
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     o.Key,
+			Mode:     0644,
+			Size:     info.Size,
+			ModTime:  info.ModTime,
+		})
+		if err == nil {
+			_, err = io.Copy(tw, r)
+		}
+		r.Close()
+		if err != nil {
+			return n, errors.Wrapf(err, "writing %s", o.Key)
+		}
+		n++
+	}
+	return n, errors.Wrap(tw.Close(), "writing archive")
+}
+
+// importCommand stores the objects of an archive written by export, import [-i <file>] [-overwrite]
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	input := flags.String("i", "-", "archive to read, - for stdin")
+	overwrite := flags.Bool("overwrite", false, "replace the objects already stored")
+	flags.Parse(args)
+
+	storage, _, err := openStorage()
+	if err != nil {
+		return err
+	}
+	r := io.Reader(os.Stdin)
+	if *input != "-" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return errors.Wrap(err, "opening archive")
+		}
+		defer f.Close()
+		r = f
+	}
+	imported, skipped, err := importArtifacts(context.Background(), storage, r, *overwrite)
+	if err != nil {
+		return err
+	}
+	log.Printf("Imported %d objects, skipped %d already stored", imported, skipped)
+	return nil
+}
+
+// importArtifacts stores the objects of a tar archive under their names. Objects already
+// stored are skipped unless overwrite is set.
+func importArtifacts(ctx context.Context, storage Storage, r io.Reader, overwrite bool) (int, int, error) {
+	tr := tar.NewReader(r)
+	imported, skipped := 0, 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return imported, skipped, nil
+		}
+		if err != nil {
+			return imported, skipped, errors.Wrap(err, "reading archive")
+		}
+		if !hdr.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		key := hdr.Name
+		if path.Clean(key) != key || strings.HasPrefix(key, "/") || strings.HasPrefix(key, "../") || key == ".." {
+			return imported, skipped, errors.Errorf("invalid object name %q in archive", key)
+		}
+		if !overwrite {
+			_, err := storage.Stat(ctx, key)
+			if err == nil {
+				skipped++
+				continue
+			}
+			if err != ErrNotFound {
+				return imported, skipped, errors.Wrapf(err, "checking %s", key)
+			}
+		}
+		err = storage.Put(ctx, key, tr, hdr.Size)
+		if err != nil {
+			return imported, skipped, errors.Wrapf(err, "storing %s", key)
+		}
+		imported++
+	}
+}
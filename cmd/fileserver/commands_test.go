@@ -0,0 +1,122 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestStore returns a file server holding the source and output of build1
+func newTestStore(t *testing.T) (*fileServer, func()) {
+	s, cleanup := newTestFileServer(t)
+	h := s.routes()
+	for path, content := range map[string]string{
+		"/build1/chaincode-source.tar": "source",
+		"/build1/chaincode-output.tar": "output",
+	} {
+		rec := doRequest(t, h, "POST", path, content, map[string]string{labelHeader: "fabcar_1"})
+		require.Equal(t, http.StatusOK, rec.Code)
+	}
+	return s, cleanup
+}
+
+func TestListBuilds(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	var buf bytes.Buffer
+	require.NoError(t, listBuilds(context.Background(), s.storage, "", false, &buf))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.True(t, strings.HasPrefix(lines[0], "TENANT"))
+	assert.Contains(t, lines[1], "build1")
+	assert.Contains(t, lines[1], "chaincode-output.tar")
+	assert.Contains(t, lines[1], "fabcar_1")
+
+	buf.Reset()
+	require.NoError(t, listBuilds(context.Background(), s.storage, "build2/", false, &buf))
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"))
+}
+
+func TestVerifyArtifacts(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	report, err := verifyArtifacts(ctx, s.storage, "", &buf)
+	require.NoError(t, err)
+	assert.Equal(t, verifyReport{Verified: 2}, *report)
+	assert.Empty(t, buf.String())
+
+	// Same size, different content
+	require.NoError(t, s.storage.Put(ctx, "build1/chaincode-output.tar", strings.NewReader("outpux"), 6))
+	// No metadata
+	require.NoError(t, s.storage.Put(ctx, "build2/chaincode-source.tar", strings.NewReader("source"), 6))
+	report, err = verifyArtifacts(ctx, s.storage, "", &buf)
+	require.NoError(t, err)
+	assert.Equal(t, verifyReport{Verified: 1, Failed: 1, Skipped: 1}, *report)
+	assert.Contains(t, buf.String(), "FAILED build1/chaincode-output.tar: sha256 is")
+	assert.Contains(t, buf.String(), "SKIPPED build2/chaincode-source.tar")
+}
+
+func TestExportImport(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	var archive bytes.Buffer
+	n, err := exportArtifacts(ctx, s.storage, &archive)
+	require.NoError(t, err)
+	assert.Equal(t, 4, n) // Two artifacts and their metadata
+
+	dir, err := ioutil.TempDir("", "fileserver")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	target := NewLocalStorage(dir)
+	imported, skipped, err := importArtifacts(ctx, target, bytes.NewReader(archive.Bytes()), false)
+	require.NoError(t, err)
+	assert.Equal(t, 4, imported)
+	assert.Equal(t, 0, skipped)
+
+	expected, err := listArtifacts(ctx, s.storage, "")
+	require.NoError(t, err)
+	actual, err := listArtifacts(ctx, target, "")
+	require.NoError(t, err)
+	assert.Equal(t, groupByBuild(expected), groupByBuild(actual))
+	report, err := verifyArtifacts(ctx, target, "", ioutil.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, verifyReport{Verified: 2}, *report)
+
+	// Objects already stored are kept unless overwriting
+	require.NoError(t, target.Put(ctx, "build1/chaincode-source.tar", strings.NewReader("local"), 5))
+	imported, skipped, err = importArtifacts(ctx, target, bytes.NewReader(archive.Bytes()), false)
+	require.NoError(t, err)
+	assert.Equal(t, 0, imported)
+	assert.Equal(t, 4, skipped)
+	imported, _, err = importArtifacts(ctx, target, bytes.NewReader(archive.Bytes()), true)
+	require.NoError(t, err)
+	assert.Equal(t, 4, imported)
+	r, _, err := target.Get(ctx, "build1/chaincode-source.tar")
+	require.NoError(t, err)
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "source", string(data))
+
+	// Names escaping the store are rejected
+	var evil bytes.Buffer
+	tw := tar.NewWriter(&evil)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "../escape", Size: 1, Mode: 0644}))
+	tw.Write([]byte("x"))
+	require.NoError(t, tw.Close())
+	_, _, err = importArtifacts(ctx, target, &evil, false)
+	assert.Error(t, err)
+}
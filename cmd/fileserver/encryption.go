@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Encrypted objects start with a header holding the data key of the object wrapped with a
+// key encryption key, followed by the content split in chunks sealed with AES-256-GCM:
+//
+//	magic (4) | key fingerprint (8) | nonce (12) | wrapped data key (32 + 16) | chunks
+//
+// The nonce of a chunk is its index, with the last byte set on the last chunk so
+// truncated objects are detected.
+const (
+	encryptionMagic     = "CCE1"
+	fingerprintSize     = 8
+	dataKeySize         = 32
+	encryptionChunkSize = 64 << 10
+	gcmTagSize          = 16
+	gcmNonceSize        = 12
+
+	encryptionHeaderSize = len(encryptionMagic) + fingerprintSize + gcmNonceSize + dataKeySize + gcmTagSize
+)
+
+var (
+	errUnknownKey        = errors.New("object is encrypted with an unknown key")
+	errCorruptCiphertext = errors.New("encrypted object is corrupt")
+)
+
+// keyring holds the key encryption keys, loaded from the files of a directory like a mounted Secret.
+// New objects are encrypted with the active key, the others are kept to decrypt older objects.
+type keyring struct {
+	dir       string
+	activeKey string // File name of the active key, the last one in lexical order if empty
+
+	mu     sync.RWMutex
+	keys   map[string][]byte // By fingerprint
+	active string            // Fingerprint of the active key
+}
+
+// newKeyringFromEnv loads the keys from ENCRYPTION_KEYS_DIR, or returns nil if it's not set
+func newKeyringFromEnv() (*keyring, error) {
+	dir := os.Getenv("ENCRYPTION_KEYS_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+	k := &keyring{dir: dir, activeKey: os.Getenv("ENCRYPTION_ACTIVE_KEY")}
+	return k, k.Reload()
+}
+
+// Reload reads the keys again, so keys added to the Secret can be used without a restart
+func (k *keyring) Reload() error {
+	files, err := ioutil.ReadDir(k.dir)
+	if err != nil {
+		return errors.Wrap(err, "listing encryption keys")
+	}
+	names := []string{}
+	keys := map[string][]byte{}
+	fingerprints := map[string]string{}
+	for _, fi := range files {
+		// Secret volumes hold the files in hidden directories linked from the top level
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(k.dir, fi.Name()))
+		if err != nil {
+			return errors.Wrapf(err, "reading encryption key %s", fi.Name())
+		}
+		key, err := parseEncryptionKey(data)
+		if err != nil {
+			return errors.Wrapf(err, "parsing encryption key %s", fi.Name())
+		}
+		fingerprint := keyFingerprint(key)
+		keys[fingerprint] = key
+		fingerprints[fi.Name()] = fingerprint
+		names = append(names, fi.Name())
+	}
+	if len(names) == 0 {
+		return errors.Errorf("no encryption keys found in %s", k.dir)
+	}
+
+	activeKey := k.activeKey
+	if activeKey == "" {
+		sort.Strings(names)
+		activeKey = names[len(names)-1]
+	}
+	active, ok := fingerprints[activeKey]
+	if !ok {
+		return errors.Errorf("active encryption key %s not found in %s", activeKey, k.dir)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.active != "" && k.active != active {
+		log.Printf("Encryption key %s is now active", activeKey)
+	}
+	k.keys = keys
+	k.active = active
+	return nil
+}
+
+// parseEncryptionKey accepts 32 raw bytes or their base64 or hex encoding
+func parseEncryptionKey(data []byte) ([]byte, error) {
+	if len(data) == dataKeySize {
+		return data, nil
+	}
+	text := strings.TrimSpace(string(data))
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == dataKeySize {
+		return key, nil
+	}
+	if key, err := hex.DecodeString(text); err == nil && len(key) == dataKeySize {
+		return key, nil
+	}
+	return nil, errors.New("key must be 32 bytes, raw or base64 or hex encoded")
+}
+
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return string(sum[:fingerprintSize])
+}
+
+func (k *keyring) activeKeyFingerprint() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+// wrap seals a new data key with the active key and returns the header of an object
+func (k *keyring) wrap(dataKey []byte) ([]byte, error) {
+	k.mu.RLock()
+	fingerprint := k.active
+	kek := k.keys[fingerprint]
+	k.mu.RUnlock()
+
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, encryptionHeaderSize)
+	header = append(header, encryptionMagic...)
+	header = append(header, fingerprint...)
+	nonce := make([]byte, gcmNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "generating nonce")
+	}
+	header = append(header, nonce...)
+	return aead.Seal(header, nonce, dataKey, header[:len(encryptionMagic)+fingerprintSize]), nil
+}
+
+// unwrap returns the data key of an object from its header
+func (k *keyring) unwrap(header []byte) ([]byte, error) {
+	prefix := header[:len(encryptionMagic)+fingerprintSize]
+	fingerprint := string(prefix[len(encryptionMagic):])
+	k.mu.RLock()
+	kek, ok := k.keys[fingerprint]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, errUnknownKey
+	}
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	nonce := header[len(prefix) : len(prefix)+gcmNonceSize]
+	dataKey, err := aead.Open(nil, nonce, header[len(prefix)+gcmNonceSize:], prefix)
+	if err != nil {
+		return nil, errCorruptCiphertext
+	}
+	return dataKey, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(index int64, last bool) []byte {
+	nonce := make([]byte, gcmNonceSize)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[gcmNonceSize-1] = 1
+	}
+	return nonce
+}
+
+// encryptedSize returns the size of the encrypted form of size bytes
+func encryptedSize(size int64) int64 {
+	if size < 0 {
+		return -1
+	}
+	chunks := (size + encryptionChunkSize - 1) / encryptionChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return int64(encryptionHeaderSize) + size + chunks*gcmTagSize
+}
+
+// plaintextSize returns the size of the content of an encrypted object of size bytes
+func plaintextSize(size int64) int64 {
+	body := size - int64(encryptionHeaderSize)
+	if body <= 0 {
+		return 0
+	}
+	chunks := (body + encryptionChunkSize + gcmTagSize - 1) / (encryptionChunkSize + gcmTagSize)
+	return body - chunks*gcmTagSize
+}
+
+// EncryptedStorage encrypts the objects of another storage with envelope encryption:
+// every object has its own data key, stored wrapped with a key of the keyring.
+// Objects stored before encryption was enabled are read as they are.
+type EncryptedStorage struct {
+	backend Storage
+	keys    *keyring
+}
+
+// NewEncryptedStorage encrypts the objects stored in backend with the keys of keys
+func NewEncryptedStorage(backend Storage, keys *keyring) *EncryptedStorage {
+	return &EncryptedStorage{backend: backend, keys: keys}
+}
+
+func (s *EncryptedStorage) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	obj, info, err := s.backend.Get(ctx, key)
+	if err != nil {
+		return nil, info, err
+	}
+	header := make([]byte, encryptionHeaderSize)
+	n, err := io.ReadFull(obj, header)
+	if (err == nil || err == io.ErrUnexpectedEOF || err == io.EOF) && !bytes.HasPrefix(header[:n], []byte(encryptionMagic)) {
+		// Not encrypted yet
+		return plainObject(obj, header[:n], info)
+	}
+	if err != nil {
+		obj.Close()
+		return nil, info, errors.Wrap(err, "reading encryption header")
+	}
+	dataKey, err := s.keys.unwrap(header)
+	if err != nil {
+		obj.Close()
+		return nil, info, errors.Wrapf(err, "decrypting %s", key)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		obj.Close()
+		return nil, info, err
+	}
+	info.Size = plaintextSize(info.Size)
+	return newDecryptingReader(obj, aead, info.Size), info, nil
+}
+
+// plainObject returns an unencrypted object whose first bytes were already read
+func plainObject(obj io.ReadCloser, head []byte, info ObjectInfo) (io.ReadCloser, ObjectInfo, error) {
+	if rs, ok := obj.(io.ReadSeeker); ok {
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			obj.Close()
+			return nil, info, err
+		}
+		return obj, info, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), obj), obj}, info, nil
+}
+
+func (s *EncryptedStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return errors.Wrap(err, "generating data key")
+	}
+	header, err := s.keys.wrap(dataKey)
+	if err != nil {
+		return errors.Wrap(err, "wrapping data key")
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	er := &encryptingReader{r: bufio.NewReaderSize(r, encryptionChunkSize), aead: aead, buf: header}
+	return s.backend.Put(ctx, key, er, encryptedSize(size))
+}
+
+func (s *EncryptedStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := s.backend.Stat(ctx, key)
+	if err != nil {
+		return info, err
+	}
+	info.Size = plaintextSize(info.Size)
+	return info, nil
+}
+
+func (s *EncryptedStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects, err := s.backend.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i := range objects {
+		objects[i].Size = plaintextSize(objects[i].Size)
+	}
+	return objects, nil
+}
+
+func (s *EncryptedStorage) Delete(ctx context.Context, key string) error {
+	return s.backend.Delete(ctx, key)
+}
+
+// rotationReport summarizes a key rotation
+type rotationReport struct {
+	Rewrapped int `json:"rewrapped"` // Objects whose data key was wrapped with the active key
+	Encrypted int `json:"encrypted"` // Objects stored before encryption was enabled
+	Failed    int `json:"failed"`
+}
+
+// RotateKeys reloads the keys and wraps the data keys of all objects with the active key.
+// Only the headers change, the content is copied as it is. Unencrypted objects are encrypted.
+// Each object is rotated holding lock(key), which must exclude the other writes of the object,
+// otherwise a write while it's rotated may be reverted.
+func (s *EncryptedStorage) RotateKeys(ctx context.Context, lock func(key string) func()) (*rotationReport, error) {
+	err := s.keys.Reload()
+	if err != nil {
+		return nil, err
+	}
+	objects, err := s.backend.List(ctx, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "listing storage")
+	}
+	active := s.keys.activeKeyFingerprint()
+	report := &rotationReport{}
+	for _, o := range objects {
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		unlock := lock(o.Key)
+		rewrapped, encrypted, err := s.rotateObject(ctx, o.Key, active)
+		unlock()
+		switch {
+		case err == ErrNotFound:
+		case err != nil:
+			log.Printf("Rotating key of %s: %s", o.Key, err)
+			report.Failed++
+		case rewrapped:
+			report.Rewrapped++
+		case encrypted:
+			report.Encrypted++
+		}
+	}
+	return report, nil
+}
+
+func (s *EncryptedStorage) rotateObject(ctx context.Context, key string, active string) (bool, bool, error) {
+	obj, info, err := s.backend.Get(ctx, key)
+	if err != nil {
+		return false, false, err
+	}
+	defer obj.Close()
+	header := make([]byte, encryptionHeaderSize)
+	n, err := io.ReadFull(obj, header)
+	if !bytes.HasPrefix(header[:n], []byte(encryptionMagic)) {
+		r, info, err := plainObject(obj, header[:n], info)
+		if err != nil {
+			return false, false, err
+		}
+		return false, true, s.Put(ctx, key, r, info.Size)
+	}
+	if err != nil {
+		return false, false, errors.Wrap(err, "reading encryption header")
+	}
+	if string(header[len(encryptionMagic):len(encryptionMagic)+fingerprintSize]) == active {
+		return false, false, nil
+	}
+	dataKey, err := s.keys.unwrap(header)
+	if err != nil {
+		return false, false, err
+	}
+	newHeader, err := s.keys.wrap(dataKey)
+	if err != nil {
+		return false, false, err
+	}
+	return true, false, s.backend.Put(ctx, key, io.MultiReader(bytes.NewReader(newHeader), obj), info.Size)
+}
+
+// encryptingReader reads the encrypted form of r
+type encryptingReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	buf   []byte // Encrypted data not read yet
+	index int64
+	done  bool
+	chunk []byte
+}
+
+func (e *encryptingReader) Read(p []byte) (int, error) {
+	for len(e.buf) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if e.chunk == nil {
+			e.chunk = make([]byte, encryptionChunkSize)
+		}
+		n, err := io.ReadFull(e.r, e.chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		last := err != nil
+		if !last {
+			// A full chunk is the last one if nothing follows
+			if _, err := e.r.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+		e.buf = e.aead.Seal(e.buf[:0], chunkNonce(e.index, last), e.chunk[:n], nil)
+		e.index++
+		e.done = last
+	}
+	n := copy(p, e.buf)
+	e.buf = e.buf[n:]
+	return n, nil
+}
+
+// decryptingReader reads the content of an encrypted object, seeking if the object supports it
+type decryptingReader struct {
+	obj    io.ReadCloser
+	aead   cipher.AEAD
+	size   int64 // Size of the content
+	offset int64 // Offset of the next byte to read
+	index  int64 // Index of the decrypted chunk, -1 if none
+	next   int64 // Index of the chunk the object is positioned at
+	chunk  []byte
+	sealed []byte
+}
+
+func newDecryptingReader(obj io.ReadCloser, aead cipher.AEAD, size int64) *decryptingReader {
+	return &decryptingReader{obj: obj, aead: aead, size: size, index: -1}
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	if d.offset >= d.size {
+		if d.size == 0 && d.index < 0 {
+			// The single chunk of an empty object is still authenticated
+			if err := d.load(0); err != nil {
+				return 0, err
+			}
+		}
+		return 0, io.EOF
+	}
+	index := d.offset / encryptionChunkSize
+	if index != d.index {
+		if err := d.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.chunk[d.offset-index*encryptionChunkSize:])
+	d.offset += int64(n)
+	return n, nil
+}
+
+// load decrypts the chunk with the given index
+func (d *decryptingReader) load(index int64) error {
+	if index != d.next {
+		rs, ok := d.obj.(io.ReadSeeker)
+		if !ok {
+			return errors.New("object does not support seeking")
+		}
+		_, err := rs.Seek(int64(encryptionHeaderSize)+index*(encryptionChunkSize+gcmTagSize), io.SeekStart)
+		if err != nil {
+			return err
+		}
+	}
+
+	length := d.size - index*encryptionChunkSize
+	if length > encryptionChunkSize {
+		length = encryptionChunkSize
+	}
+	if d.sealed == nil {
+		d.sealed = make([]byte, encryptionChunkSize+gcmTagSize)
+	}
+	sealed := d.sealed[:length+gcmTagSize]
+	_, err := io.ReadFull(d.obj, sealed)
+	if err != nil {
+		return errCorruptCiphertext
+	}
+	d.next = index + 1
+	last := (index+1)*encryptionChunkSize >= d.size
+	d.chunk, err = d.aead.Open(d.chunk[:0], chunkNonce(index, last), sealed, nil)
+	if err != nil {
+		d.index = -1
+		return errCorruptCiphertext
+	}
+	d.index = index
+	return nil
+}
+
+func (d *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	if _, ok := d.obj.(io.ReadSeeker); !ok {
+		return 0, errors.New("object does not support seeking")
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	d.offset = offset
+	return offset, nil
+}
+
+func (d *decryptingReader) Close() error {
+	return d.obj.Close()
+}
+
+// serveRotateKeys rotates the encryption keys on demand, POST /api/keys/rotate
+func (s *fileServer) serveRotateKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeAdmin(s.adminToken, len(s.secret) > 0, w, r) {
+		return
+	}
+	if s.encryption == nil {
+		http.Error(w, "encryption is not enabled", http.StatusConflict)
+		return
+	}
+	report, err := s.encryption.RotateKeys(r.Context(), s.lockObject)
+	if err != nil {
+		log.Printf("Rotating encryption keys: %s", err)
+		http.Error(w, "rotating keys failed", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Rotated encryption keys: %d rewrapped, %d encrypted, %d failed", report.Rewrapped, report.Encrypted, report.Failed)
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestKeyring(t *testing.T, dir string, names ...string) *keyring {
+	for _, name := range names {
+		key := make([]byte, dataKeySize)
+		_, err := rand.Read(key)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(base64.StdEncoding.EncodeToString(key)), 0600))
+	}
+	k := &keyring{dir: dir}
+	require.NoError(t, k.Reload())
+	return k
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileserver")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "keys"), 0700))
+	keys := newTestKeyring(t, filepath.Join(dir, "keys"), "key1")
+
+	testStorage(t, NewEncryptedStorage(NewLocalStorage(filepath.Join(dir, "store")), keys))
+
+	srv := newFakeS3("chaincodes")
+	defer srv.Close()
+	s3, err := NewS3Storage(S3Config{
+		Endpoint:        srv.URL,
+		Region:          "us-east-1",
+		Bucket:          "chaincodes",
+		AccessKeyID:     "minio",
+		SecretAccessKey: "minio123",
+	})
+	require.NoError(t, err)
+	testStorage(t, NewEncryptedStorage(s3, keys))
+}
+
+func TestEncryptedStorageChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileserver")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keys := newTestKeyring(t, dir, "key1")
+	backend := NewLocalStorage(filepath.Join(dir, "store"))
+	s := NewEncryptedStorage(backend, keys)
+	ctx := context.Background()
+
+	for _, size := range []int{0, 1, encryptionChunkSize, encryptionChunkSize + 1, 3*encryptionChunkSize - 7} {
+		data := make([]byte, size)
+		rand.Read(data)
+		require.NoError(t, s.Put(ctx, "build1/chaincode-output.tar", bytes.NewReader(data), -1))
+
+		raw, info, err := backend.Get(ctx, "build1/chaincode-output.tar")
+		require.NoError(t, err)
+		raw.Close()
+		assert.Equal(t, encryptedSize(int64(size)), info.Size, size)
+
+		r, info, err := s.Get(ctx, "build1/chaincode-output.tar")
+		require.NoError(t, err)
+		assert.EqualValues(t, size, info.Size)
+		decrypted, err := ioutil.ReadAll(r)
+		require.NoError(t, err, size)
+		assert.True(t, bytes.Equal(data, decrypted), size)
+
+		// Seek back and forth across chunks
+		rs := r.(io.ReadSeeker)
+		for _, offset := range []int{size / 2, 0, size - 1} {
+			if offset < 0 {
+				continue
+			}
+			_, err = rs.Seek(int64(offset), io.SeekStart)
+			require.NoError(t, err)
+			rest, err := ioutil.ReadAll(rs)
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(data[offset:], rest), "size %d offset %d", size, offset)
+		}
+		r.Close()
+	}
+
+	// The content is not stored in clear
+	require.NoError(t, s.Put(ctx, "build1/chaincode-source.tar", bytes.NewReader(bytes.Repeat([]byte("secret"), 100)), 600))
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "store", "build1", "chaincode-source.tar"))
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("secret")))
+
+	// Tampering and truncation are detected
+	for _, corrupt := range [][]byte{
+		append(append([]byte{}, raw[:len(raw)-1]...), raw[len(raw)-1]^1),
+		raw[:len(raw)-1],
+	} {
+		require.NoError(t, backend.Put(ctx, "build1/chaincode-source.tar", bytes.NewReader(corrupt), int64(len(corrupt))))
+		r, _, err := s.Get(ctx, "build1/chaincode-source.tar")
+		require.NoError(t, err)
+		_, err = ioutil.ReadAll(r)
+		r.Close()
+		assert.Equal(t, errCorruptCiphertext, err)
+	}
+}
+
+func TestRotateKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileserver")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keysDir := filepath.Join(dir, "keys")
+	require.NoError(t, os.Mkdir(keysDir, 0700))
+	keys := newTestKeyring(t, keysDir, "2020-01")
+	backend := NewLocalStorage(filepath.Join(dir, "store"))
+	s := NewEncryptedStorage(backend, keys)
+	ctx := context.Background()
+
+	require.NoError(t, s.Put(ctx, "build1/chaincode-output.tar", bytes.NewReader([]byte("output")), 6))
+	// Stored before encryption was enabled
+	require.NoError(t, backend.Put(ctx, "build1/chaincode-source.tar", bytes.NewReader([]byte("source")), 6))
+	r, info, err := s.Get(ctx, "build1/chaincode-source.tar")
+	require.NoError(t, err)
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "source", string(data))
+	assert.EqualValues(t, 6, info.Size)
+
+	// A newer key becomes the active one. Every object is rotated holding its lock.
+	newTestKeyring(t, keysDir, "2020-06")
+	locked := map[string]bool{}
+	held := false
+	lock := func(key string) func() {
+		assert.False(t, held)
+		held = true
+		locked[key] = true
+		return func() { held = false }
+	}
+	report, err := s.RotateKeys(ctx, lock)
+	require.NoError(t, err)
+	assert.Equal(t, rotationReport{Rewrapped: 1, Encrypted: 1}, *report)
+	assert.Equal(t, map[string]bool{"build1/chaincode-output.tar": true, "build1/chaincode-source.tar": true}, locked)
+	assert.False(t, held)
+
+	// The old key is not needed anymore
+	require.NoError(t, os.Remove(filepath.Join(keysDir, "2020-01")))
+	require.NoError(t, keys.Reload())
+	for key, content := range map[string]string{"build1/chaincode-output.tar": "output", "build1/chaincode-source.tar": "source"} {
+		r, _, err := s.Get(ctx, key)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		require.NoError(t, err)
+		assert.Equal(t, content, string(data))
+	}
+
+	report, err = s.RotateKeys(ctx, lock)
+	require.NoError(t, err)
+	assert.Equal(t, rotationReport{}, *report)
+
+	// Without its key an object can't be read
+	require.NoError(t, os.Remove(filepath.Join(keysDir, "2020-06")))
+	newTestKeyring(t, keysDir, "2021-01")
+	require.NoError(t, keys.Reload())
+	_, _, err = s.Get(ctx, "build1/chaincode-output.tar")
+	assert.Error(t, err)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kfsoftware/externalbuilder/cmd/internal/signedurl"
+)
+
+const (
+	// eventHistorySize is the number of past events kept for the clients catching up
+	eventHistorySize = 1000
+	// eventBufferSize is the number of events queued for a client before it's disconnected
+	eventBufferSize = 100
+
+	defaultEventWait = 30 * time.Second
+	maxEventWait     = 5 * time.Minute
+	eventKeepAlive   = 15 * time.Second
+)
+
+// Event types
+const (
+	eventUploaded = "uploaded"
+	eventDeleted  = "deleted"
+)
+
+// artifactEvent tells that an artifact became available or was removed on this replica
+type artifactEvent struct {
+	ID       int64     `json:"id"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Tenant   string    `json:"tenant,omitempty"`
+	BuildID  string    `json:"build_id"`
+	Artifact string    `json:"artifact"`
+	Size     int64     `json:"size,omitempty"`
+	Digest   string    `json:"sha256,omitempty"`
+	Label    string    `json:"label,omitempty"`
+	Reason   string    `json:"reason,omitempty"` // Why the garbage collector removed the artifact
+}
+
+// eventHub distributes the artifact events to the subscribed clients, and keeps the
+// latest ones so clients can resume after a disconnection.
+// A nil eventHub discards the events.
+type eventHub struct {
+	mu          sync.Mutex
+	lastID      int64
+	history     []artifactEvent
+	subscribers map[chan artifactEvent]bool
+	closed      bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subscribers: map[chan artifactEvent]bool{}}
+}
+
+// Publish numbers an event and sends it to the subscribers. Subscribers that don't keep up
+// are disconnected by closing their channel.
+func (h *eventHub) Publish(e artifactEvent) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastID++
+	e.ID = h.lastID
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	h.history = append(h.history, e)
+	if len(h.history) > eventHistorySize {
+		h.history = h.history[len(h.history)-eventHistorySize:]
+	}
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns the kept events after the given ID and a channel receiving the next ones,
+// which is closed when the subscriber falls behind or the hub is closed
+func (h *eventHub) Subscribe(after int64) ([]artifactEvent, chan artifactEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	backlog := []artifactEvent{}
+	for _, e := range h.history {
+		if e.ID > after {
+			backlog = append(backlog, e)
+		}
+	}
+	ch := make(chan artifactEvent, eventBufferSize)
+	if h.closed {
+		close(ch)
+		return backlog, ch
+	}
+	h.subscribers[ch] = true
+	return backlog, ch
+}
+
+// Unsubscribe stops sending events to ch
+func (h *eventHub) Unsubscribe(ch chan artifactEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[ch] {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Close disconnects the subscribers, so their requests finish on shutdown
+func (h *eventHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// publish emits an event about an artifact of the tenant of s
+func (s *fileServer) publish(eventType string, md *ArtifactMetadata) {
+	s.events.Publish(artifactEvent{
+		Type:     eventType,
+		Tenant:   s.tenant,
+		BuildID:  md.BuildID,
+		Artifact: md.Artifact,
+		Size:     md.Size,
+		Digest:   md.Digest,
+		Label:    md.Label,
+	})
+}
+
+// eventFilter selects the events sent to a client
+type eventFilter struct {
+	allTenants bool
+	tenant     string
+	buildID    string
+	artifact   string
+}
+
+func (f eventFilter) match(e artifactEvent) bool {
+	return (f.allTenants || e.Tenant == f.tenant) &&
+		(f.buildID == "" || e.BuildID == f.buildID) &&
+		(f.artifact == "" || e.Artifact == f.artifact)
+}
+
+// serveEvents streams the artifact events, GET /api/events?build_id=<buildID>&artifact=<artifact>.
+// With Accept: text/event-stream the events are sent as Server-Sent Events, otherwise the request
+// waits up to wait for events and returns them as a JSON array (long polling). Clients resume
+// after the event ID passed in the Last-Event-ID header or the after parameter.
+// The events of a build can be read with an URL signed for reading the build, the others
+// require the admin token.
+func (s *fileServer) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	filter := eventFilter{tenant: s.tenant, buildID: q.Get("build_id"), artifact: q.Get("artifact")}
+	if filter.buildID != "" && q.Get(signedurl.ParamSignature) != "" {
+		if !authorize(s.secret, filter.buildID, w, r) {
+			return
+		}
+	} else {
+		if !authorizeAdmin(s.adminToken, len(s.secret) > 0, w, r) {
+			return
+		}
+		if s.partition == nil {
+			// Events of all tenants, unless one is selected
+			filter.tenant = q.Get("tenant")
+			_, selected := q["tenant"]
+			filter.allTenants = !selected
+		}
+	}
+
+	after := r.Header.Get("Last-Event-ID")
+	if value := q.Get("after"); value != "" {
+		after = value
+	}
+	var afterID int64
+	if after != "" {
+		var err error
+		afterID, err = strconv.ParseInt(after, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid event ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	backlog, ch := s.events.Subscribe(afterID)
+	defer s.events.Unsubscribe(ch)
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		s.streamEvents(filter, backlog, ch, w, r)
+		return
+	}
+
+	wait := defaultEventWait
+	if value := q.Get("wait"); value != "" {
+		var err error
+		wait, err = time.ParseDuration(value)
+		if err != nil || wait < 0 {
+			http.Error(w, "invalid wait", http.StatusBadRequest)
+			return
+		}
+		if wait > maxEventWait {
+			wait = maxEventWait
+		}
+	}
+	events := []artifactEvent{}
+	for _, e := range backlog {
+		if filter.match(e) {
+			events = append(events, e)
+		}
+	}
+	if len(events) == 0 && wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+	poll:
+		for {
+			select {
+			case e, ok := <-ch:
+				if !ok {
+					break poll
+				}
+				if filter.match(e) {
+					events = append(events, e)
+					break poll
+				}
+			case <-timer.C:
+				break poll
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+// streamEvents sends the events as Server-Sent Events until the client goes away
+// or ch is closed
+func (s *fileServer) streamEvents(filter eventFilter, backlog []artifactEvent, ch chan artifactEvent, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(e artifactEvent) error {
+		if !filter.match(e) {
+			return nil
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		return err
+	}
+	for _, e := range backlog {
+		if err := send(e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := send(e); err != nil {
+				log.Printf("Sending event to %s: %s", r.RemoteAddr, err)
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
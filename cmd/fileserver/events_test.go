@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kfsoftware/externalbuilder/cmd/internal/signedurl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventHub(t *testing.T) {
+	h := newEventHub()
+	h.Publish(artifactEvent{Type: eventUploaded, BuildID: "build1"})
+	backlog, ch := h.Subscribe(0)
+	require.Len(t, backlog, 1)
+	assert.EqualValues(t, 1, backlog[0].ID)
+	assert.False(t, backlog[0].Time.IsZero())
+
+	h.Publish(artifactEvent{Type: eventDeleted, BuildID: "build1"})
+	e := <-ch
+	assert.EqualValues(t, 2, e.ID)
+	backlog, other := h.Subscribe(1)
+	require.Len(t, backlog, 1)
+	assert.EqualValues(t, 2, backlog[0].ID)
+
+	// A subscriber that doesn't keep up is disconnected
+	for i := 0; i <= eventBufferSize; i++ {
+		h.Publish(artifactEvent{Type: eventUploaded, BuildID: "build2"})
+	}
+	for range ch {
+	}
+	h.Unsubscribe(ch)
+
+	h.Close()
+	for range other {
+	}
+	_, ch = h.Subscribe(0)
+	_, ok := <-ch
+	assert.False(t, ok)
+
+	var nilHub *eventHub
+	nilHub.Publish(artifactEvent{})
+}
+
+func TestEventsLongPoll(t *testing.T) {
+	s, cleanup := newTestFileServer(t)
+	defer cleanup()
+	s.secret = []byte("secret")
+	s.adminToken = "admin"
+	h := s.routes()
+	admin := map[string]string{"Authorization": "Bearer admin"}
+
+	rec := doRequest(t, h, "GET", "/api/events?wait=0", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = doRequest(t, h, "GET", "/api/events?wait=0", "", admin)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "[]\n", rec.Body.String())
+
+	// Waits for the next event
+	done := make(chan []artifactEvent)
+	go func() {
+		rec := doRequest(t, h, "GET", "/api/events?wait=10s&artifact=chaincode-output.tar", "", admin)
+		var events []artifactEvent
+		json.Unmarshal(rec.Body.Bytes(), &events)
+		done <- events
+	}()
+	time.Sleep(50 * time.Millisecond)
+	rec = doRequest(t, h, "POST", signedPath("/build1/chaincode-source.tar", "secret", "build1", signedurl.Write), "source", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = doRequest(t, h, "POST", signedPath("/build1/chaincode-output.tar", "secret", "build1", signedurl.Write), "output", map[string]string{labelHeader: "fabcar_1"})
+	require.Equal(t, http.StatusOK, rec.Code)
+	events := <-done
+	require.Len(t, events, 1)
+	assert.Equal(t, eventUploaded, events[0].Type)
+	assert.Equal(t, "build1", events[0].BuildID)
+	assert.Equal(t, "chaincode-output.tar", events[0].Artifact)
+	assert.Equal(t, "fabcar_1", events[0].Label)
+	assert.EqualValues(t, 6, events[0].Size)
+	assert.NotEmpty(t, events[0].Digest)
+
+	rec = doRequest(t, h, "DELETE", "/api/builds/build1", "", admin)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	// A signed URL gives access to the events of its build
+	path := signedPath("/api/events?build_id=build1&after=1&wait=0", "secret", "build1", signedurl.Read)
+	rec = doRequest(t, h, "GET", path, "", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &events))
+	require.Len(t, events, 3)
+	assert.Equal(t, []string{eventUploaded, eventDeleted, eventDeleted}, []string{events[0].Type, events[1].Type, events[2].Type})
+	path = strings.Replace(path, "build_id=build1", "build_id=build2", 1)
+	rec = doRequest(t, h, "GET", path, "", nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func TestEventsStream(t *testing.T) {
+	s, cleanup := newTestFileServer(t)
+	defer cleanup()
+	srv := httptest.NewServer(s.routes())
+	defer srv.Close()
+	s.publish(eventUploaded, &ArtifactMetadata{BuildID: "build1", Artifact: "chaincode-source.tar"})
+
+	req, err := http.NewRequest("GET", srv.URL+"/api/events?build_id=build2", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	s.publish(eventUploaded, &ArtifactMetadata{BuildID: "build2", Artifact: "chaincode-output.tar"})
+	scanner := bufio.NewScanner(resp.Body)
+	lines := []string{}
+	for len(lines) < 3 && scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	require.Len(t, lines, 3)
+	assert.Equal(t, "id: 2", lines[0])
+	assert.Equal(t, "event: uploaded", lines[1])
+	var e artifactEvent
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &e))
+	assert.Equal(t, "build2", e.BuildID)
+
+	// Closing the hub ends the stream
+	s.events.Close()
+	for scanner.Scan() {
+	}
+	assert.NoError(t, scanner.Err())
+}
@@ -1,55 +1,529 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kfsoftware/externalbuilder/cmd/internal/compression"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// fileServer stores the chaincode sources and build outputs exchanged between
+// the launcher, the builder pods and the chaincode pods
+type fileServer struct {
+	storage       Storage
+	secret        []byte
+	adminToken    string
+	maxUploadSize int64
+	gc            *garbageCollector
+	uploads       *partialUploads
+	health        *health
+	replicator    *replicator
+	encryption    *EncryptedStorage // nil if encryption at rest is disabled
+	audit         *auditLog
+	events        *eventHub
+	upstream      *upstream // nil if there is no upstream file server
+
+	tenants map[string]*fileServer // By name
+
+	// Set on the file servers of the tenants
+	tenant    string
+	partition *tenantStorage
+	handler   http.Handler // Serves the requests under /tenants/<tenant>/
+}
+
+// commands are the subcommands of the file server, serve is the default one
+var commands = map[string]func(args []string) error{
+	"serve":  serve,
+	"ls":     listCommand,
+	"gc":     gcCommand,
+	"verify": verifyCommand,
+	"export": exportCommand,
+	"import": importCommand,
+}
+
 func main() {
-	sharedDir := os.Getenv("CHAINCODE_SHARED_DIR")
-	fs := http.FileServer(http.Dir(sharedDir))
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q, usage: %s [serve|ls|gc|verify|export|import] [flags]\n", name, os.Args[0])
+		os.Exit(2)
+	}
+	err := command(args)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// openStorage opens the storage configured by the environment, which is encrypted
+// if ENCRYPTION_KEYS_DIR is set. The returned EncryptedStorage is nil otherwise.
+func openStorage() (Storage, *EncryptedStorage, error) {
+	storage, err := newStorageFromEnv()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "configuring storage")
+	}
+	keys, err := newKeyringFromEnv()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "configuring encryption")
+	}
+	if keys == nil {
+		return storage, nil, nil
+	}
+	log.Printf("Encrypting artifacts with the keys in %s", keys.dir)
+	encryption := NewEncryptedStorage(storage, keys)
+	return encryption, encryption, nil
+}
 
-	http.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
-		log.Printf("Url=%s Method %s", request.URL.Path, request.Method)
-		if request.Method == "POST" {
-			serveUpload(sharedDir, writer, request)
-		} else if request.Method == "GET" {
-			fs.ServeHTTP(writer, request)
+// serve runs the HTTP server until SIGTERM or SIGINT
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		return errors.Errorf("unexpected arguments %s", strings.Join(flags.Args(), " "))
+	}
+
+	storage, encryption, err := openStorage()
+	if err != nil {
+		return err
+	}
+
+	maxUploadSize, err := getMaxUploadSize()
+	if err != nil {
+		return errors.Wrap(err, "configuring uploads")
+	}
+
+	gcPolicy, gcInterval, err := getGCConfig()
+	if err != nil {
+		return errors.Wrap(err, "configuring garbage collection")
+	}
+
+	uploads, err := newPartialUploads()
+	if err != nil {
+		return errors.Wrap(err, "configuring resumable uploads")
+	}
+
+	shutdownTimeout := 30 * time.Second
+	if value := os.Getenv("SHUTDOWN_TIMEOUT"); value != "" {
+		shutdownTimeout, err = time.ParseDuration(value)
+		if err != nil {
+			return errors.Wrap(err, "parsing SHUTDOWN_TIMEOUT")
 		}
-	})
+	}
+
+	audit, err := newAuditLogFromEnv()
+	if err != nil {
+		return errors.Wrap(err, "configuring audit log")
+	}
+	defer audit.Close()
+
+	secret := []byte(os.Getenv("FILE_SERVER_SECRET"))
+	if len(secret) == 0 {
+		log.Printf("FILE_SERVER_SECRET is not set, requests will not be authenticated")
+	}
+
+	replicationCtx, replicationCancel := context.WithCancel(context.Background())
+	defer replicationCancel()
+	replicator, err := newReplicatorFromEnv(replicationCtx, storage, secret)
+	if err != nil {
+		return errors.Wrap(err, "configuring replication")
+	}
+	if len(replicator.peers) > 0 {
+		log.Printf("Replicating to %s", strings.Join(replicator.peers, ", "))
+	}
+
+	upstream, err := newUpstreamFromEnv()
+	if err != nil {
+		return errors.Wrap(err, "configuring upstream")
+	}
+	if upstream != nil {
+		log.Printf("Fetching missing artifacts from %s", upstream.url)
+	}
+
+	events := newEventHub()
+	s := &fileServer{
+		storage:       storage,
+		secret:        secret,
+		adminToken:    os.Getenv("ADMIN_TOKEN"),
+		maxUploadSize: maxUploadSize,
+		gc:            &garbageCollector{storage: storage, policy: gcPolicy, events: events},
+		uploads:       uploads,
+		health:        &health{storage: storage},
+		replicator:    replicator,
+		encryption:    encryption,
+		audit:         audit,
+		events:        events,
+		upstream:      upstream,
+		tenants:       map[string]*fileServer{},
+	}
+	s.gc.deleteFromPeers = s.deleteFromPeers
+	s.gc.lock = s.lockObject
+	if path := os.Getenv("TENANTS_FILE"); path != "" {
+		tenants, err := loadTenants(path, secret, replicator.secret)
+		if err != nil {
+			return errors.Wrap(err, "configuring tenants")
+		}
+		for name, cfg := range tenants {
+			s.tenants[name], err = s.newTenantServer(name, cfg)
+			if err != nil {
+				return errors.Wrapf(err, "configuring tenant %s", name)
+			}
+		}
+		log.Printf("Serving %d tenants", len(tenants))
+	}
+	prometheus.MustRegister(newStorageCollector(storage))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go uploads.ExpireLoop(ctx)
+	for _, t := range s.tenants {
+		go t.uploads.ExpireLoop(ctx)
+	}
+	if encryption != nil {
+		// Encrypt the artifacts stored before, and the ones under a previous key with the active one.
+		// The artifacts are locked while they're rotated, so uploads aren't reverted.
+		go func() {
+			report, err := encryption.RotateKeys(ctx, s.lockObject)
+			if err != nil {
+				log.Printf("Rotating encryption keys: %s", err)
+				return
+			}
+			log.Printf("Rotated encryption keys: %d rewrapped, %d encrypted, %d failed", report.Rewrapped, report.Encrypted, report.Failed)
+		}()
+	}
+	if gcInterval > 0 {
+		log.Printf("Running garbage collection every %s", gcInterval)
+		go s.gc.Loop(ctx, gcInterval)
+	}
+
 	httpAddress := os.Getenv("HTTP_ADDRESS")
 	if httpAddress == "" {
 		httpAddress = ":8080"
 	}
-	log.Printf("Listening on %s", httpAddress)
-	err := http.ListenAndServe(httpAddress, nil)
+	tlsConfig, err := getTLSConfig()
+	if err != nil {
+		return errors.Wrap(err, "configuring TLS")
+	}
+	servers := []*http.Server{
+		{
+			Addr:      httpAddress,
+			Handler:   s.routes(),
+			TLSConfig: tlsConfig,
+		},
+	}
+	// Probes and scrapers usually can't present client certificates, so
+	// monitoring can be served on a separate plain HTTP listener
+	if monitoringAddress := os.Getenv("MONITORING_ADDRESS"); monitoringAddress != "" {
+		servers = append(servers, &http.Server{
+			Addr:    monitoringAddress,
+			Handler: s.monitoringRoutes(),
+		})
+	}
+
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			var err error
+			if server.TLSConfig != nil {
+				log.Printf("Listening on %s (TLS)", server.Addr)
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				log.Printf("Listening on %s", server.Addr)
+				err = server.ListenAndServe()
+			}
+			errs <- err
+		}(server)
+	}
+
+	// Stop accepting requests on SIGTERM and SIGINT, and wait for
+	// the in-flight ones like uploads to finish
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errs:
+		return errors.Wrap(err, "starting server")
+	case sig := <-sigs:
+		log.Printf("Received %s, shutting down", sig)
+	}
+
+	s.health.ShutDown()
+	// Event streams would keep the shutdown waiting
+	events.Close()
+	cancel()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer shutdownCancel()
+	for _, server := range servers {
+		err := server.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Printf("Shutting down %s: %s", server.Addr, err)
+		}
+	}
+	err = replicator.Wait(shutdownCtx)
+	for _, t := range s.tenants {
+		if err == nil {
+			err = t.replicator.Wait(shutdownCtx)
+		}
+	}
 	if err != nil {
-		log.Fatalf("Failed to start server")
+		log.Printf("Waiting for pending replications: %s", err)
 	}
+	log.Printf("Shut down")
+	return nil
+}
+
+func (s *fileServer) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.serveArtifact)
+	mux.HandleFunc("/api/gc", s.serveGC)
+	mux.HandleFunc("/api/builds", s.serveBuilds)
+	mux.HandleFunc("/api/builds/", s.serveBuild)
+	mux.HandleFunc("/api/replicate/", s.serveReplica)
+	mux.HandleFunc("/api/keys/rotate", s.serveRotateKeys)
+	mux.HandleFunc("/api/events", s.serveEvents)
+	mux.HandleFunc("/"+tenantsPrefix, s.serveTenant)
+	s.addMonitoringRoutes(mux)
+	return instrument(mux, s.audit)
 }
 
-func serveUpload(sharedDir string, w http.ResponseWriter, r *http.Request) {
-	body, err := ioutil.ReadAll(r.Body)
+func (s *fileServer) monitoringRoutes() http.Handler {
+	mux := http.NewServeMux()
+	s.addMonitoringRoutes(mux)
+	return mux
+}
+
+func (s *fileServer) addMonitoringRoutes(mux *http.ServeMux) {
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", s.health.serveHealthz)
+	mux.HandleFunc("/readyz", s.health.serveReadyz)
+}
+
+func (s *fileServer) serveArtifact(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Url=%s Method %s", r.URL.Path, r.Method)
+	if r.Method != "POST" && r.Method != "PUT" && r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	buildID, artifact, err := parseArtifactPath(r.URL.Path)
+	if err != nil {
+		log.Printf("Rejecting %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, err)
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	if !authorize(s.secret, buildID, w, r) {
+		return
+	}
+	switch r.Method {
+	case "POST":
+		s.serveUpload(buildID, artifact, w, r)
+	case "PUT":
+		s.serveChunk(buildID, artifact, w, r)
+	default:
+		s.serveDownload(buildID, artifact, w, r)
+	}
+}
+
+func (s *fileServer) serveDownload(buildID string, artifact string, w http.ResponseWriter, r *http.Request) {
+	key := artifactKey(buildID, artifact)
+	obj, info, md, err := s.openArtifact(r.Context(), key)
+	if err == ErrNotFound && len(s.replicator.peers) > 0 {
+		// Not replicated here yet, or this replica missed it
+		err = s.fetchFromPeers(r.Context(), buildID, artifact)
+		if err == nil {
+			obj, info, md, err = s.openArtifact(r.Context(), key)
+		} else if err != ErrNotFound {
+			log.Printf("Fetching %s from peers: %s", key, err)
+			err = ErrNotFound
+		}
+	}
+	if err == ErrNotFound && s.upstream != nil {
+		// Built in another cluster
+		err = s.fetchFromUpstream(r.Context(), buildID, artifact)
+		if err == nil {
+			obj, info, md, err = s.openArtifact(r.Context(), key)
+		} else if err != ErrNotFound {
+			log.Printf("Fetching %s from upstream: %s", key, err)
+			err = ErrNotFound
+		}
+	}
+	if err == ErrNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Reading %s: %s", key, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer obj.Close()
+
+	if md != nil {
+		setDigestHeader(w, md)
+		if md.Label != "" {
+			w.Header().Set(labelHeader, md.Label)
+		}
+		s.touch(r.Context(), key, md)
+	}
+
+	if md != nil && md.Encoding != compression.None {
+		w.Header().Set("Vary", "Accept-Encoding")
+		if !compression.Accepts(r.Header.Get("Accept-Encoding"), md.Encoding) {
+			s.serveDecompressed(key, md, obj, w, r)
+			return
+		}
+		w.Header().Set("Content-Encoding", md.Encoding)
+	}
+	if rs, ok := obj.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, key, info.ModTime, rs)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", info.Size))
+	_, err = io.Copy(w, obj)
+	if err != nil {
+		log.Printf("Sending %s: %s", key, err)
+	}
+}
+
+// openArtifact opens an artifact and reads its metadata, nil if it has none. Both are read holding
+// the lock of the artifact, which uploads hold until they wrote the metadata too, so the digest
+// matches the content. Reading a local object keeps returning the content opened; objects read
+// lazily, from S3, fail with errObjectChanged once replaced, which cuts the download short.
+func (s *fileServer) openArtifact(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, *ArtifactMetadata, error) {
+	unlock := s.lockArtifact(key)
+	defer unlock()
+	obj, info, err := s.storage.Get(ctx, key)
+	if err != nil {
+		return nil, info, nil, err
+	}
+	md, err := readMetadata(ctx, s.storage, key)
 	if err != nil {
-		fmt.Println(err)
+		if err != ErrNotFound {
+			log.Printf("Reading metadata of %s: %s", key, err)
+		}
+		md = nil
+	}
+	return obj, info, md, nil
+}
+
+// serveDecompressed sends a compressed artifact to a client that doesn't accept its encoding.
+// The content can't be seeked, so range requests are rejected rather than answered with
+// the start of the content.
+func (s *fileServer) serveDecompressed(key string, md *ArtifactMetadata, obj io.Reader, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Accept-Ranges", "none")
+	if r.Header.Get("Range") != "" {
+		size := "*"
+		if md.UncompressedSize > 0 {
+			size = strconv.FormatInt(md.UncompressedSize, 10)
+		}
+		w.Header().Set("Content-Range", "bytes */"+size)
+		http.Error(w, "range requests need the stored encoding, "+md.Encoding, http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	dr, err := compression.NewReader(obj, md.Encoding)
+	if err != nil {
+		log.Printf("Decompressing %s: %s", key, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer dr.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, err = io.Copy(w, dr)
+	if err != nil {
+		log.Printf("Sending %s: %s", key, err)
+	}
+}
+
+// accessTimeResolution is how often the access time of an artifact is updated,
+// the garbage collector evicts the least recently used artifacts with this precision
+const accessTimeResolution = time.Hour
+
+// touch records the access to an artifact for the garbage collector. The access time is
+// only written once it's older than accessTimeResolution, so downloads don't write to the storage.
+func (s *fileServer) touch(ctx context.Context, key string, md *ArtifactMetadata) {
+	now := time.Now()
+	if now.Sub(md.LastAccess) < accessTimeResolution {
+		return
+	}
+	unlock := s.lockArtifact(key)
+	defer unlock()
+	// Update the current metadata, the artifact may have been uploaded again since md was read
+	current, err := readMetadata(ctx, s.storage, key)
+	if err != nil {
+		log.Printf("Reading metadata of %s: %s", key, err)
 		return
 	}
-	completePath := fmt.Sprintf("%s%s", sharedDir, r.URL.Path)
-	log.Printf("File will be uploaded to %s", completePath)
-	dir := filepath.Dir(r.URL.Path)
-	err = os.MkdirAll(fmt.Sprintf("%s%s", sharedDir, dir), 0755)
+	current.LastAccess = now
+	err = writeMetadata(ctx, s.storage, key, current)
 	if err != nil {
-		fmt.Println(err)
+		log.Printf("Writing metadata of %s: %s", key, err)
+	}
+}
+
+// lockArtifact serializes the changes of the artifact under key and of its metadata:
+// stores, deletes, access time updates and key rotations
+func (s *fileServer) lockArtifact(key string) func() {
+	if s.uploads == nil {
+		return func() {}
+	}
+	return s.uploads.lock(metadataKey(key))
+}
+
+// lockObject locks the artifact an object of the storage belongs to, with the locks of
+// the server of its tenant
+func (s *fileServer) lockObject(key string) func() {
+	key = strings.TrimSuffix(key, metadataSuffix)
+	if rest := strings.TrimPrefix(key, tenantsPrefix); rest != key {
+		parts := strings.SplitN(rest, "/", 2)
+		if t, ok := s.tenants[parts[0]]; ok && len(parts) == 2 {
+			return t.lockArtifact(parts[1])
+		}
+	}
+	return s.lockArtifact(key)
+}
+
+// serveGC runs the garbage collector on demand, POST /api/gc?dry_run=true only reports
+// what would be removed
+func (s *fileServer) serveGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeAdmin(s.adminToken, len(s.secret) > 0, w, r) {
 		return
 	}
-	err = ioutil.WriteFile(completePath, body, 0755)
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	report, err := s.gc.Run(r.Context(), dryRun)
 	if err != nil {
-		fmt.Println(err)
+		log.Printf("GC failed: %s", err)
+		http.Error(w, "garbage collection failed", http.StatusInternalServerError)
 		return
 	}
-	return
+	writeJSON(w, http.StatusOK, report)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("Writing response: %s", err)
+	}
 }
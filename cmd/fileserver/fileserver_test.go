@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kfsoftware/externalbuilder/cmd/internal/compression"
+	"github.com/kfsoftware/externalbuilder/cmd/internal/digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestFileServer(t *testing.T) (*fileServer, func()) {
+	dir, err := ioutil.TempDir("", "fileserver")
+	require.NoError(t, err)
+	storage := NewLocalStorage(dir + "/store")
+	s := &fileServer{
+		storage:       storage,
+		maxUploadSize: defaultMaxUploadSize,
+		gc:            &garbageCollector{storage: storage},
+		uploads:       &partialUploads{dir: dir, locks: map[string]*sync.Mutex{}},
+		health:        &health{storage: storage},
+		replicator:    &replicator{storage: storage},
+		events:        newEventHub(),
+	}
+	s.gc.deleteFromPeers = s.deleteFromPeers
+	s.gc.lock = s.lockObject
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func doRequest(t *testing.T, h http.Handler, method, path, body string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestResumableUpload(t *testing.T) {
+	s, cleanup := newTestFileServer(t)
+	defer cleanup()
+	h := s.routes()
+	path := "/build1/chaincode-output.tar"
+
+	rec := doRequest(t, h, "PUT", path, "", map[string]string{"Content-Range": "bytes */10"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "0", rec.Header().Get(uploadOffsetHeader))
+
+	rec = doRequest(t, h, "PUT", path, "01234", map[string]string{"Content-Range": "bytes 0-4/10"})
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Equal(t, "5", rec.Header().Get(uploadOffsetHeader))
+
+	// A chunk sent twice is rejected with the current offset
+	rec = doRequest(t, h, "PUT", path, "01234", map[string]string{"Content-Range": "bytes 0-4/10"})
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Equal(t, "5", rec.Header().Get(uploadOffsetHeader))
+
+	// An interrupted chunk keeps the received data
+	rec = doRequest(t, h, "PUT", path, "56", map[string]string{"Content-Range": "bytes 5-9/10"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "7", rec.Header().Get(uploadOffsetHeader))
+
+	rec = doRequest(t, h, "PUT", path, "789", map[string]string{"Content-Range": "bytes 7-9/10", labelHeader: "fabcar_1"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = doRequest(t, h, "GET", path, "", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "0123456789", rec.Body.String())
+
+	rec = doRequest(t, h, "GET", path, "", map[string]string{"Range": "bytes=4-"})
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, "456789", rec.Body.String())
+
+	// Once stored, the upload is reported as complete
+	rec = doRequest(t, h, "PUT", path, "", map[string]string{"Content-Range": "bytes */10"})
+	assert.Equal(t, "10", rec.Header().Get(uploadOffsetHeader))
+
+	md, err := readMetadata(context.Background(), s.storage, "build1/chaincode-output.tar")
+	require.NoError(t, err)
+	assert.Equal(t, "fabcar_1", md.Label)
+	assert.EqualValues(t, 10, md.Size)
+	assert.Equal(t, "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882", md.Digest)
+}
+
+func TestUploadDigest(t *testing.T) {
+	s, cleanup := newTestFileServer(t)
+	defer cleanup()
+	h := s.routes()
+	path := "/build1/chaincode-source.tar"
+	// sha256 of "0123456789"
+	sum := "sha-256=hNiYd/DUBB77a/kaFvAkjy/Vc+avBcGflr7bn4gveII="
+
+	rec := doRequest(t, h, "POST", path, "012345678X", map[string]string{digest.Header: sum})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doRequest(t, h, "GET", path, "", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = doRequest(t, h, "POST", path, "0123456789", map[string]string{digest.Header: sum})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, sum, rec.Header().Get(digest.Header))
+
+	rec = doRequest(t, h, "HEAD", path, "", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, sum, rec.Header().Get(digest.Header))
+
+	// A corrupt upload leaves the stored artifact alone
+	rec = doRequest(t, h, "POST", path, "012345678X", map[string]string{digest.Header: sum})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doRequest(t, h, "GET", path, "", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "0123456789", rec.Body.String())
+	assert.Equal(t, sum, rec.Header().Get(digest.Header))
+}
+
+// gatedStorage blocks the writes of metadata while gate is set, after telling them on reached
+type gatedStorage struct {
+	Storage
+	gate    chan struct{}
+	reached chan struct{}
+}
+
+func (s *gatedStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if s.gate != nil && strings.HasSuffix(key, metadataSuffix) {
+		s.reached <- struct{}{}
+		<-s.gate
+	}
+	return s.Storage.Put(ctx, key, r, size)
+}
+
+func TestDownloadDuringUpload(t *testing.T) {
+	s, cleanup := newTestFileServer(t)
+	defer cleanup()
+	storage := &gatedStorage{Storage: s.storage}
+	s.storage = storage
+	h := s.routes()
+	path := "/build1/chaincode-source.tar"
+
+	rec := doRequest(t, h, "POST", path, "0123456789", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// The artifact is replaced, its metadata not written yet
+	storage.gate = make(chan struct{})
+	storage.reached = make(chan struct{})
+	uploaded := make(chan *httptest.ResponseRecorder)
+	go func() {
+		uploaded <- doRequest(t, h, "POST", path, "abcdefghij", nil)
+	}()
+	<-storage.reached
+
+	// Downloads wait for the metadata, so the digest matches the content
+	downloaded := make(chan *httptest.ResponseRecorder)
+	go func() {
+		downloaded <- doRequest(t, h, "GET", path, "", nil)
+	}()
+	select {
+	case <-downloaded:
+		t.Fatal("download didn't wait for the upload")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(storage.gate)
+	upload := <-uploaded
+	require.Equal(t, http.StatusOK, upload.Code)
+	download := <-downloaded
+	require.Equal(t, http.StatusOK, download.Code)
+	assert.Equal(t, "abcdefghij", download.Body.String())
+	assert.Equal(t, upload.Header().Get(digest.Header), download.Header().Get(digest.Header))
+}
+
+func TestCompressedUpload(t *testing.T) {
+	s, cleanup := newTestFileServer(t)
+	defer cleanup()
+	h := s.routes()
+	path := "/build1/chaincode-source.tar"
+	var buf bytes.Buffer
+	w, err := compression.NewWriter(&buf, compression.Zstd, 0)
+	require.NoError(t, err)
+	w.Write([]byte("0123456789"))
+	require.NoError(t, w.Close())
+	// sha256 of "0123456789"
+	sum := "sha-256=hNiYd/DUBB77a/kaFvAkjy/Vc+avBcGflr7bn4gveII="
+
+	rec := doRequest(t, h, "POST", path, "not zstd", map[string]string{"Content-Encoding": "zstd"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = doRequest(t, h, "POST", path, buf.String(), map[string]string{"Content-Encoding": "br"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = doRequest(t, h, "POST", path, buf.String(), map[string]string{"Content-Encoding": "zstd", digest.Header: sum})
+	require.Equal(t, http.StatusOK, rec.Code)
+	md, err := readMetadata(context.Background(), s.storage, "build1/chaincode-source.tar")
+	require.NoError(t, err)
+	assert.Equal(t, compression.Zstd, md.Encoding)
+	assert.EqualValues(t, buf.Len(), md.Size)
+	assert.EqualValues(t, 10, md.UncompressedSize)
+
+	// Clients accepting the encoding get the stored content
+	rec = doRequest(t, h, "GET", path, "", map[string]string{"Accept-Encoding": "gzip, zstd"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "zstd", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, buf.String(), rec.Body.String())
+	assert.Equal(t, sum, rec.Header().Get(digest.Header))
+
+	rec = doRequest(t, h, "GET", path, "", map[string]string{"Accept-Encoding": "zstd", "Range": "bytes=4-"})
+	assert.Equal(t, http.StatusPartialContent, rec.Code)
+	assert.Equal(t, buf.String()[4:], rec.Body.String())
+
+	// Others get it decompressed
+	rec = doRequest(t, h, "GET", path, "", map[string]string{"Accept-Encoding": "gzip"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "0123456789", rec.Body.String())
+
+	// Ranges of the decompressed content are not served
+	rec = doRequest(t, h, "GET", path, "", map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=4-"})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, rec.Code)
+	assert.Equal(t, "bytes */10", rec.Header().Get("Content-Range"))
+	rec = doRequest(t, h, "GET", path, "", map[string]string{"Range": "bytes=4-"})
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, rec.Code)
+}
+
+// failingStorage fails to store artifacts, but not their metadata
+type failingStorage struct {
+	Storage
+}
+
+func (s *failingStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if strings.HasSuffix(key, metadataSuffix) {
+		return s.Storage.Put(ctx, key, r, size)
+	}
+	io.Copy(ioutil.Discard, r)
+	return errors.New("storage unavailable")
+}
+
+func TestResumableUploadStorageFailure(t *testing.T) {
+	s, cleanup := newTestFileServer(t)
+	defer cleanup()
+	s.storage = &failingStorage{Storage: s.storage}
+	h := s.routes()
+	path := "/build1/chaincode-output.tar"
+
+	rec := doRequest(t, h, "PUT", path, "01234", map[string]string{"Content-Range": "bytes 0-4/10"})
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	rec = doRequest(t, h, "PUT", path, "56789", map[string]string{"Content-Range": "bytes 5-9/10"})
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, "0", rec.Header().Get(uploadOffsetHeader))
+
+	// The upload starts over instead of being reported as complete
+	rec = doRequest(t, h, "PUT", path, "", map[string]string{"Content-Range": "bytes */10"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "0", rec.Header().Get(uploadOffsetHeader))
+}
+
+func TestResumableUploadNotStored(t *testing.T) {
+	s, cleanup := newTestFileServer(t)
+	defer cleanup()
+	h := s.routes()
+	path := "/build1/chaincode-output.tar"
+
+	// A partial upload holding all the bytes isn't a stored artifact
+	require.NoError(t, ioutil.WriteFile(s.uploads.path("build1/chaincode-output.tar"), []byte("0123456789"), 0644))
+	rec := doRequest(t, h, "PUT", path, "", map[string]string{"Content-Range": "bytes */10"})
+	assert.Equal(t, "0", rec.Header().Get(uploadOffsetHeader))
+
+	// A stored artifact with another digest neither
+	rec = doRequest(t, h, "POST", path, "012345678X", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	// sha256 of "0123456789"
+	sum := "sha-256=hNiYd/DUBB77a/kaFvAkjy/Vc+avBcGflr7bn4gveII="
+	rec = doRequest(t, h, "PUT", path, "", map[string]string{"Content-Range": "bytes */10", digest.Header: sum})
+	assert.Equal(t, "0", rec.Header().Get(uploadOffsetHeader))
+	rec = doRequest(t, h, "PUT", path, "", map[string]string{"Content-Range": "bytes */10"})
+	assert.Equal(t, "10", rec.Header().Get(uploadOffsetHeader))
+}
+
+// countingStorage counts the objects stored
+type countingStorage struct {
+	Storage
+	puts int
+}
+
+func (s *countingStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	s.puts++
+	return s.Storage.Put(ctx, key, r, size)
+}
+
+func TestAccessTime(t *testing.T) {
+	s, cleanup := newTestFileServer(t)
+	defer cleanup()
+	storage := &countingStorage{Storage: s.storage}
+	s.storage = storage
+	h := s.routes()
+	ctx := context.Background()
+	key := "build1/chaincode-output.tar"
+
+	rec := doRequest(t, h, "POST", "/"+key, "0123456789", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	// Downloads don't write to the storage while the access time is recent
+	storage.puts = 0
+	rec = doRequest(t, h, "GET", "/"+key, "", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = doRequest(t, h, "HEAD", "/"+key, "", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 0, storage.puts)
+
+	// An old access time is updated on the current metadata, not the one read before
+	stale, err := readMetadata(ctx, s.storage, key)
+	require.NoError(t, err)
+	stale.LastAccess = time.Now().Add(-2 * accessTimeResolution)
+	stale.Digest = "stale"
+	s.touch(ctx, key, stale)
+	assert.Equal(t, 1, storage.puts)
+	md, err := readMetadata(ctx, s.storage, key)
+	require.NoError(t, err)
+	assert.Equal(t, "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882", md.Digest)
+	assert.WithinDuration(t, time.Now(), md.LastAccess, time.Minute)
+}
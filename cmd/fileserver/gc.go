@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// gcPolicy defines which artifacts are removed by the garbage collector
+type gcPolicy struct {
+	// MaxAge removes artifacts uploaded longer ago, disabled if zero
+	MaxAge time.Duration
+	// MaxTotalSize evicts the least recently used artifacts until the store is below it, disabled if zero
+	MaxTotalSize int64
+	// KeepLatestOutput never removes the latest chaincode output of each label
+	KeepLatestOutput bool
+}
+
+// gcDeletion is an artifact removed by the garbage collector
+type gcDeletion struct {
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	Reason string `json:"reason"`
+}
+
+// gcReport is the outcome of a garbage collection run
+type gcReport struct {
+	DryRun         bool         `json:"dry_run"`
+	Deleted        []gcDeletion `json:"deleted"`
+	FreedBytes     int64        `json:"freed_bytes"`
+	RemainingBytes int64        `json:"remaining_bytes"`
+	Remaining      int          `json:"remaining"`
+}
+
+// garbageCollector removes stored artifacts according to a policy
+type garbageCollector struct {
+	storage Storage
+	policy  gcPolicy
+	events  *eventHub // Notified of the deletions
+	// deleteFromPeers removes the deleted artifacts from the replicas, which would
+	// otherwise bring them back. Not set when running without replication.
+	deleteFromPeers func(ctx context.Context, md *ArtifactMetadata)
+	// lock locks an artifact while it's deleted, not set when nothing else writes to the storage
+	lock func(key string) func()
+	mu   sync.Mutex // Serializes runs
+}
+
+// getGCConfig reads the garbage collection policy and interval from
+// GC_MAX_AGE, GC_MAX_TOTAL_SIZE, GC_KEEP_LATEST_OUTPUT and GC_INTERVAL
+func getGCConfig() (gcPolicy, time.Duration, error) {
+	policy := gcPolicy{KeepLatestOutput: true}
+	var interval time.Duration
+	var err error
+
+	if value := os.Getenv("GC_MAX_AGE"); value != "" {
+		policy.MaxAge, err = time.ParseDuration(value)
+		if err != nil {
+			return policy, 0, errors.Wrap(err, "parsing GC_MAX_AGE")
+		}
+	}
+	if value := os.Getenv("GC_MAX_TOTAL_SIZE"); value != "" {
+		policy.MaxTotalSize, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return policy, 0, errors.Wrap(err, "parsing GC_MAX_TOTAL_SIZE")
+		}
+	}
+	if value := os.Getenv("GC_KEEP_LATEST_OUTPUT"); value != "" {
+		policy.KeepLatestOutput, err = strconv.ParseBool(value)
+		if err != nil {
+			return policy, 0, errors.Wrap(err, "parsing GC_KEEP_LATEST_OUTPUT")
+		}
+	}
+	if value := os.Getenv("GC_INTERVAL"); value != "" {
+		interval, err = time.ParseDuration(value)
+		if err != nil {
+			return policy, 0, errors.Wrap(err, "parsing GC_INTERVAL")
+		}
+	}
+	return policy, interval, nil
+}
+
+// Run removes the artifacts selected by the policy. Nothing is removed on a dry run.
+func (gc *garbageCollector) Run(ctx context.Context, dryRun bool) (*gcReport, error) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+
+	artifacts, err := listArtifacts(ctx, gc.storage, "")
+	if err != nil {
+		return nil, err
+	}
+	candidates := selectGarbage(artifacts, gc.policy, time.Now())
+
+	metadata := map[string]ArtifactMetadata{}
+	for _, a := range artifacts {
+		metadata[a.Key] = a.Metadata
+	}
+	report := &gcReport{DryRun: dryRun, Deleted: []gcDeletion{}}
+	deleted := map[string]bool{}
+	for _, c := range candidates {
+		if !dryRun {
+			unlock := func() {}
+			if gc.lock != nil {
+				unlock = gc.lock(c.Key)
+			}
+			err := deleteArtifact(ctx, gc.storage, c.Key)
+			unlock()
+			if err != nil && err != ErrNotFound {
+				log.Printf("GC: deleting %s: %s", c.Key, err)
+				continue
+			}
+			log.Printf("GC: deleted %s (%s)", c.Key, c.Reason)
+			md := metadata[c.Key]
+			if gc.deleteFromPeers != nil {
+				gc.deleteFromPeers(ctx, &md)
+			}
+			gc.events.Publish(artifactEvent{
+				Type:     eventDeleted,
+				Tenant:   md.Tenant,
+				BuildID:  md.BuildID,
+				Artifact: md.Artifact,
+				Size:     md.Size,
+				Digest:   md.Digest,
+				Label:    md.Label,
+				Reason:   c.Reason,
+			})
+		}
+		deleted[c.Key] = true
+		report.Deleted = append(report.Deleted, c)
+		report.FreedBytes += c.Size
+	}
+	for _, a := range artifacts {
+		if !deleted[a.Key] {
+			report.Remaining++
+			report.RemainingBytes += a.Metadata.Size
+		}
+	}
+	return report, nil
+}
+
+// Loop runs the garbage collector every interval until ctx is done
+func (gc *garbageCollector) Loop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := gc.Run(ctx, false)
+			if err != nil {
+				log.Printf("GC failed: %s", err)
+				continue
+			}
+			log.Printf("GC: deleted %d artifacts, freed %d bytes, %d bytes in use",
+				len(report.Deleted), report.FreedBytes, report.RemainingBytes)
+		}
+	}
+}
+
+// selectGarbage returns the artifacts to remove according to policy
+func selectGarbage(artifacts []Artifact, policy gcPolicy, now time.Time) []gcDeletion {
+	// Find the latest output of every label, tenants may use the same labels
+	protected := map[string]bool{}
+	if policy.KeepLatestOutput {
+		latest := map[string]Artifact{}
+		for _, a := range artifacts {
+			md := a.Metadata
+			if md.Label == "" || md.Artifact != "chaincode-output.tar" {
+				continue
+			}
+			label := md.Tenant + "/" + md.Label
+			if l, ok := latest[label]; !ok || md.UploadedAt.After(l.Metadata.UploadedAt) {
+				latest[label] = a
+			}
+		}
+		for _, a := range latest {
+			protected[a.Key] = true
+		}
+	}
+
+	deletions := []gcDeletion{}
+	remaining := []Artifact{}
+	var totalSize int64
+	for _, a := range artifacts {
+		if !protected[a.Key] && policy.MaxAge > 0 && now.Sub(a.Metadata.UploadedAt) > policy.MaxAge {
+			deletions = append(deletions, gcDeletion{Key: a.Key, Size: a.Metadata.Size, Reason: "max age exceeded"})
+			continue
+		}
+		remaining = append(remaining, a)
+		totalSize += a.Metadata.Size
+	}
+
+	if policy.MaxTotalSize <= 0 || totalSize <= policy.MaxTotalSize {
+		return deletions
+	}
+
+	// Evict the least recently used artifacts until the quota is met
+	sort.Slice(remaining, func(i, j int) bool {
+		return remaining[i].Metadata.LastAccess.Before(remaining[j].Metadata.LastAccess)
+	})
+	for _, a := range remaining {
+		if totalSize <= policy.MaxTotalSize {
+			break
+		}
+		if protected[a.Key] {
+			continue
+		}
+		deletions = append(deletions, gcDeletion{Key: a.Key, Size: a.Metadata.Size, Reason: "total size quota exceeded"})
+		totalSize -= a.Metadata.Size
+	}
+	return deletions
+}
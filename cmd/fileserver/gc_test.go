@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectGarbage(t *testing.T) {
+	now := time.Now()
+	artifact := func(buildID, name, label string, size int64, uploaded, accessed time.Duration) Artifact {
+		return Artifact{
+			Key: artifactKey(buildID, name),
+			Metadata: ArtifactMetadata{
+				BuildID:    buildID,
+				Artifact:   name,
+				Size:       size,
+				Label:      label,
+				UploadedAt: now.Add(-uploaded),
+				LastAccess: now.Add(-accessed),
+			},
+		}
+	}
+	artifacts := []Artifact{
+		artifact("old", "chaincode-source.tar", "fabcar_1", 10, 48*time.Hour, 48*time.Hour),
+		artifact("old", "chaincode-output.tar", "fabcar_1", 10, 48*time.Hour, time.Minute),
+		artifact("older", "chaincode-output.tar", "fabcar_1", 10, 72*time.Hour, 72*time.Hour),
+		artifact("recent", "chaincode-output.tar", "asset_1", 10, time.Hour, 30*time.Minute),
+		artifact("recent2", "chaincode-output.tar", "", 10, time.Hour, 20*time.Minute),
+		artifact("latest", "chaincode-output.tar", "asset_1", 10, time.Minute, time.Hour),
+	}
+	keys := func(deletions []gcDeletion) []string {
+		k := []string{}
+		for _, d := range deletions {
+			k = append(k, d.Key)
+		}
+		sort.Strings(k)
+		return k
+	}
+
+	// Max age keeps the latest output of fabcar_1
+	deletions := selectGarbage(artifacts, gcPolicy{MaxAge: 24 * time.Hour, KeepLatestOutput: true}, now)
+	assert.Equal(t, []string{"old/chaincode-source.tar", "older/chaincode-output.tar"}, keys(deletions))
+
+	deletions = selectGarbage(artifacts, gcPolicy{MaxAge: 24 * time.Hour}, now)
+	assert.Equal(t, []string{"old/chaincode-output.tar", "old/chaincode-source.tar", "older/chaincode-output.tar"}, keys(deletions))
+
+	// Quota evicts the least recently used artifacts, skipping the latest outputs
+	deletions = selectGarbage(artifacts, gcPolicy{MaxTotalSize: 30, KeepLatestOutput: true}, now)
+	assert.Equal(t, []string{"old/chaincode-source.tar", "older/chaincode-output.tar", "recent/chaincode-output.tar"}, keys(deletions))
+}
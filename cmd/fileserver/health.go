@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// healthProbeKey is written and removed to check that the storage is writable
+const healthProbeKey = ".health-probe"
+
+// health reports whether the file server can store artifacts and is not shutting down
+type health struct {
+	storage      Storage
+	shuttingDown int32
+}
+
+// ShutDown makes the readiness check fail, so no new requests are routed to the server
+func (h *health) ShutDown() {
+	atomic.StoreInt32(&h.shuttingDown, 1)
+}
+
+func (h *health) checkStorage(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	err := h.storage.Put(ctx, healthProbeKey, strings.NewReader("ok"), 2)
+	if err != nil {
+		return err
+	}
+	return h.storage.Delete(ctx, healthProbeKey)
+}
+
+// serveHealthz is the liveness check, GET /healthz. It only tells that the server handles
+// requests, storage outages are not fixed by restarting it.
+func (h *health) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// serveReadyz is the readiness check, GET /readyz
+func (h *health) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&h.shuttingDown) == 1 {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	err := h.checkStorage(r.Context())
+	if err != nil {
+		log.Printf("Readiness check failed: %s", err)
+		http.Error(w, "storage not writable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
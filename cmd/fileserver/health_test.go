@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// unwritableStorage fails to store anything, and counts the attempts
+type unwritableStorage struct {
+	Storage
+	puts int
+}
+
+func (s *unwritableStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	s.puts++
+	return errors.New("read-only file system")
+}
+
+func TestHealth(t *testing.T) {
+	s, cleanup := newTestFileServer(t)
+	defer cleanup()
+	storage := &unwritableStorage{Storage: s.storage}
+	s.health = &health{storage: storage}
+	h := s.routes()
+
+	// Liveness doesn't depend on the storage
+	rec := doRequest(t, h, "GET", "/healthz", "", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 0, storage.puts)
+
+	rec = doRequest(t, h, "GET", "/readyz", "", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, 1, storage.puts)
+
+	s.health.storage = s.storage
+	rec = doRequest(t, h, "GET", "/readyz", "", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	s.health.ShutDown()
+	rec = doRequest(t, h, "GET", "/readyz", "", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	rec = doRequest(t, h, "GET", "/healthz", "", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// metadataSuffix is appended to the key of an artifact to store its metadata
+	metadataSuffix = ".meta.json"
+
+	labelHeader = "X-Chaincode-Label"
+)
+
+// labelPattern matches the chaincode labels accepted by Hyperledger Fabric
+var labelPattern = regexp.MustCompile(`^[[:alnum:]][[:alnum:]_.+-]*$`)
+
+// ArtifactMetadata is stored next to every artifact
+type ArtifactMetadata struct {
+	Tenant           string    `json:"tenant,omitempty"`
+	BuildID          string    `json:"build_id"`
+	Artifact         string    `json:"artifact"`
+	Size             int64     `json:"size"`               // Size as stored, compressed or not
+	Encoding         string    `json:"encoding,omitempty"` // Content encoding the artifact is stored with
+	UncompressedSize int64     `json:"uncompressed_size,omitempty"`
+	Label            string    `json:"label,omitempty"`
+	Digest           string    `json:"sha256,omitempty"`   // Hex encoded SHA-256 of the uncompressed content
+	Uploader         string    `json:"uploader,omitempty"` // Client certificate subject or address of the uploader
+	UploadedAt       time.Time `json:"uploaded_at"`
+	LastAccess       time.Time `json:"last_access"`
+}
+
+// Artifact is a stored artifact along with its metadata
+type Artifact struct {
+	Key      string
+	Metadata ArtifactMetadata
+}
+
+func metadataKey(key string) string {
+	return key + metadataSuffix
+}
+
+func readMetadata(ctx context.Context, storage Storage, key string) (*ArtifactMetadata, error) {
+	r, _, err := storage.Get(ctx, metadataKey(key))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading metadata")
+	}
+	md := &ArtifactMetadata{}
+	err = json.Unmarshal(data, md)
+	return md, errors.Wrap(err, "unmarshaling metadata")
+}
+
+func writeMetadata(ctx context.Context, storage Storage, key string, md *ArtifactMetadata) error {
+	data, err := json.Marshal(md)
+	if err != nil {
+		return errors.Wrap(err, "marshaling metadata")
+	}
+	return storage.Put(ctx, metadataKey(key), bytes.NewReader(data), int64(len(data)))
+}
+
+// listArtifacts returns the artifacts whose key starts with prefix.
+// Artifacts stored without metadata get it derived from the storage.
+func listArtifacts(ctx context.Context, storage Storage, prefix string) ([]Artifact, error) {
+	objects, err := storage.List(ctx, prefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing storage")
+	}
+	hasMetadata := map[string]bool{}
+	for _, o := range objects {
+		if strings.HasSuffix(o.Key, metadataSuffix) {
+			hasMetadata[strings.TrimSuffix(o.Key, metadataSuffix)] = true
+		}
+	}
+
+	artifacts := []Artifact{}
+	for _, o := range objects {
+		if strings.HasSuffix(o.Key, metadataSuffix) {
+			continue
+		}
+		if hasMetadata[o.Key] {
+			md, err := readMetadata(ctx, storage, o.Key)
+			if err == nil {
+				artifacts = append(artifacts, Artifact{Key: o.Key, Metadata: *md})
+				continue
+			}
+			if err != ErrNotFound {
+				return nil, errors.Wrapf(err, "reading metadata of %s", o.Key)
+			}
+		}
+		key := o.Key
+		tenant := ""
+		if strings.HasPrefix(key, tenantsPrefix) {
+			parts := strings.SplitN(strings.TrimPrefix(key, tenantsPrefix), "/", 2)
+			tenant = parts[0]
+			if len(parts) == 2 {
+				key = parts[1]
+			}
+		}
+		parts := strings.SplitN(key, "/", 2)
+		md := ArtifactMetadata{
+			Tenant:     tenant,
+			BuildID:    parts[0],
+			Size:       o.Size,
+			UploadedAt: o.ModTime,
+			LastAccess: o.ModTime,
+		}
+		if len(parts) == 2 {
+			md.Artifact = parts[1]
+		}
+		artifacts = append(artifacts, Artifact{Key: o.Key, Metadata: md})
+	}
+	return artifacts, nil
+}
+
+// deleteArtifact removes an artifact along with its metadata
+func deleteArtifact(ctx context.Context, storage Storage, key string) error {
+	err := storage.Delete(ctx, key)
+	if err != nil {
+		return err
+	}
+	err = storage.Delete(ctx, metadataKey(key))
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
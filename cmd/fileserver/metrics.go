@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fileserver_requests_total",
+		Help: "Number of HTTP requests by method and status code.",
+	}, []string{"method", "code"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "fileserver_request_duration_seconds",
+		Help:    "Duration of HTTP requests by method and status code.",
+		Buckets: []float64{0.005, 0.025, 0.1, 0.5, 1, 5, 15, 60, 300},
+	}, []string{"method", "code"})
+	receivedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "fileserver_received_bytes_total",
+		Help: "Bytes received in request bodies.",
+	})
+	sentBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "fileserver_sent_bytes_total",
+		Help: "Bytes sent in response bodies.",
+	})
+	replicationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fileserver_replications_total",
+		Help: "Number of replication requests to peers by operation (push, fetch, delete) and result.",
+	}, []string{"operation", "result"})
+	upstreamFetchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fileserver_upstream_fetches_total",
+		Help: "Number of artifacts fetched from the upstream file server by result (success, not_found, failure).",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration, receivedBytes, sentBytes, replicationsTotal, upstreamFetchesTotal)
+}
+
+// storageCollector reports the number and size of the stored artifacts on every scrape
+type storageCollector struct {
+	storage   Storage
+	artifacts *prometheus.Desc
+	size      *prometheus.Desc
+}
+
+func newStorageCollector(storage Storage) *storageCollector {
+	return &storageCollector{
+		storage:   storage,
+		artifacts: prometheus.NewDesc("fileserver_stored_artifacts", "Number of stored artifacts.", nil, nil),
+		size:      prometheus.NewDesc("fileserver_stored_bytes", "Size of the stored artifacts in bytes.", nil, nil),
+	}
+}
+
+func (c *storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.artifacts
+	ch <- c.size
+}
+
+func (c *storageCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	objects, err := c.storage.List(ctx, "")
+	if err != nil {
+		log.Printf("Collecting storage metrics: %s", err)
+		ch <- prometheus.NewInvalidMetric(c.artifacts, err)
+		return
+	}
+	var count, size int64
+	for _, o := range objects {
+		if strings.HasSuffix(o.Key, metadataSuffix) {
+			continue
+		}
+		count++
+		size += o.Size
+	}
+	ch <- prometheus.MustNewConstMetric(c.artifacts, prometheus.GaugeValue, float64(count))
+	ch <- prometheus.MustNewConstMetric(c.size, prometheus.GaugeValue, float64(size))
+}
+
+// instrumentedResponseWriter records the status code and size of a response
+type instrumentedResponseWriter struct {
+	http.ResponseWriter
+	code int
+	sent int64
+}
+
+func (w *instrumentedResponseWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *instrumentedResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.sent += int64(n)
+	sentBytes.Add(float64(n))
+	return n, err
+}
+
+// Flush supports streaming responses
+func (w *instrumentedResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// countingBody counts the bytes read from a request body
+type countingBody struct {
+	body io.ReadCloser
+	n    int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.n += int64(n)
+	receivedBytes.Add(float64(n))
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	return b.body.Close()
+}
+
+// getMethodLabel returns the method label of a request, methods are sent by the clients so
+// the unknown ones share a label, rather than adding a series each
+func getMethodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "other"
+}
+
+// instrument records the metrics of the requests handled by next, and writes
+// them to the audit log when there's one
+func instrument(next http.Handler, audit *auditLog) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		body := &countingBody{body: r.Body}
+		r.Body = body
+		iw := &instrumentedResponseWriter{ResponseWriter: w, code: http.StatusOK}
+		next.ServeHTTP(iw, r)
+
+		duration := time.Since(start)
+		method := getMethodLabel(r.Method)
+		code := strconv.Itoa(iw.code)
+		requestsTotal.WithLabelValues(method, code).Inc()
+		requestDuration.WithLabelValues(method, code).Observe(duration.Seconds())
+		if audit != nil {
+			audit.Record(r, iw.code, body.n, iw.sent, iw.Header(), duration)
+		}
+	})
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstrument(t *testing.T) {
+	h := instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusTeapot)
+		w.Write(body)
+	}), nil)
+
+	requests := testutil.ToFloat64(requestsTotal.WithLabelValues("PUT", "418"))
+	received := testutil.ToFloat64(receivedBytes)
+	sent := testutil.ToFloat64(sentBytes)
+	doRequest(t, h, "PUT", "/", "0123456789", nil)
+	assert.Equal(t, requests+1, testutil.ToFloat64(requestsTotal.WithLabelValues("PUT", "418")))
+	assert.Equal(t, received+10, testutil.ToFloat64(receivedBytes))
+	assert.Equal(t, sent+10, testutil.ToFloat64(sentBytes))
+}
+
+func TestInstrumentMethodLabel(t *testing.T) {
+	h := instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}), nil)
+
+	before := testutil.ToFloat64(requestsTotal.WithLabelValues("other", "418"))
+	doRequest(t, h, "FOO", "/", "", nil)
+	doRequest(t, h, "BAR", "/", "", nil)
+	assert.Equal(t, before+2, testutil.ToFloat64(requestsTotal.WithLabelValues("other", "418")))
+
+	before = testutil.ToFloat64(requestsTotal.WithLabelValues("GET", "418"))
+	doRequest(t, h, "GET", "/", "", nil)
+	assert.Equal(t, before+1, testutil.ToFloat64(requestsTotal.WithLabelValues("GET", "418")))
+}
+
+func TestStorageCollector(t *testing.T) {
+	s, cleanup := newTestFileServer(t)
+	defer cleanup()
+	h := s.routes()
+	doRequest(t, h, "POST", "/build1/chaincode-source.tar", "0123456789", nil)
+	doRequest(t, h, "POST", "/build1/chaincode-output.tar", "01234", nil)
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(newStorageCollector(s.storage))
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	values := map[string]float64{}
+	for _, family := range families {
+		values[family.GetName()] = family.GetMetric()[0].GetGauge().GetValue()
+	}
+	// Metadata files are not counted
+	assert.Equal(t, map[string]float64{"fileserver_stored_artifacts": 2, "fileserver_stored_bytes": 15}, values)
+}
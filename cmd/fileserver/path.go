@@ -0,0 +1,48 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// allowedArtifacts are the files the launcher stores for a build
+var allowedArtifacts = map[string]bool{
+	"chaincode-source.tar": true,
+	"chaincode-output.tar": true,
+}
+
+// buildIDPattern matches the build IDs generated by the launcher
+var buildIDPattern = regexp.MustCompile(`^[A-Za-z0-9]{1,64}$`)
+
+// validBuildID reports whether buildID matches buildIDPattern and is not reserved:
+// the artifacts of the tenants are stored under tenants/
+func validBuildID(buildID string) bool {
+	return buildIDPattern.MatchString(buildID) && buildID+"/" != tenantsPrefix
+}
+
+// parseArtifactPath validates an URL path of the form /<buildID>/<artifact>
+// and returns its components
+func parseArtifactPath(path string) (string, string, error) {
+	if !strings.HasPrefix(path, "/") {
+		return "", "", errors.New("path must be absolute")
+	}
+	parts := strings.Split(path[1:], "/")
+	if len(parts) != 2 {
+		return "", "", errors.New("path must be /<buildID>/<artifact>")
+	}
+	buildID, artifact := parts[0], parts[1]
+	if !validBuildID(buildID) {
+		return "", "", errors.Errorf("invalid build ID %q", buildID)
+	}
+	if !allowedArtifacts[artifact] {
+		return "", "", errors.Errorf("artifact %q not allowed", artifact)
+	}
+	return buildID, artifact, nil
+}
+
+// artifactKey returns the storage key of an artifact of a build
+func artifactKey(buildID string, artifact string) string {
+	return buildID + "/" + artifact
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseArtifactPath(t *testing.T) {
+	buildID, artifact, err := parseArtifactPath("/ea2aaf81f5/chaincode-output.tar")
+	assert.NoError(t, err)
+	assert.Equal(t, "ea2aaf81f5", buildID)
+	assert.Equal(t, "chaincode-output.tar", artifact)
+
+	for _, path := range []string{
+		"",
+		"/",
+		"/ea2aaf81f5",
+		"/ea2aaf81f5/",
+		"/ea2aaf81f5/other.tar",
+		"/../chaincode-output.tar",
+		"/ea2aaf81f5/../chaincode-output.tar",
+		"/a/b/chaincode-output.tar",
+		"//chaincode-output.tar",
+		"ea2aaf81f5/chaincode-output.tar",
+		"/tenants/chaincode-output.tar",
+	} {
+		_, _, err := parseArtifactPath(path)
+		assert.Error(t, err, path)
+	}
+}
@@ -0,0 +1,569 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kfsoftware/externalbuilder/cmd/internal/compression"
+	"github.com/kfsoftware/externalbuilder/cmd/internal/digest"
+	"github.com/kfsoftware/externalbuilder/cmd/internal/signedurl"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Headers carrying the metadata of replicated artifacts
+	uploaderHeader   = "X-Artifact-Uploader"
+	uploadedAtHeader = "X-Artifact-Uploaded-At"
+
+	replicationAttempts   = 5
+	replicationRetryDelay = time.Second
+	replicationURLExpiry  = time.Hour
+)
+
+// replicationMode is the consistency of the replication of an artifact
+type replicationMode string
+
+const (
+	// replicateSync acknowledges an upload once enough peers hold a copy of it
+	replicateSync replicationMode = "sync"
+	// replicateAsync acknowledges an upload right away and copies it to the peers in the background
+	replicateAsync replicationMode = "async"
+	replicateNone  replicationMode = "none"
+)
+
+var errReplicationFailed = errors.New("not enough peers acknowledged the artifact")
+
+// replicator copies the artifacts to the other replicas of the file server
+type replicator struct {
+	storage    Storage
+	peers      []string // Base URLs of the other replicas
+	secret     []byte   // Signs the requests to the peers and authenticates theirs, unlike the clients' secrets
+	client     *http.Client
+	modes      map[string]replicationMode // By artifact name
+	minAcks    int                        // Peers that must acknowledge a synchronous replication
+	retryDelay time.Duration
+	ctx        context.Context // Bounds the background replications
+	pending    sync.WaitGroup
+	tenant     string // Tenant whose artifacts are replicated, if any
+	prefix     string // URL path prefix of the replication API on the peers
+}
+
+// newReplicatorFromEnv configures the replication to the peers listed in REPLICATION_PEERS.
+// The list may contain this replica, which is recognized by its hostname and skipped.
+// The requests between replicas are signed with REPLICATION_SECRET, which is required
+// when the requests of the clients are authenticated with secret.
+func newReplicatorFromEnv(ctx context.Context, storage Storage, secret []byte) (*replicator, error) {
+	hostname, _ := os.Hostname()
+	peers, err := parsePeers(os.Getenv("REPLICATION_PEERS"), hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	replicationSecret := []byte(os.Getenv("REPLICATION_SECRET"))
+	if len(replicationSecret) == 0 && len(secret) > 0 && len(peers) > 0 {
+		return nil, errors.New("REPLICATION_SECRET is required when FILE_SERVER_SECRET is set")
+	}
+	if len(replicationSecret) > 0 && string(replicationSecret) == string(secret) {
+		return nil, errors.New("REPLICATION_SECRET must differ from FILE_SERVER_SECRET")
+	}
+
+	modes := map[string]replicationMode{
+		"chaincode-source.tar": replicateAsync,
+		"chaincode-output.tar": replicateSync,
+	}
+	for artifact, env := range map[string]string{
+		"chaincode-source.tar": "REPLICATION_SOURCE_MODE",
+		"chaincode-output.tar": "REPLICATION_OUTPUT_MODE",
+	} {
+		switch mode := replicationMode(os.Getenv(env)); mode {
+		case "":
+		case replicateSync, replicateAsync, replicateNone:
+			modes[artifact] = mode
+		default:
+			return nil, errors.Errorf("invalid %s %q", env, mode)
+		}
+	}
+
+	minAcks := 1
+	if value := os.Getenv("REPLICATION_MIN_ACKS"); value != "" {
+		minAcks, err = strconv.Atoi(value)
+		if err != nil || minAcks < 0 {
+			return nil, errors.Errorf("invalid REPLICATION_MIN_ACKS %q", value)
+		}
+	}
+
+	client, err := getReplicationClient()
+	if err != nil {
+		return nil, err
+	}
+	return &replicator{
+		storage:    storage,
+		peers:      peers,
+		secret:     replicationSecret,
+		client:     client,
+		modes:      modes,
+		minAcks:    minAcks,
+		retryDelay: replicationRetryDelay,
+		ctx:        ctx,
+	}, nil
+}
+
+// forTenant returns a replicator copying the artifacts of a tenant to the same peers
+func (r *replicator) forTenant(storage Storage, tenant string) *replicator {
+	return &replicator{
+		storage:    storage,
+		peers:      r.peers,
+		secret:     r.secret,
+		client:     r.client,
+		modes:      r.modes,
+		minAcks:    r.minAcks,
+		retryDelay: r.retryDelay,
+		ctx:        r.ctx,
+		tenant:     tenant,
+		prefix:     "/" + tenantsPrefix + tenant,
+	}
+}
+
+// replicaScope returns what the signatures of the replication requests for the artifacts
+// of a build are scoped to. It includes the tenant, so they're only valid for its partition.
+func replicaScope(tenant string, buildID string) string {
+	if tenant == "" {
+		return buildID
+	}
+	return tenantsPrefix + tenant + "/" + buildID
+}
+
+// parsePeers parses a comma separated list of peer URLs, leaving out the one of hostname
+func parsePeers(value string, hostname string) ([]string, error) {
+	peers := []string{}
+	for _, peer := range strings.Split(value, ",") {
+		peer = strings.TrimRight(strings.TrimSpace(peer), "/")
+		if peer == "" {
+			continue
+		}
+		u, err := url.Parse(peer)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.Errorf("invalid peer URL %q", peer)
+		}
+		host := u.Hostname()
+		if hostname != "" && (host == hostname || strings.HasPrefix(host, hostname+".")) {
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+// getReplicationClient returns the client for the requests to the peers. Their certificates are
+// verified against REPLICATION_CA_FILE if it is set, and the server certificate is presented
+// when client certificates are required.
+func getReplicationClient() (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile := os.Getenv("REPLICATION_CA_FILE"); caFile != "" {
+		caData, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading replication CA file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, errors.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if os.Getenv("TLS_CLIENT_CA_FILE") != "" {
+		cert, err := tls.LoadX509KeyPair(os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE"))
+		if err != nil {
+			return nil, errors.Wrap(err, "loading replication client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+func (r *replicator) mode(artifact string) replicationMode {
+	if len(r.peers) == 0 {
+		return replicateNone
+	}
+	mode, ok := r.modes[artifact]
+	if !ok {
+		return replicateNone
+	}
+	return mode
+}
+
+// peerURL returns the signed replication URL of an artifact on a peer
+func (r *replicator) peerURL(peer string, key string, op signedurl.Operation) string {
+	u := fmt.Sprintf("%s%s/api/replicate/%s", peer, r.prefix, key)
+	if len(r.secret) == 0 {
+		return u
+	}
+	buildID := strings.SplitN(key, "/", 2)[0]
+	return u + "?" + signedurl.Sign(r.secret, replicaScope(r.tenant, buildID), op, time.Now().Add(replicationURLExpiry)).Encode()
+}
+
+// Replicate copies an artifact that was just uploaded to the peers. With synchronous replication
+// it returns once enough peers hold a copy, the others are retried in the background.
+func (r *replicator) Replicate(ctx context.Context, key string, artifact string) error {
+	switch r.mode(artifact) {
+	case replicateNone:
+		return nil
+	case replicateAsync:
+		for _, peer := range r.peers {
+			r.replicateAsync(peer, key)
+		}
+		return nil
+	}
+
+	errs := make([]error, len(r.peers))
+	var wg sync.WaitGroup
+	for i, peer := range r.peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			errs[i] = r.push(ctx, peer, key)
+			replicationsTotal.WithLabelValues("push", resultLabel(errs[i])).Inc()
+		}(i, peer)
+	}
+	wg.Wait()
+
+	acks := 0
+	for i, err := range errs {
+		if err != nil {
+			log.Printf("Replicating %s to %s: %s", key, r.peers[i], err)
+			continue
+		}
+		acks++
+	}
+	required := r.minAcks
+	if required > len(r.peers) {
+		required = len(r.peers)
+	}
+	if acks < required {
+		return errors.Wrapf(errReplicationFailed, "%d of %d required", acks, required)
+	}
+	for i, err := range errs {
+		if err != nil {
+			r.replicateAsync(r.peers[i], key)
+		}
+	}
+	return nil
+}
+
+// replicateAsync copies an artifact to a peer in the background, retrying on failure
+func (r *replicator) replicateAsync(peer string, key string) {
+	r.pending.Add(1)
+	go func() {
+		defer r.pending.Done()
+		delay := r.retryDelay
+		for attempt := 1; ; attempt++ {
+			err := r.push(r.ctx, peer, key)
+			replicationsTotal.WithLabelValues("push", resultLabel(err)).Inc()
+			if err == nil {
+				log.Printf("Replicated %s to %s", key, peer)
+				return
+			}
+			if errors.Cause(err) == ErrNotFound {
+				// Deleted in the meantime
+				return
+			}
+			if attempt == replicationAttempts {
+				log.Printf("Giving up replicating %s to %s: %s", key, peer, err)
+				return
+			}
+			log.Printf("Replicating %s to %s, retrying in %s: %s", key, peer, delay, err)
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+	}()
+}
+
+// push sends the stored artifact key along with its metadata to a peer
+func (r *replicator) push(ctx context.Context, peer string, key string) error {
+	obj, info, err := r.storage.Get(ctx, key)
+	if err != nil {
+		return errors.Wrap(err, "reading artifact")
+	}
+	defer obj.Close()
+	md, err := readMetadata(ctx, r.storage, key)
+	if err != nil && err != ErrNotFound {
+		return errors.Wrap(err, "reading metadata")
+	}
+
+	req, err := http.NewRequest(http.MethodPut, r.peerURL(peer, key, signedurl.Write), obj)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = info.Size
+	if info.Size == 0 {
+		req.Body = http.NoBody
+	}
+	if md != nil {
+		setMetadataHeaders(req.Header, md)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("peer responded %s", resp.Status)
+	}
+	return nil
+}
+
+// fetch returns the response of the first peer holding the artifact key,
+// or ErrNotFound if none does
+func (r *replicator) fetch(ctx context.Context, key string) (*http.Response, error) {
+	for _, peer := range r.peers {
+		req, err := http.NewRequest(http.MethodGet, r.peerURL(peer, key, signedurl.Read), nil)
+		if err != nil {
+			return nil, err
+		}
+		// Artifacts are copied as stored, asking for an encoding keeps
+		// the client from decompressing them
+		req.Header.Set("Accept-Encoding", strings.Join([]string{compression.Gzip, compression.Zstd}, ", "))
+		resp, err := r.client.Do(req.WithContext(ctx))
+		if err != nil {
+			log.Printf("Fetching %s from %s: %s", key, peer, err)
+			continue
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			log.Printf("Fetching %s from %s: peer responded %s", key, peer, resp.Status)
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Delete removes an artifact from the peers, failures are only logged
+func (r *replicator) Delete(ctx context.Context, key string) {
+	for _, peer := range r.peers {
+		req, err := http.NewRequest(http.MethodDelete, r.peerURL(peer, key, signedurl.Write), nil)
+		if err != nil {
+			log.Printf("Deleting %s from %s: %s", key, peer, err)
+			continue
+		}
+		resp, err := r.client.Do(req.WithContext(ctx))
+		replicationsTotal.WithLabelValues("delete", resultLabel(err)).Inc()
+		if err != nil {
+			log.Printf("Deleting %s from %s: %s", key, peer, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			log.Printf("Deleting %s from %s: peer responded %s", key, peer, resp.Status)
+		}
+	}
+}
+
+// Wait waits for the background replications to finish or ctx to be done
+func (r *replicator) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		r.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// setMetadataHeaders sends the metadata of an artifact along with its content
+func setMetadataHeaders(header http.Header, md *ArtifactMetadata) {
+	if md.Label != "" {
+		header.Set(labelHeader, md.Label)
+	}
+	if md.Encoding != compression.None {
+		header.Set("Content-Encoding", md.Encoding)
+	}
+	if md.Digest != "" {
+		if value, err := digest.FormatSHA256(md.Digest); err == nil {
+			header.Set(digest.Header, value)
+		}
+	}
+	if md.Uploader != "" {
+		header.Set(uploaderHeader, md.Uploader)
+	}
+	header.Set(uploadedAtHeader, md.UploadedAt.UTC().Format(time.RFC3339Nano))
+}
+
+// getReplicaInfo returns the metadata sent along with a replicated artifact
+func getReplicaInfo(header http.Header) (uploadInfo, error) {
+	info, err := parseUploadHeaders(header)
+	if err != nil {
+		return info, err
+	}
+	info.Uploader = header.Get(uploaderHeader)
+	if value := header.Get(uploadedAtHeader); value != "" {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return info, errors.Errorf("invalid %s %q", uploadedAtHeader, value)
+		}
+		info.UploadedAt = t
+	}
+	return info, nil
+}
+
+// replicateUpload replicates an artifact after it was uploaded by a client. If the replication
+// fails the artifact is removed again, so the client retries the upload.
+func (s *fileServer) replicateUpload(ctx context.Context, buildID string, artifact string) error {
+	key := artifactKey(buildID, artifact)
+	err := s.replicator.Replicate(ctx, key, artifact)
+	if err == nil {
+		return nil
+	}
+	unlock := s.lockArtifact(key)
+	defer unlock()
+	if err := deleteArtifact(ctx, s.storage, key); err != nil {
+		log.Printf("Deleting %s: %s", key, err)
+	}
+	return err
+}
+
+// fetchFromPeers stores a copy of an artifact missing in the storage from the first peer holding it
+func (s *fileServer) fetchFromPeers(ctx context.Context, buildID string, artifact string) error {
+	key := artifactKey(buildID, artifact)
+	unlock := s.uploads.lock(key)
+	defer unlock()
+	// Another request may have fetched it in the meantime
+	if _, err := s.storage.Stat(ctx, key); err != ErrNotFound {
+		return err
+	}
+
+	resp, err := s.replicator.fetch(ctx, key)
+	replicationsTotal.WithLabelValues("fetch", resultLabel(err)).Inc()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	info, err := getReplicaInfo(resp.Header)
+	if err != nil {
+		return err
+	}
+	_, err = s.storeArtifact(ctx, buildID, artifact, resp.Body, resp.ContentLength, info)
+	if err != nil {
+		return errors.Wrap(err, "storing artifact fetched from peer")
+	}
+	log.Printf("Fetched %s from a peer", key)
+	return nil
+}
+
+// serveReplica handles the requests of the peers, PUT, GET, HEAD or DELETE /api/replicate/<buildID>/<artifact>.
+// Unlike the requests of the clients, they only involve the storage of this replica, and they're signed
+// with the replication secret: the URLs signed for the clients don't grant access to them.
+func (s *fileServer) serveReplica(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut, http.MethodGet, http.MethodHead, http.MethodDelete:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	buildID, artifact, err := parseArtifactPath(strings.TrimPrefix(r.URL.Path, "/api/replicate"))
+	if err != nil {
+		log.Printf("Rejecting %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, err)
+		http.Error(w, "invalid path", http.StatusBadRequest)
+		return
+	}
+	if len(s.replicator.secret) == 0 && len(s.secret) > 0 {
+		log.Printf("Rejecting %s %s from %s: REPLICATION_SECRET is not set", r.Method, r.URL.Path, r.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if !authorize(s.replicator.secret, replicaScope(s.tenant, buildID), w, r) {
+		return
+	}
+	key := artifactKey(buildID, artifact)
+
+	switch r.Method {
+	case http.MethodPut:
+		info, err := getReplicaInfo(r.Header)
+		if err != nil {
+			log.Printf("Rejecting replica of %s: %s", key, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body := &uploadReader{r: r.Body, remaining: s.maxUploadSize}
+		md, err := s.storeArtifact(r.Context(), buildID, artifact, body, r.ContentLength, info)
+		if err != nil {
+			log.Printf("Storing replica of %s: %s", key, err)
+			if err == errDigestMismatch || err == errInvalidEncoding || body.err != nil {
+				http.Error(w, "invalid replica", http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "storing file failed", http.StatusInternalServerError)
+			return
+		}
+		s.publish(eventUploaded, md)
+		log.Printf("Stored replica of %s", key)
+	case http.MethodDelete:
+		unlock := s.lockArtifact(key)
+		err := deleteArtifact(r.Context(), s.storage, key)
+		unlock()
+		if err != nil && err != ErrNotFound {
+			log.Printf("Deleting replica of %s: %s", key, err)
+			http.Error(w, "deleting file failed", http.StatusInternalServerError)
+			return
+		}
+		if err == nil {
+			s.publish(eventDeleted, &ArtifactMetadata{BuildID: buildID, Artifact: artifact})
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		obj, info, md, err := s.openArtifact(r.Context(), key)
+		if err == ErrNotFound {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("Reading %s: %s", key, err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		defer obj.Close()
+		if md != nil {
+			setMetadataHeaders(w.Header(), md)
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		if r.Method == http.MethodHead {
+			return
+		}
+		_, err = io.Copy(w, obj)
+		if err != nil {
+			log.Printf("Sending replica of %s: %s", key, err)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kfsoftware/externalbuilder/cmd/internal/signedurl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCluster starts n file servers replicating to each other
+func newTestCluster(t *testing.T, n int) ([]*fileServer, []*httptest.Server, func()) {
+	secret := []byte("secret")
+	servers := make([]*fileServer, n)
+	https := make([]*httptest.Server, n)
+	cleanups := []func(){}
+	for i := range servers {
+		s, cleanup := newTestFileServer(t)
+		s.secret = secret
+		servers[i] = s
+		https[i] = httptest.NewServer(s.routes())
+		cleanups = append(cleanups, cleanup, https[i].Close)
+	}
+	for i, s := range servers {
+		peers := []string{}
+		for j, h := range https {
+			if j != i {
+				peers = append(peers, h.URL)
+			}
+		}
+		s.replicator = &replicator{
+			storage: s.storage,
+			peers:   peers,
+			secret:  []byte("replication"),
+			client:  http.DefaultClient,
+			modes: map[string]replicationMode{
+				"chaincode-source.tar": replicateAsync,
+				"chaincode-output.tar": replicateSync,
+			},
+			minAcks:    1,
+			retryDelay: 10 * time.Millisecond,
+			ctx:        context.Background(),
+		}
+	}
+	return servers, https, func() {
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+	}
+}
+
+func signedRequest(t *testing.T, method, url, buildID, body string, op signedurl.Operation) *http.Response {
+	q := signedurl.Sign([]byte("secret"), buildID, op, time.Now().Add(time.Minute))
+	req, err := http.NewRequest(method, url+"?"+q.Encode(), strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set(labelHeader, "fabcar_1")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp
+}
+
+func TestReplication(t *testing.T) {
+	servers, https, cleanup := newTestCluster(t, 3)
+	defer cleanup()
+	ctx := context.Background()
+
+	// Outputs are on every replica once the upload is acknowledged
+	resp := signedRequest(t, "POST", https[0].URL+"/build1/chaincode-output.tar", "build1", "output", signedurl.Write)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	uploaded, err := readMetadata(ctx, servers[0].storage, "build1/chaincode-output.tar")
+	require.NoError(t, err)
+	for _, s := range servers[1:] {
+		md, err := readMetadata(ctx, s.storage, "build1/chaincode-output.tar")
+		require.NoError(t, err)
+		assert.Equal(t, "fabcar_1", md.Label)
+		assert.Equal(t, uploaded.Digest, md.Digest)
+		assert.True(t, uploaded.UploadedAt.Equal(md.UploadedAt))
+	}
+
+	// Sources are replicated in the background
+	resp = signedRequest(t, "POST", https[0].URL+"/build1/chaincode-source.tar", "build1", "source", signedurl.Write)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, servers[0].replicator.Wait(ctx))
+	for _, s := range servers[1:] {
+		_, err := s.storage.Stat(ctx, "build1/chaincode-source.tar")
+		assert.NoError(t, err)
+	}
+
+	// Deleting a build deletes it everywhere
+	req := httptest.NewRequest("DELETE", "/api/builds/build1", nil)
+	rec := httptest.NewRecorder()
+	servers[1].adminToken = "admin"
+	req.Header.Set("Authorization", "Bearer admin")
+	servers[1].routes().ServeHTTP(rec, req)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	for _, s := range servers {
+		artifacts, err := listArtifacts(ctx, s.storage, "")
+		require.NoError(t, err)
+		assert.Empty(t, artifacts)
+	}
+}
+
+func TestReplicationFetchFromPeer(t *testing.T) {
+	servers, https, cleanup := newTestCluster(t, 2)
+	defer cleanup()
+	servers[0].replicator.modes = map[string]replicationMode{}
+
+	resp := signedRequest(t, "POST", https[0].URL+"/build1/chaincode-source.tar", "build1", "source", signedurl.Write)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err := servers[1].storage.Stat(context.Background(), "build1/chaincode-source.tar")
+	require.Equal(t, ErrNotFound, err)
+
+	// The other replica fetches the artifact on the first read
+	rec := doRequest(t, servers[1].routes(), "GET", "/build1/chaincode-source.tar?"+
+		signedurl.Sign(servers[1].secret, "build1", signedurl.Read, time.Now().Add(time.Minute)).Encode(), "", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "source", rec.Body.String())
+	md, err := readMetadata(context.Background(), servers[1].storage, "build1/chaincode-source.tar")
+	require.NoError(t, err)
+	assert.Equal(t, "fabcar_1", md.Label)
+
+	rec = doRequest(t, servers[1].routes(), "GET", "/build2/chaincode-source.tar?"+
+		signedurl.Sign(servers[1].secret, "build2", signedurl.Read, time.Now().Add(time.Minute)).Encode(), "", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestReplicationSyncFailure(t *testing.T) {
+	servers, https, cleanup := newTestCluster(t, 2)
+	defer cleanup()
+	https[1].Close()
+
+	// Without a copy on another replica the output upload is rejected
+	resp := signedRequest(t, "POST", https[0].URL+"/build1/chaincode-output.tar", "build1", "output", signedurl.Write)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	_, err := servers[0].storage.Stat(context.Background(), "build1/chaincode-output.tar")
+	assert.Equal(t, ErrNotFound, err)
+
+	// Sources don't wait for the peers
+	resp = signedRequest(t, "POST", https[0].URL+"/build1/chaincode-source.tar", "build1", "source", signedurl.Write)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, servers[0].replicator.Wait(context.Background()))
+}
+
+func TestReplicaAuthorization(t *testing.T) {
+	servers, _, cleanup := newTestCluster(t, 1)
+	defer cleanup()
+	s := servers[0]
+	tenant, err := s.newTenantServer("Org1MSP", tenantConfig{Secret: "s1"})
+	require.NoError(t, err)
+	s.tenants = map[string]*fileServer{"Org1MSP": tenant}
+	h := s.routes()
+	path := "/api/replicate/build1/chaincode-output.tar"
+
+	// The URLs signed for the clients don't grant access to the replicas
+	rec := doRequest(t, h, "PUT", signedPath(path, "secret", "build1", signedurl.Write), "output", nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = doRequest(t, h, "PUT", signedPath(path, "replication", "build1", signedurl.Read), "output", nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = doRequest(t, h, "PUT", signedPath(path, "replication", "build1", signedurl.Write), "output", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = doRequest(t, h, "DELETE", signedPath(path, "secret", "build1", signedurl.Write), "", nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = doRequest(t, h, "DELETE", signedPath(path, "replication", "build1", signedurl.Read), "", nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = doRequest(t, h, "DELETE", signedPath(path, "replication", "build1", signedurl.Write), "", nil)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	// The signatures are scoped to the partition of a tenant
+	tenantPath := "/tenants/Org1MSP" + path
+	rec = doRequest(t, h, "PUT", signedPath(tenantPath, "replication", "build1", signedurl.Write), "output", nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = doRequest(t, h, "PUT", signedPath(tenantPath, "s1", "build1", signedurl.Write), "output", nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = doRequest(t, h, "PUT", signedPath(tenantPath, "replication", "tenants/Org1MSP/build1", signedurl.Write), "output", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// Without a replication secret the replicas are closed when the clients are authenticated
+	s.replicator.secret = nil
+	rec = doRequest(t, h, "PUT", signedPath(path, "secret", "build1", signedurl.Write), "output", nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = doRequest(t, h, "GET", path, "", nil)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func TestNewReplicatorFromEnv(t *testing.T) {
+	defer os.Unsetenv("REPLICATION_PEERS")
+	defer os.Unsetenv("REPLICATION_SECRET")
+	os.Setenv("REPLICATION_PEERS", "http://fileserver-1.fileserver:8080")
+
+	_, err := newReplicatorFromEnv(context.Background(), nil, []byte("secret"))
+	assert.Error(t, err)
+	os.Setenv("REPLICATION_SECRET", "secret")
+	_, err = newReplicatorFromEnv(context.Background(), nil, []byte("secret"))
+	assert.Error(t, err)
+
+	os.Setenv("REPLICATION_SECRET", "replication")
+	r, err := newReplicatorFromEnv(context.Background(), nil, []byte("secret"))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("replication"), r.secret)
+	assert.Equal(t, []byte("replication"), r.forTenant(nil, "Org1MSP").secret)
+}
+
+func TestParsePeers(t *testing.T) {
+	peers, err := parsePeers("http://fileserver-0.fileserver:8080, http://fileserver-1.fileserver:8080/,,https://10.0.0.3:8443", "fileserver-0")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"http://fileserver-1.fileserver:8080", "https://10.0.0.3:8443"}, peers)
+
+	peers, err = parsePeers("", "fileserver-0")
+	require.NoError(t, err)
+	assert.Empty(t, peers)
+
+	_, err = parsePeers("fileserver-1:8080", "fileserver-0")
+	assert.Error(t, err)
+}
+
+func TestReplicationGarbageCollection(t *testing.T) {
+	servers, https, cleanup := newTestCluster(t, 2)
+	defer cleanup()
+	ctx := context.Background()
+
+	resp := signedRequest(t, "POST", https[0].URL+"/build1/chaincode-output.tar", "build1", "output", signedurl.Write)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, err := servers[1].storage.Stat(ctx, "build1/chaincode-output.tar")
+	require.NoError(t, err)
+
+	// Artifacts collected on one replica are deleted from the others, so they aren't fetched back
+	servers[0].gc.policy = gcPolicy{MaxAge: time.Nanosecond}
+	report, err := servers[0].gc.Run(ctx, false)
+	require.NoError(t, err)
+	assert.Len(t, report.Deleted, 1)
+	for _, s := range servers {
+		artifacts, err := listArtifacts(ctx, s.storage, "")
+		require.NoError(t, err)
+		assert.Empty(t, artifacts)
+	}
+	resp = signedRequest(t, "GET", https[0].URL+"/build1/chaincode-output.tar", "build1", "", signedurl.Read)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// uploadOffsetHeader reports how many bytes of a resumable upload the server holds
+	uploadOffsetHeader = "Upload-Offset"
+
+	// partialUploadTTL is how long an abandoned resumable upload is kept
+	partialUploadTTL = 24 * time.Hour
+)
+
+var contentRangePattern = regexp.MustCompile(`^bytes (?:(\d+)-(\d+)|\*)/(\d+)$`)
+
+// partialUploads keeps the chunks of resumable uploads on local disk until they are complete
+type partialUploads struct {
+	dir   string
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// newPartialUploads keeps the resumable uploads in UPLOAD_DIR, or a temporary directory if it's not set
+func newPartialUploads() (*partialUploads, error) {
+	dir := os.Getenv("UPLOAD_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "fileserver-uploads")
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating upload directory")
+	}
+	return &partialUploads{dir: dir, locks: map[string]*sync.Mutex{}}, nil
+}
+
+// lock serializes the requests for the upload of key
+func (p *partialUploads) lock(key string) func() {
+	p.mu.Lock()
+	l, ok := p.locks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		p.locks[key] = l
+	}
+	p.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func (p *partialUploads) path(key string) string {
+	return filepath.Join(p.dir, strings.ReplaceAll(key, "/", "_")+".partial")
+}
+
+// offset returns the number of bytes received for the upload of key
+func (p *partialUploads) offset(key string) (int64, error) {
+	fi, err := os.Stat(p.path(key))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// ExpireLoop removes abandoned uploads until ctx is done
+func (p *partialUploads) ExpireLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			files, err := ioutil.ReadDir(p.dir)
+			if err != nil {
+				log.Printf("Listing partial uploads: %s", err)
+				continue
+			}
+			for _, fi := range files {
+				if fi.IsDir() {
+					// Uploads of the tenants, expired by their own loop
+					continue
+				}
+				if time.Since(fi.ModTime()) > partialUploadTTL {
+					log.Printf("Removing abandoned upload %s", fi.Name())
+					os.Remove(filepath.Join(p.dir, fi.Name()))
+				}
+			}
+		}
+	}
+}
+
+// parseContentRange parses a Content-Range header of the form "bytes <start>-<end>/<total>"
+// or "bytes */<total>", start is -1 for the latter
+func parseContentRange(value string) (int64, int64, int64, error) {
+	m := contentRangePattern.FindStringSubmatch(value)
+	if m == nil {
+		return 0, 0, 0, errors.Errorf("invalid Content-Range %q", value)
+	}
+	total, err := strconv.ParseInt(m[3], 10, 64)
+	if err != nil {
+		return 0, 0, 0, errors.Errorf("invalid Content-Range %q", value)
+	}
+	if m[1] == "" {
+		return -1, -1, total, nil
+	}
+	start, err1 := strconv.ParseInt(m[1], 10, 64)
+	end, err2 := strconv.ParseInt(m[2], 10, 64)
+	if err1 != nil || err2 != nil || start > end || end >= total {
+		return 0, 0, 0, errors.Errorf("invalid Content-Range %q", value)
+	}
+	return start, end, total, nil
+}
+
+// serveChunk handles resumable uploads, sent as a series of PUT requests with a Content-Range header.
+// A request with "Content-Range: bytes */<total>" and no body queries the current offset.
+// Every response carries the number of bytes received so far in the Upload-Offset header,
+// the upload is stored as an artifact once the last chunk arrives.
+func (s *fileServer) serveChunk(buildID string, artifact string, w http.ResponseWriter, r *http.Request) {
+	key := artifactKey(buildID, artifact)
+	start, end, total, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		log.Printf("Rejecting chunk for %s: %s", key, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if total > s.maxUploadSize {
+		log.Printf("Rejecting chunk for %s: %d bytes exceed the maximum of %d", key, total, s.maxUploadSize)
+		http.Error(w, errUploadTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	info, err := getUploadInfo(r)
+	if err != nil {
+		log.Printf("Rejecting chunk for %s: %s", key, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	unlock := s.uploads.lock(key)
+	defer unlock()
+
+	offset, err := s.uploads.offset(key)
+	if err != nil {
+		log.Printf("Reading partial upload of %s: %s", key, err)
+		http.Error(w, "reading partial upload failed", http.StatusInternalServerError)
+		return
+	}
+
+	if start < 0 {
+		// Only a stored artifact completes an upload. A partial upload holding all the bytes
+		// failed to be stored, so it starts over.
+		if offset >= total {
+			log.Printf("Discarding partial upload of %s, it wasn't stored", key)
+			os.Remove(s.uploads.path(key))
+			offset = 0
+		}
+		// A finished upload whose response got lost is reported as complete
+		if offset == 0 && s.isStored(r.Context(), key, total, info) {
+			offset = total
+		}
+		w.Header().Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if start != offset {
+		w.Header().Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+		http.Error(w, "chunk does not start at the upload offset", http.StatusConflict)
+		return
+	}
+	if start == 0 && !s.checkQuota(r.Context(), key, total, w) {
+		return
+	}
+
+	path := s.uploads.path(key)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("Opening partial upload of %s: %s", key, err)
+		http.Error(w, "writing partial upload failed", http.StatusInternalServerError)
+		return
+	}
+	length := end - start + 1
+	n, err := io.Copy(f, io.LimitReader(r.Body, length))
+	closeErr := f.Close()
+	offset += n
+	w.Header().Set(uploadOffsetHeader, strconv.FormatInt(offset, 10))
+	if err == nil && closeErr != nil {
+		log.Printf("Writing partial upload of %s: %s", key, closeErr)
+		http.Error(w, "writing partial upload failed", http.StatusInternalServerError)
+		return
+	}
+	if err != nil || n != length {
+		// Keep what we got, the client resumes from the reported offset
+		log.Printf("Incomplete chunk for %s: received %d of %d bytes", key, n, length)
+		http.Error(w, "incomplete chunk", http.StatusBadRequest)
+		return
+	}
+	if offset < total {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	f, err = os.Open(path)
+	if err != nil {
+		log.Printf("Opening partial upload of %s: %s", key, err)
+		http.Error(w, "storing file failed", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	md, err := s.storeArtifact(r.Context(), buildID, artifact, f, total, info)
+	if err == errDigestMismatch || err == errInvalidEncoding {
+		// The received data is corrupt, so the upload starts over
+		log.Printf("Rejecting upload to %s: %s", key, err)
+		os.Remove(path)
+		w.Header().Set(uploadOffsetHeader, "0")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err == errQuotaExceeded {
+		log.Printf("Rejecting upload to %s of %s: %s", key, s.tenant, err)
+		os.Remove(path)
+		w.Header().Set(uploadOffsetHeader, "0")
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		// The upload starts over, otherwise the client would take the full partial upload
+		// for a stored artifact
+		log.Printf("Storing upload to %s: %s", key, err)
+		os.Remove(path)
+		w.Header().Set(uploadOffsetHeader, "0")
+		http.Error(w, "storing file failed", http.StatusInternalServerError)
+		return
+	}
+	os.Remove(path)
+	err = s.replicateUpload(r.Context(), buildID, artifact)
+	if err != nil {
+		// The upload starts over
+		log.Printf("Replicating upload to %s: %s", key, err)
+		w.Header().Set(uploadOffsetHeader, "0")
+		http.Error(w, "replicating file failed", http.StatusServiceUnavailable)
+		return
+	}
+	setDigestHeader(w, md)
+	s.publish(eventUploaded, md)
+	log.Printf("File uploaded to %s", key)
+}
+
+// isStored returns whether the artifact under key is stored with the size of an upload,
+// and the digest the client sent if there's one
+func (s *fileServer) isStored(ctx context.Context, key string, size int64, info uploadInfo) bool {
+	stored, err := s.storage.Stat(ctx, key)
+	if err != nil || stored.Size != size {
+		return false
+	}
+	if info.Digest == "" {
+		return true
+	}
+	md, err := readMetadata(ctx, s.storage, key)
+	return err == nil && md.Digest == info.Digest
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned by a Storage when the requested object doesn't exist
+var ErrNotFound = errors.New("object not found")
+
+// errObjectChanged is returned when reading an object that was replaced since it was opened,
+// by storages that read objects lazily
+var errObjectChanged = errors.New("object changed while it was read")
+
+// ObjectInfo describes an object held by a Storage
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage is the backend where the file server keeps the artifacts.
+// Keys are slash separated paths like <buildID>/<artifact>.
+type Storage interface {
+	// Get opens the object stored under key.
+	// The returned reader implements io.ReadSeeker if the backend supports it.
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	// Put stores the content of r under key. size is -1 if unknown.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Stat returns the information of the object stored under key
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	// List returns all objects whose key starts with prefix
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// Delete removes the object stored under key
+	Delete(ctx context.Context, key string) error
+}
+
+// newStorageFromEnv creates the storage selected by STORAGE_BACKEND (local or s3)
+func newStorageFromEnv() (Storage, error) {
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "local":
+		return NewLocalStorage(os.Getenv("CHAINCODE_SHARED_DIR")), nil
+	case "s3":
+		region := os.Getenv("S3_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		return NewS3Storage(S3Config{
+			Endpoint:        os.Getenv("S3_ENDPOINT"),
+			Region:          region,
+			Bucket:          os.Getenv("S3_BUCKET"),
+			Prefix:          os.Getenv("S3_PREFIX"),
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+		})
+	default:
+		return nil, errors.Errorf("unknown storage backend %q", backend)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// LocalStorage stores the objects as files below a directory
+type LocalStorage struct {
+	root string
+}
+
+// NewLocalStorage creates a storage keeping the objects below root
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{root: root}
+}
+
+func (s *LocalStorage) path(key string) string {
+	// Cleaning the key as an absolute path keeps it below root
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (s *LocalStorage) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	f, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ObjectInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, ObjectInfo{}, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, ObjectInfo{}, ErrNotFound
+	}
+	return f, ObjectInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *LocalStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	completePath := s.path(key)
+	err := os.MkdirAll(filepath.Dir(completePath), 0755)
+	if err != nil {
+		return errors.Wrap(err, "creating directory")
+	}
+	// Write to a temporary file next to the target and rename it afterwards,
+	// so readers never see a partially written file
+	f, err := ioutil.TempFile(filepath.Dir(completePath), "."+filepath.Base(completePath)+".upload-")
+	if err != nil {
+		return errors.Wrap(err, "creating temporary file")
+	}
+	defer os.Remove(f.Name()) // No-op once renamed
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "writing file")
+	}
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "syncing file")
+	}
+	err = f.Close()
+	if err != nil {
+		return errors.Wrap(err, "closing file")
+	}
+	err = os.Chmod(f.Name(), 0644)
+	if err != nil {
+		return errors.Wrap(err, "changing permissions of file")
+	}
+	return errors.Wrap(os.Rename(f.Name(), completePath), "renaming file")
+}
+
+func (s *LocalStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	fi, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) || (err == nil && fi.IsDir()) {
+		return ObjectInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *LocalStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	err := filepath.Walk(s.root, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skip directories and uploads in progress
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, file)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, ObjectInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()})
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return objects, nil
+	}
+	return objects, err
+}
+
+func (s *LocalStorage) Delete(ctx context.Context, key string) error {
+	completePath := s.path(key)
+	err := os.Remove(completePath)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	// Remove the build directory once it's empty, ignoring failures if it's not
+	if dir := filepath.Dir(completePath); dir != filepath.Clean(s.root) {
+		_ = os.Remove(dir)
+	}
+	return nil
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3EmptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Config configures a S3 compatible object store
+type S3Config struct {
+	Endpoint        string // e.g. https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Region          string
+	Bucket          string
+	Prefix          string // Prepended to every key
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// S3Storage stores the objects in a bucket of a S3 compatible object store.
+// Requests use path-style addressing and AWS Signature Version 4.
+type S3Storage struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3Storage creates a storage keeping the objects in a S3 bucket
+func NewS3Storage(cfg S3Config) (*S3Storage, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("S3 storage requires an endpoint and a bucket")
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing S3 endpoint")
+	}
+	return &S3Storage{
+		cfg:      cfg,
+		endpoint: endpoint,
+		client:   &http.Client{},
+	}, nil
+}
+
+func (s *S3Storage) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	info, etag, err := s.head(ctx, key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return &s3Object{ctx: ctx, storage: s, key: key, size: info.Size, etag: etag}, info, nil
+}
+
+// s3Object reads an object lazily, fetching it from the current offset with a range request.
+// This allows serving range requests without downloading the whole object. The requests are
+// conditional on the ETag of the object when it was opened, so reading an object replaced in
+// the meantime fails with errObjectChanged instead of mixing both contents.
+type s3Object struct {
+	ctx     context.Context
+	storage *S3Storage
+	key     string
+	size    int64
+	etag    string
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		header := http.Header{}
+		header.Set("Range", fmt.Sprintf("bytes=%d-", o.offset))
+		if o.etag != "" {
+			header.Set("If-Match", o.etag)
+		}
+		resp, err := o.storage.doWithHeader(o.ctx, http.MethodGet, o.storage.objectKey(o.key), nil, header, nil, -1)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode == http.StatusPreconditionFailed {
+			resp.Body.Close()
+			return 0, errObjectChanged
+		}
+		if err := checkS3Response(resp); err != nil {
+			resp.Body.Close()
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if size < 0 {
+		// S3 requires the content length of the object, so spool it first
+		tmp, err := ioutil.TempFile("", "s3-upload-")
+		if err != nil {
+			return errors.Wrap(err, "creating spool file")
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		size, err = io.Copy(tmp, r)
+		if err != nil {
+			return errors.Wrap(err, "spooling upload")
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		r = tmp
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, s.objectKey(key), nil, r, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkS3Response(resp)
+}
+
+func (s *S3Storage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, _, err := s.head(ctx, key)
+	return info, err
+}
+
+// head returns the information and the ETag of an object
+func (s *S3Storage) head(ctx context.Context, key string) (ObjectInfo, string, error) {
+	resp, err := s.do(ctx, http.MethodHead, s.objectKey(key), nil, nil, -1)
+	if err != nil {
+		return ObjectInfo{}, "", err
+	}
+	defer resp.Body.Close()
+	if err := checkS3Response(resp); err != nil {
+		return ObjectInfo{}, "", err
+	}
+	return s3ObjectInfo(key, resp), resp.Header.Get("ETag"), nil
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (s *S3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", s.objectKey(prefix))
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, -1)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkS3Response(resp); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		result := s3ListBucketResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "decoding S3 list response")
+		}
+		for _, c := range result.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:     strings.TrimPrefix(c.Key, s.cfg.Prefix),
+				Size:    c.Size,
+				ModTime: c.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	// S3 doesn't report missing objects on DELETE
+	if _, err := s.Stat(ctx, key); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodDelete, s.objectKey(key), nil, nil, -1)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkS3Response(resp)
+}
+
+func (s *S3Storage) objectKey(key string) string {
+	return s.cfg.Prefix + key
+}
+
+// do sends a signed request for an object of the bucket, or for the bucket itself if objectKey is empty
+func (s *S3Storage) do(ctx context.Context, method, objectKey string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	return s.doWithHeader(ctx, method, objectKey, query, nil, body, size)
+}
+
+func (s *S3Storage) doWithHeader(ctx context.Context, method, objectKey string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.cfg.Bucket
+	if objectKey != "" {
+		u.Path += "/" + objectKey
+	}
+	u.RawPath = s3URIEncode(u.Path, false)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	s.sign(req, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	return resp, errors.Wrapf(err, "S3 %s %s", method, objectKey)
+}
+
+// sign adds an AWS Signature Version 4 to req
+func (s *S3Storage) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := s3EmptyPayload
+	if req.Body != nil {
+		payloadHash = s3UnsignedPayload
+	}
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.cfg.Region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(sha256Sum([]byte(canonicalRequest))),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretAccessKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func checkS3Response(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.StatusCode >= 300:
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("S3 responded %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func s3ObjectInfo(key string, resp *http.Response) ObjectInfo {
+	size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return ObjectInfo{Key: key, Size: size, ModTime: modTime}
+}
+
+// s3URIEncode encodes s as required by AWS Signature Version 4
+func s3URIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3URIEncode(k, true)+"="+s3URIEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func sha256Sum(data []byte) []byte {
+	h := sha256.Sum256(data)
+	return h[:]
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is an in-memory stand-in for a S3 compatible object store like MinIO
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+}
+
+func newFakeS3(bucket string) *httptest.Server {
+	return httptest.NewServer(&fakeS3{bucket: bucket, objects: map[string][]byte{}})
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	parts := strings.SplitN(path, "/", 2)
+	if parts[0] != f.bucket {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(parts) == 1 {
+		f.list(w, r.URL.Query().Get("prefix"))
+		return
+	}
+	key := parts[1]
+	switch r.Method {
+	case http.MethodPut:
+		if r.ContentLength < 0 {
+			w.WriteHeader(http.StatusLengthRequired)
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = data
+	case http.MethodGet, http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha256.Sum256(data)))
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(data)))
+			return
+		}
+		http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(data))
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	result := struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Contents []content
+	}{}
+	for key, data := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, content{Key: key, Size: int64(len(data)), LastModified: time.Now()})
+		}
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+func testStorage(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	_, _, err := s.Get(ctx, "build1/chaincode-source.tar")
+	assert.Equal(t, ErrNotFound, err)
+
+	require.NoError(t, s.Put(ctx, "build1/chaincode-source.tar", strings.NewReader("source"), 6))
+	require.NoError(t, s.Put(ctx, "build1/chaincode-output.tar", bytes.NewBufferString("output"), -1))
+	require.NoError(t, s.Put(ctx, "build2/chaincode-source.tar", strings.NewReader(""), 0))
+
+	r, info, err := s.Get(ctx, "build1/chaincode-source.tar")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "source", string(data))
+	assert.EqualValues(t, 6, info.Size)
+
+	// Seek to serve range requests
+	r, _, err = s.Get(ctx, "build1/chaincode-source.tar")
+	require.NoError(t, err)
+	rs, ok := r.(io.ReadSeeker)
+	require.True(t, ok)
+	_, err = rs.Seek(2, io.SeekStart)
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(rs)
+	r.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "urce", string(data))
+
+	info, err = s.Stat(ctx, "build1/chaincode-output.tar")
+	require.NoError(t, err)
+	assert.EqualValues(t, 6, info.Size)
+
+	objects, err := s.List(ctx, "build1/")
+	require.NoError(t, err)
+	keys := []string{}
+	for _, o := range objects {
+		keys = append(keys, o.Key)
+	}
+	sort.Strings(keys)
+	assert.Equal(t, []string{"build1/chaincode-output.tar", "build1/chaincode-source.tar"}, keys)
+
+	require.NoError(t, s.Delete(ctx, "build1/chaincode-output.tar"))
+	assert.Equal(t, ErrNotFound, s.Delete(ctx, "build1/chaincode-output.tar"))
+	_, err = s.Stat(ctx, "build1/chaincode-output.tar")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestLocalStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileserver")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	testStorage(t, NewLocalStorage(dir))
+}
+
+func TestS3Storage(t *testing.T) {
+	srv := newFakeS3("chaincodes")
+	defer srv.Close()
+
+	s, err := NewS3Storage(S3Config{
+		Endpoint:        srv.URL,
+		Region:          "us-east-1",
+		Bucket:          "chaincodes",
+		Prefix:          "peer0/",
+		AccessKeyID:     "minio",
+		SecretAccessKey: "minio123",
+	})
+	require.NoError(t, err)
+	testStorage(t, s)
+
+	// Objects replaced after they were opened are not read
+	ctx := context.Background()
+	require.NoError(t, s.Put(ctx, "build1/chaincode-source.tar", strings.NewReader("source"), 6))
+	r, _, err := s.Get(ctx, "build1/chaincode-source.tar")
+	require.NoError(t, err)
+	require.NoError(t, s.Put(ctx, "build1/chaincode-source.tar", strings.NewReader("replaced"), 8))
+	_, err = ioutil.ReadAll(r)
+	r.Close()
+	assert.Equal(t, errObjectChanged, err)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// tenantsPrefix is the storage prefix and URL path prefix of the tenants' artifacts
+const tenantsPrefix = "tenants/"
+
+var errQuotaExceeded = errors.New("storage quota of the tenant exceeded")
+
+// tenantPattern matches tenant names, such as MSP IDs or namespaces
+var tenantPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// tenantConfig is the configuration of a tenant in TENANTS_FILE
+type tenantConfig struct {
+	// Secret signs the URLs of the tenant, in place of FILE_SERVER_SECRET
+	Secret string `yaml:"secret"`
+	// Quota is the maximum size in bytes of the tenant's artifacts, unlimited if zero
+	Quota int64 `yaml:"quota"`
+	// UpstreamSecret signs the requests to the partition of the tenant on the upstream file server
+	UpstreamSecret string `yaml:"upstream_secret"`
+}
+
+// loadTenants reads the tenants from a YAML file mapping their names to their configuration.
+// Every tenant needs its own secret when requests are authenticated, which can't be the
+// secret of the replication either.
+func loadTenants(path string, secret []byte, replicationSecret []byte) (map[string]tenantConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading tenants file")
+	}
+	tenants := map[string]tenantConfig{}
+	err = yaml.UnmarshalStrict(data, &tenants)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing tenants file")
+	}
+
+	secrets := map[string]string{}
+	if len(secret) > 0 {
+		secrets[string(secret)] = "FILE_SERVER_SECRET"
+	}
+	if len(replicationSecret) > 0 {
+		secrets[string(replicationSecret)] = "REPLICATION_SECRET"
+	}
+	for name, cfg := range tenants {
+		if !tenantPattern.MatchString(name) {
+			return nil, errors.Errorf("invalid tenant name %q", name)
+		}
+		if cfg.Quota < 0 {
+			return nil, errors.Errorf("invalid quota %d of tenant %s", cfg.Quota, name)
+		}
+		if cfg.Secret == "" {
+			if len(secret) > 0 {
+				return nil, errors.Errorf("tenant %s has no secret", name)
+			}
+			continue
+		}
+		if other, ok := secrets[cfg.Secret]; ok {
+			return nil, errors.Errorf("tenant %s has the same secret as %s", name, other)
+		}
+		secrets[cfg.Secret] = name
+	}
+	return tenants, nil
+}
+
+// tenantStorage is the partition of a storage holding the artifacts of a tenant
+// under tenants/<tenant>/, limited to the tenant's quota
+type tenantStorage struct {
+	backend Storage
+	prefix  string
+	quota   int64
+}
+
+func newTenantStorage(backend Storage, tenant string, quota int64) *tenantStorage {
+	return &tenantStorage{backend: backend, prefix: tenantsPrefix + tenant + "/", quota: quota}
+}
+
+func (s *tenantStorage) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	r, info, err := s.backend.Get(ctx, s.prefix+key)
+	info.Key = key
+	return r, info, err
+}
+
+// Put stores an object, failing with errQuotaExceeded if it doesn't fit in the quota.
+// Metadata doesn't count towards the quota.
+func (s *tenantStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if s.quota <= 0 || strings.HasSuffix(key, metadataSuffix) {
+		return s.backend.Put(ctx, s.prefix+key, r, size)
+	}
+	available, err := s.Available(ctx, key)
+	if err != nil {
+		return err
+	}
+	if size > available {
+		return errQuotaExceeded
+	}
+	qr := &quotaReader{r: r, remaining: available}
+	err = s.backend.Put(ctx, s.prefix+key, qr, size)
+	if qr.exceeded {
+		return errQuotaExceeded
+	}
+	return err
+}
+
+func (s *tenantStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := s.backend.Stat(ctx, s.prefix+key)
+	info.Key = key
+	return info, err
+}
+
+func (s *tenantStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects, err := s.backend.List(ctx, s.prefix+prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i := range objects {
+		objects[i].Key = strings.TrimPrefix(objects[i].Key, s.prefix)
+	}
+	return objects, nil
+}
+
+func (s *tenantStorage) Delete(ctx context.Context, key string) error {
+	return s.backend.Delete(ctx, s.prefix+key)
+}
+
+// Usage returns the size of the tenant's artifacts
+func (s *tenantStorage) Usage(ctx context.Context) (int64, error) {
+	return s.usage(ctx, "")
+}
+
+// usage returns the size of the tenant's artifacts, leaving out the one stored under exclude
+func (s *tenantStorage) usage(ctx context.Context, exclude string) (int64, error) {
+	objects, err := s.List(ctx, "")
+	if err != nil {
+		return 0, errors.Wrap(err, "listing artifacts of the tenant")
+	}
+	var used int64
+	for _, o := range objects {
+		if o.Key != exclude && !strings.HasSuffix(o.Key, metadataSuffix) {
+			used += o.Size
+		}
+	}
+	return used, nil
+}
+
+// Available returns how many bytes can be stored under key, replacing the object stored there.
+// Concurrent uploads are not accounted for, so the quota may be exceeded by them.
+func (s *tenantStorage) Available(ctx context.Context, key string) (int64, error) {
+	used, err := s.usage(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if used >= s.quota {
+		return 0, nil
+	}
+	return s.quota - used, nil
+}
+
+// quotaReader fails once more than remaining bytes are read
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.remaining -= int64(n)
+	if q.remaining < 0 {
+		q.exceeded = true
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
+
+// checkQuota rejects an upload of size bytes to key with 507 if it doesn't fit in the
+// quota of the tenant, returning false
+func (s *fileServer) checkQuota(ctx context.Context, key string, size int64, w http.ResponseWriter) bool {
+	if s.partition == nil || s.partition.quota <= 0 || size < 0 {
+		return true
+	}
+	available, err := s.partition.Available(ctx, key)
+	if err != nil {
+		log.Printf("Checking quota of %s: %s", s.tenant, err)
+		http.Error(w, "checking quota failed", http.StatusInternalServerError)
+		return false
+	}
+	if size > available {
+		log.Printf("Rejecting upload to %s of %s: %d bytes exceed the %d bytes available", key, s.tenant, size, available)
+		http.Error(w, errQuotaExceeded.Error(), http.StatusInsufficientStorage)
+		return false
+	}
+	return true
+}
+
+// newTenantServer returns the file server of a tenant. It shares the configuration of s,
+// but serves from the tenant's partition of the storage with the tenant's secret.
+func (s *fileServer) newTenantServer(name string, cfg tenantConfig) (*fileServer, error) {
+	storage := newTenantStorage(s.storage, name, cfg.Quota)
+	secret := []byte(cfg.Secret)
+	uploadDir := filepath.Join(s.uploads.dir, tenantsPrefix, name)
+	err := os.MkdirAll(uploadDir, 0755)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating upload directory")
+	}
+	t := &fileServer{
+		storage:       storage,
+		secret:        secret,
+		adminToken:    s.adminToken,
+		maxUploadSize: s.maxUploadSize,
+		uploads:       &partialUploads{dir: uploadDir, locks: map[string]*sync.Mutex{}},
+		replicator:    s.replicator.forTenant(storage, name),
+		events:        s.events,
+		tenant:        name,
+		partition:     storage,
+	}
+	if s.upstream != nil {
+		t.upstream = s.upstream.forTenant(name, []byte(cfg.UpstreamSecret))
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", t.serveArtifact)
+	mux.HandleFunc("/api/builds", t.serveBuilds)
+	mux.HandleFunc("/api/builds/", t.serveBuild)
+	mux.HandleFunc("/api/replicate/", t.serveReplica)
+	mux.HandleFunc("/api/usage", t.serveUsage)
+	mux.HandleFunc("/api/events", t.serveEvents)
+	t.handler = mux
+	return t, nil
+}
+
+// serveTenant passes the requests under /tenants/<tenant>/ to the file server of the tenant
+func (s *fileServer) serveTenant(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/"+tenantsPrefix)
+	i := strings.Index(rest, "/")
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	t, ok := s.tenants[rest[:i]]
+	if !ok {
+		log.Printf("Rejecting %s %s from %s: unknown tenant", r.Method, r.URL.Path, r.RemoteAddr)
+		http.NotFound(w, r)
+		return
+	}
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = rest[i:]
+	t.handler.ServeHTTP(w, r2)
+}
+
+// tenantUsage is the storage used by a tenant
+type tenantUsage struct {
+	Tenant    string `json:"tenant"`
+	UsedBytes int64  `json:"used_bytes"`
+	Quota     int64  `json:"quota_bytes,omitempty"`
+}
+
+// serveUsage returns the storage used by a tenant, GET /tenants/<tenant>/api/usage
+func (s *fileServer) serveUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeAdmin(s.adminToken, len(s.secret) > 0, w, r) {
+		return
+	}
+	used, err := s.partition.Usage(r.Context())
+	if err != nil {
+		log.Printf("Computing usage of %s: %s", s.tenant, err)
+		http.Error(w, "computing usage failed", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, tenantUsage{Tenant: s.tenant, UsedBytes: used, Quota: s.partition.quota})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kfsoftware/externalbuilder/cmd/internal/signedurl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func signedPath(path string, secret string, buildID string, op signedurl.Operation) string {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + signedurl.Sign([]byte(secret), buildID, op, time.Now().Add(time.Minute)).Encode()
+}
+
+func TestLoadTenants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tenants")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tenants.yaml")
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("Org1MSP:\n  secret: s1\n  quota: 1024\norg2-ns:\n  secret: s2\n"), 0600))
+	tenants, err := loadTenants(path, []byte("secret"), []byte("replication"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]tenantConfig{
+		"Org1MSP": {Secret: "s1", Quota: 1024},
+		"org2-ns": {Secret: "s2"},
+	}, tenants)
+
+	for _, content := range []string{
+		"Org1MSP:\n  secret: s1\nOrg2MSP:\n  secret: s1\n",
+		"Org1MSP:\n  secret: secret\n",
+		"Org1MSP:\n  secret: replication\n",
+		"Org1MSP:\n  quota: 1024\n",
+		"Org1MSP:\n  secret: s1\n  quota: -1\n",
+		"../Org1MSP:\n  secret: s1\n",
+		"Org1MSP:\n  secret: s1\n  unknown: true\n",
+	} {
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+		_, err = loadTenants(path, []byte("secret"), []byte("replication"))
+		assert.Error(t, err, content)
+	}
+
+	// Without authentication tenants only partition the storage
+	require.NoError(t, ioutil.WriteFile(path, []byte("Org1MSP:\n  quota: 1024\n"), 0600))
+	_, err = loadTenants(path, nil, nil)
+	assert.NoError(t, err)
+}
+
+func TestTenantStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileserver")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	backend := NewLocalStorage(dir)
+	testStorage(t, newTenantStorage(backend, "Org1MSP", 0))
+
+	ctx := context.Background()
+	s := newTenantStorage(backend, "Org2MSP", 10)
+	require.NoError(t, s.Put(ctx, "build1/chaincode-source.tar", strings.NewReader("012345"), 6))
+	require.NoError(t, s.Put(ctx, "build1/chaincode-source.tar.meta.json", strings.NewReader("{}"), 2))
+	_, err = backend.Stat(ctx, "tenants/Org2MSP/build1/chaincode-source.tar")
+	assert.NoError(t, err)
+
+	assert.Equal(t, errQuotaExceeded, s.Put(ctx, "build1/chaincode-output.tar", strings.NewReader("01234"), 5))
+	assert.Equal(t, errQuotaExceeded, s.Put(ctx, "build1/chaincode-output.tar", strings.NewReader("01234"), -1))
+	_, err = s.Stat(ctx, "build1/chaincode-output.tar")
+	assert.Equal(t, ErrNotFound, err)
+	require.NoError(t, s.Put(ctx, "build1/chaincode-output.tar", strings.NewReader("0123"), -1))
+	// Replacing an artifact only counts the new content
+	require.NoError(t, s.Put(ctx, "build1/chaincode-source.tar", strings.NewReader("012345"), 6))
+
+	used, err := s.Usage(ctx)
+	require.NoError(t, err)
+	assert.EqualValues(t, 10, used)
+}
+
+func TestTenants(t *testing.T) {
+	s, cleanup := newTestFileServer(t)
+	defer cleanup()
+	s.secret = []byte("secret")
+	s.adminToken = "admin"
+	s.tenants = map[string]*fileServer{}
+	for name, cfg := range map[string]tenantConfig{
+		"Org1MSP": {Secret: "s1", Quota: 15},
+		"Org2MSP": {Secret: "s2"},
+	} {
+		tenant, err := s.newTenantServer(name, cfg)
+		require.NoError(t, err)
+		s.tenants[name] = tenant
+	}
+	h := s.routes()
+	path := "/tenants/Org1MSP/build1/chaincode-source.tar"
+
+	rec := doRequest(t, h, "POST", signedPath(path, "s1", "build1", signedurl.Write), "0123456789", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	_, err := s.storage.Stat(context.Background(), "tenants/Org1MSP/build1/chaincode-source.tar")
+	assert.NoError(t, err)
+
+	rec = doRequest(t, h, "GET", signedPath(path, "s1", "build1", signedurl.Read), "", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "0123456789", rec.Body.String())
+
+	// Neither other tenants nor the shared space can access the artifact
+	for _, secret := range []string{"s2", "secret"} {
+		rec = doRequest(t, h, "GET", signedPath(path, secret, "build1", signedurl.Read), "", nil)
+		assert.Equal(t, http.StatusForbidden, rec.Code, secret)
+		rec = doRequest(t, h, "POST", signedPath(path, secret, "build1", signedurl.Write), "overwritten", nil)
+		assert.Equal(t, http.StatusForbidden, rec.Code, secret)
+	}
+	rec = doRequest(t, h, "GET", signedPath("/tenants/Org2MSP/build1/chaincode-source.tar", "s2", "build1", signedurl.Read), "", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = doRequest(t, h, "GET", signedPath("/build1/chaincode-source.tar", "secret", "build1", signedurl.Read), "", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	rec = doRequest(t, h, "GET", signedPath("/tenants/Org3MSP/build1/chaincode-source.tar", "s1", "build1", signedurl.Read), "", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// Quota
+	output := "/tenants/Org1MSP/build1/chaincode-output.tar"
+	rec = doRequest(t, h, "POST", signedPath(output, "s1", "build1", signedurl.Write), "0123456789", nil)
+	assert.Equal(t, http.StatusInsufficientStorage, rec.Code)
+	rec = doRequest(t, h, "PUT", signedPath(output, "s1", "build1", signedurl.Write), "01234", map[string]string{"Content-Range": "bytes 0-4/10"})
+	assert.Equal(t, http.StatusInsufficientStorage, rec.Code)
+	rec = doRequest(t, h, "POST", signedPath(output, "s1", "build1", signedurl.Write), "01234", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = doRequest(t, h, "GET", "/tenants/Org1MSP/api/usage", "", map[string]string{"Authorization": "Bearer admin"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var usage tenantUsage
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &usage))
+	assert.Equal(t, tenantUsage{Tenant: "Org1MSP", UsedBytes: 15, Quota: 15}, usage)
+
+	// The catalog tells the builds of the tenants apart
+	rec = doRequest(t, h, "POST", signedPath("/build1/chaincode-source.tar", "secret", "build1", signedurl.Write), "shared", nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = doRequest(t, h, "GET", "/api/builds", "", map[string]string{"Authorization": "Bearer admin"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var builds []buildEntry
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &builds))
+	require.Len(t, builds, 2)
+	assert.Equal(t, "", builds[0].Tenant)
+	assert.Equal(t, "Org1MSP", builds[1].Tenant)
+	assert.Len(t, builds[1].Artifacts, 2)
+
+	rec = doRequest(t, h, "GET", "/tenants/Org1MSP/api/builds", "", map[string]string{"Authorization": "Bearer admin"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &builds))
+	require.Len(t, builds, 1)
+	assert.Equal(t, "Org1MSP", builds[0].Tenant)
+
+	// The artifacts of the tenants are not a build of the shared space
+	for _, method := range []string{"GET", "DELETE"} {
+		rec = doRequest(t, h, method, "/api/builds/tenants", "", map[string]string{"Authorization": "Bearer admin"})
+		assert.Equal(t, http.StatusBadRequest, rec.Code, method)
+	}
+	_, err = s.storage.Stat(context.Background(), "tenants/Org1MSP/build1/chaincode-source.tar")
+	assert.NoError(t, err)
+}
+
+func TestTenantReplication(t *testing.T) {
+	servers, https, cleanup := newTestCluster(t, 2)
+	defer cleanup()
+	ctx := context.Background()
+	for _, s := range servers {
+		tenant, err := s.newTenantServer("Org1MSP", tenantConfig{Secret: "s1"})
+		require.NoError(t, err)
+		s.tenants = map[string]*fileServer{"Org1MSP": tenant}
+	}
+
+	req, err := http.NewRequest("POST", https[0].URL+signedPath("/tenants/Org1MSP/build1/chaincode-output.tar", "s1", "build1", signedurl.Write), strings.NewReader("output"))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	md, err := readMetadata(ctx, servers[1].storage, "tenants/Org1MSP/build1/chaincode-output.tar")
+	require.NoError(t, err)
+	assert.Equal(t, "Org1MSP", md.Tenant)
+	_, err = servers[1].storage.Stat(ctx, "build1/chaincode-output.tar")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestLockObject(t *testing.T) {
+	s, cleanup := newTestFileServer(t)
+	defer cleanup()
+	tenant, err := s.newTenantServer("Org1MSP", tenantConfig{})
+	require.NoError(t, err)
+	s.tenants = map[string]*fileServer{"Org1MSP": tenant}
+
+	// Objects of a tenant are locked with the locks of the tenant's server,
+	// an artifact and its metadata with the same lock
+	for _, key := range []string{"tenants/Org1MSP/build1/chaincode-source.tar", "tenants/Org1MSP/build1/chaincode-source.tar.meta.json"} {
+		s.lockObject(key)()
+		assert.Contains(t, tenant.uploads.locks, "build1/chaincode-source.tar.meta.json", key)
+		assert.Empty(t, s.uploads.locks, key)
+	}
+	for _, key := range []string{"build1/chaincode-source.tar", "tenants/Unknown/build1/chaincode-source.tar"} {
+		s.lockObject(key)()
+		assert.Contains(t, s.uploads.locks, key+metadataSuffix)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kfsoftware/externalbuilder/cmd/internal/testcert"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setTLSEnv sets the TLS variables of the server, unsetting the empty ones
+func setTLSEnv(certFile, keyFile, clientCAFile string) {
+	for name, value := range map[string]string{
+		"TLS_CERT_FILE":      certFile,
+		"TLS_KEY_FILE":       keyFile,
+		"TLS_CLIENT_CA_FILE": clientCAFile,
+	} {
+		if value == "" {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, value)
+		}
+	}
+}
+
+func TestGetTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	files, err := testcert.Generate(dir)
+	require.NoError(t, err)
+	defer setTLSEnv("", "", "")
+
+	setTLSEnv("", "", "")
+	tlsConfig, err := getTLSConfig()
+	require.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+
+	setTLSEnv(files.ServerCert, files.ServerKey, files.CA)
+	tlsConfig, err = getTLSConfig()
+	require.NoError(t, err)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.TLS = tlsConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	caData, err := ioutil.ReadFile(files.CA)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	require.True(t, pool.AppendCertsFromPEM(caData))
+	clientCert, err := tls.LoadX509KeyPair(files.ClientCert, files.ClientKey)
+	require.NoError(t, err)
+	client := func(certificates ...tls.Certificate) *http.Client {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, Certificates: certificates}
+		return &http.Client{Transport: transport}
+	}
+
+	// Clients with a certificate issued by the client CA are accepted
+	resp, err := client(clientCert).Get(srv.URL)
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "launcher", string(body))
+
+	// Clients without a certificate are rejected during the handshake
+	resp, err = client().Get(srv.URL)
+	if err == nil {
+		resp.Body.Close()
+	}
+	assert.Error(t, err)
+
+	// So are clients with a certificate of another CA
+	otherDir := filepath.Join(dir, "other")
+	require.NoError(t, os.Mkdir(otherDir, 0700))
+	other, err := testcert.Generate(otherDir)
+	require.NoError(t, err)
+	otherCert, err := tls.LoadX509KeyPair(other.ClientCert, other.ClientKey)
+	require.NoError(t, err)
+	resp, err = client(otherCert).Get(srv.URL)
+	if err == nil {
+		resp.Body.Close()
+	}
+	assert.Error(t, err)
+}
+
+func TestGetTLSConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	files, err := testcert.Generate(dir)
+	require.NoError(t, err)
+	defer setTLSEnv("", "", "")
+	invalidCA := filepath.Join(dir, "invalid.crt")
+	require.NoError(t, ioutil.WriteFile(invalidCA, []byte("not a certificate"), 0600))
+
+	for _, env := range [][3]string{
+		{"", "", files.CA},                                 // Client CA without TLS
+		{files.ServerCert, files.ClientKey, ""},            // Key of another certificate
+		{files.ServerCert, files.ServerKey, invalidCA},     // No certificate in the CA file
+		{files.ServerCert, files.ServerKey, dir + "/none"}, // Missing CA file
+	} {
+		setTLSEnv(env[0], env[1], env[2])
+		_, err := getTLSConfig()
+		assert.Error(t, err, env)
+	}
+}
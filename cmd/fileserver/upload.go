@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/kfsoftware/externalbuilder/cmd/internal/compression"
+	"github.com/kfsoftware/externalbuilder/cmd/internal/digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultMaxUploadSize = 1 << 30 // 1 GiB
+)
+
+var (
+	errUploadTooLarge  = errors.New("upload exceeds the maximum size")
+	errDigestMismatch  = errors.New("content does not match the digest")
+	errInvalidEncoding = errors.New("content does not match the content encoding")
+)
+
+// getMaxUploadSize returns the maximum size of an upload in bytes, configured by MAX_UPLOAD_SIZE
+func getMaxUploadSize() (int64, error) {
+	value := os.Getenv("MAX_UPLOAD_SIZE")
+	if value == "" {
+		return defaultMaxUploadSize, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, errors.Errorf("invalid MAX_UPLOAD_SIZE %q", value)
+	}
+	return size, nil
+}
+
+// uploadReader limits the size of a request body and keeps the errors of the client side,
+// so they can be told apart from storage errors
+type uploadReader struct {
+	r         io.Reader
+	remaining int64
+	err       error
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	if u.remaining <= 0 {
+		// Check whether there is more data than allowed
+		var b [1]byte
+		n, err := u.r.Read(b[:])
+		if n > 0 {
+			u.err = errUploadTooLarge
+			return 0, u.err
+		}
+		if err != nil && err != io.EOF {
+			u.err = err
+		}
+		return 0, err
+	}
+	if int64(len(p)) > u.remaining {
+		p = p[:u.remaining]
+	}
+	n, err := u.r.Read(p)
+	u.remaining -= int64(n)
+	if err != nil && err != io.EOF {
+		u.err = err
+	}
+	return n, err
+}
+
+func (s *fileServer) serveUpload(buildID string, artifact string, w http.ResponseWriter, r *http.Request) {
+	key := artifactKey(buildID, artifact)
+	info, err := getUploadInfo(r)
+	if err != nil {
+		log.Printf("Rejecting upload to %s: %s", key, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength > s.maxUploadSize {
+		log.Printf("Rejecting upload to %s: %d bytes exceed the maximum of %d", key, r.ContentLength, s.maxUploadSize)
+		http.Error(w, errUploadTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !s.checkQuota(r.Context(), key, r.ContentLength, w) {
+		return
+	}
+
+	log.Printf("File will be uploaded to %s", key)
+	body := &uploadReader{r: r.Body, remaining: s.maxUploadSize}
+	md, err := s.storeArtifact(r.Context(), buildID, artifact, body, r.ContentLength, info)
+	if err != nil {
+		switch {
+		case err == errDigestMismatch || err == errInvalidEncoding:
+			log.Printf("Rejecting upload to %s: %s", key, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case body.err == errUploadTooLarge:
+			log.Printf("Rejecting upload to %s: %s", key, body.err)
+			http.Error(w, body.err.Error(), http.StatusRequestEntityTooLarge)
+		case err == errQuotaExceeded:
+			log.Printf("Rejecting upload to %s of %s: %s", key, s.tenant, err)
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		case body.err != nil:
+			log.Printf("Reading upload to %s: %s", key, body.err)
+			http.Error(w, "reading request body failed", http.StatusBadRequest)
+		default:
+			log.Printf("Storing upload to %s: %s", key, err)
+			http.Error(w, "storing file failed", http.StatusInternalServerError)
+		}
+		return
+	}
+	err = s.replicateUpload(r.Context(), buildID, artifact)
+	if err != nil {
+		log.Printf("Replicating upload to %s: %s", key, err)
+		http.Error(w, "replicating file failed", http.StatusServiceUnavailable)
+		return
+	}
+	setDigestHeader(w, md)
+	s.publish(eventUploaded, md)
+	log.Printf("File uploaded to %s", key)
+}
+
+// storeArtifact stores the content of r as an artifact of a build along with its metadata.
+// Compressed content is stored as is, its digest is the one of the decompressed content.
+// The content is verified before it's stored, so a corrupt upload never replaces a stored
+// artifact nor gets read: if the client sent a digest and it doesn't match the content,
+// errDigestMismatch is returned and nothing is stored.
+func (s *fileServer) storeArtifact(ctx context.Context, buildID string, artifact string, r io.Reader, size int64, info uploadInfo) (*ArtifactMetadata, error) {
+	key := artifactKey(buildID, artifact)
+	staged, ok := r.(io.ReadSeeker)
+	if !ok {
+		// Stage the content on local disk, to read it again once verified
+		f, err := ioutil.TempFile(s.stagingDir(), ".staging-")
+		if err != nil {
+			return nil, errors.Wrap(err, "creating staging file")
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		_, err = io.Copy(f, r)
+		if err != nil {
+			return nil, err
+		}
+		staged = f
+	}
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "seeking staged content")
+	}
+
+	content := newContentDigest(info.Encoding)
+	n, err := io.Copy(content, staged)
+	contentErr := content.Close()
+	if err != nil {
+		return nil, err
+	}
+	if contentErr != nil {
+		log.Printf("Decompressing %s: %s", key, contentErr)
+		return nil, errInvalidEncoding
+	}
+	sum := content.Sum()
+	if info.Digest != "" && info.Digest != sum {
+		log.Printf("Digest of %s is %s, client sent %s", key, sum, info.Digest)
+		return nil, errDigestMismatch
+	}
+
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "seeking staged content")
+	}
+	unlock := s.lockArtifact(key)
+	defer unlock()
+	err = s.storage.Put(ctx, key, staged, n)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	uploadedAt := info.UploadedAt
+	if uploadedAt.IsZero() {
+		uploadedAt = now
+	}
+	md := &ArtifactMetadata{
+		Tenant:     s.tenant,
+		BuildID:    buildID,
+		Artifact:   artifact,
+		Size:       n,
+		Encoding:   info.Encoding,
+		Label:      info.Label,
+		Digest:     sum,
+		Uploader:   info.Uploader,
+		UploadedAt: uploadedAt,
+		LastAccess: now,
+	}
+	if info.Encoding != compression.None {
+		md.UncompressedSize = content.n
+	}
+	err = writeMetadata(ctx, s.storage, key, md)
+	if err != nil {
+		return nil, errors.Wrap(err, "writing metadata")
+	}
+	return md, nil
+}
+
+// stagingDir returns the directory where uploads are staged until they are verified
+func (s *fileServer) stagingDir() string {
+	if s.uploads != nil {
+		return s.uploads.dir
+	}
+	return os.TempDir()
+}
+
+// contentDigest computes the SHA-256 and size of the content written to it,
+// decompressing it first if it's compressed
+type contentDigest struct {
+	hash hash.Hash
+	n    int64
+	pw   *io.PipeWriter // Feeds the decompression of compressed content
+	done chan error
+}
+
+func newContentDigest(encoding string) *contentDigest {
+	d := &contentDigest{hash: sha256.New()}
+	if encoding == compression.None {
+		return d
+	}
+	pr, pw := io.Pipe()
+	d.pw = pw
+	d.done = make(chan error, 1)
+	go func() {
+		r, err := compression.NewReader(pr, encoding)
+		if err == nil {
+			d.n, err = io.Copy(d.hash, r)
+			r.Close()
+		}
+		// Consume the rest, so the writer never blocks
+		io.Copy(ioutil.Discard, pr)
+		d.done <- err
+	}()
+	return d
+}
+
+func (d *contentDigest) Write(p []byte) (int, error) {
+	if d.pw != nil {
+		return d.pw.Write(p)
+	}
+	d.n += int64(len(p))
+	return d.hash.Write(p)
+}
+
+// Close waits for the decompression to finish, returning its error
+func (d *contentDigest) Close() error {
+	if d.pw == nil {
+		return nil
+	}
+	d.pw.Close()
+	return <-d.done
+}
+
+// Sum returns the hex encoded SHA-256 of the content
+func (d *contentDigest) Sum() string {
+	return hex.EncodeToString(d.hash.Sum(nil))
+}
+
+// uploadInfo describes an upload as sent by the client
+type uploadInfo struct {
+	Label      string // Chaincode label the artifact belongs to
+	Digest     string // Expected hex encoded SHA-256 of the content, empty if not sent
+	Uploader   string
+	Encoding   string    // Content encoding the artifact is compressed with
+	UploadedAt time.Time // Time of the original upload for replicas, zero for new uploads
+}
+
+// getUploadInfo returns the information sent by the client along with an upload
+func getUploadInfo(r *http.Request) (uploadInfo, error) {
+	info, err := parseUploadHeaders(r.Header)
+	info.Uploader = clientIdentity(r)
+	return info, err
+}
+
+// parseUploadHeaders parses the label, encoding and digest headers of an upload
+func parseUploadHeaders(header http.Header) (uploadInfo, error) {
+	info := uploadInfo{Label: header.Get(labelHeader)}
+	if info.Label != "" && !labelPattern.MatchString(info.Label) {
+		return info, errors.Errorf("invalid chaincode label %q", info.Label)
+	}
+	encoding, err := compression.Parse(header.Get("Content-Encoding"))
+	if err != nil {
+		return info, err
+	}
+	info.Encoding = encoding
+	if value := header.Get(digest.Header); value != "" {
+		sum, err := digest.ParseSHA256(value)
+		if err != nil {
+			return info, err
+		}
+		info.Digest = sum
+	}
+	return info, nil
+}
+
+// setDigestHeader reports the digest of an artifact in the response
+func setDigestHeader(w http.ResponseWriter, md *ArtifactMetadata) {
+	if md == nil || md.Digest == "" {
+		return
+	}
+	value, err := digest.FormatSHA256(md.Digest)
+	if err != nil {
+		log.Printf("Formatting digest of %s/%s: %s", md.BuildID, md.Artifact, err)
+		return
+	}
+	w.Header().Set(digest.Header, value)
+}
+
+// clientIdentity returns the subject of the client certificate of r, or the
+// client address if there is none
+func clientIdentity(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.String()
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// errorStorage fails to store anything
+type errorStorage struct {
+	Storage
+}
+
+func (s *errorStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	return errors.New("disk full")
+}
+
+// brokenBody fails after sending part of a body, like a client that disconnects
+type brokenBody struct {
+	io.Reader
+}
+
+func (b *brokenBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func TestServeUpload(t *testing.T) {
+	s, cleanup := newTestFileServer(t)
+	defer cleanup()
+	s.maxUploadSize = 10
+	storage := s.storage
+	key := "build1/chaincode-source.tar"
+	upload := func(body io.Reader, length int64) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/"+key, body)
+		req.ContentLength = length
+		rec := httptest.NewRecorder()
+		s.routes().ServeHTTP(rec, req)
+		return rec
+	}
+	stored := func() string {
+		obj, _, err := storage.Get(context.Background(), key)
+		require.NoError(t, err)
+		defer obj.Close()
+		data, err := ioutil.ReadAll(obj)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	rec := upload(strings.NewReader("0123456789"), 10)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "0123456789", stored())
+
+	// Too large uploads are rejected upfront, or once the limit is exceeded
+	// when the size is not known, without replacing the stored content
+	rec = upload(strings.NewReader("0123456789a"), 11)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	rec = upload(strings.NewReader("abcdefghijk"), -1)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Equal(t, "0123456789", stored())
+
+	// Interrupted uploads are client errors
+	rec = upload(&brokenBody{strings.NewReader("abc")}, -1)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "0123456789", stored())
+
+	// Storage failures are server errors
+	s.storage = &errorStorage{storage}
+	rec = upload(strings.NewReader("abc"), 3)
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kfsoftware/externalbuilder/cmd/internal/compression"
+	"github.com/kfsoftware/externalbuilder/cmd/internal/digest"
+	"github.com/kfsoftware/externalbuilder/cmd/internal/signedurl"
+	"github.com/pkg/errors"
+)
+
+const upstreamURLExpiry = 5 * time.Minute
+
+var errNoUpstreamDigest = errors.New("upstream sent no digest of the artifact")
+
+// upstream is another file server, typically in another cluster, the artifacts missing here
+// are fetched from. The upstream may itself have an upstream, forming a hierarchy of caches.
+type upstream struct {
+	url    string // Base URL of the upstream
+	secret []byte // Signs the requests to the upstream, its FILE_SERVER_SECRET
+	client *http.Client
+}
+
+// newUpstreamFromEnv configures the upstream file server of UPSTREAM_URL, or returns nil if it's not set.
+// Requests are signed with UPSTREAM_SECRET, the certificate of the upstream is verified against
+// UPSTREAM_CA_FILE and UPSTREAM_CERT_FILE and UPSTREAM_KEY_FILE are presented as client certificate.
+func newUpstreamFromEnv() (*upstream, error) {
+	value := strings.TrimRight(os.Getenv("UPSTREAM_URL"), "/")
+	if value == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.Errorf("invalid UPSTREAM_URL %q", value)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile := os.Getenv("UPSTREAM_CA_FILE"); caFile != "" {
+		caData, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading upstream CA file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, errors.Errorf("no certificates found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	certFile := os.Getenv("UPSTREAM_CERT_FILE")
+	keyFile := os.Getenv("UPSTREAM_KEY_FILE")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading upstream client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &upstream{
+		url:    value,
+		secret: []byte(os.Getenv("UPSTREAM_SECRET")),
+		client: &http.Client{Transport: transport},
+	}, nil
+}
+
+// forTenant returns the upstream of a tenant, the partition of the tenant on the upstream
+// signed with the tenant's secret there
+func (u *upstream) forTenant(name string, secret []byte) *upstream {
+	return &upstream{
+		url:    u.url + "/" + tenantsPrefix + url.PathEscape(name),
+		secret: secret,
+		client: u.client,
+	}
+}
+
+// artifactURL returns the signed download URL of an artifact on the upstream
+func (u *upstream) artifactURL(buildID string, artifact string) string {
+	a := fmt.Sprintf("%s/%s/%s", u.url, url.PathEscape(buildID), url.PathEscape(artifact))
+	if len(u.secret) == 0 {
+		return a
+	}
+	return a + "?" + signedurl.Sign(u.secret, buildID, signedurl.Read, time.Now().Add(upstreamURLExpiry)).Encode()
+}
+
+// fetch downloads an artifact from the upstream as it's stored there,
+// or returns ErrNotFound if the upstream doesn't have it
+func (u *upstream) fetch(ctx context.Context, buildID string, artifact string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u.artifactURL(buildID, artifact), nil)
+	if err != nil {
+		return nil, err
+	}
+	// Asking for an encoding keeps the client from decompressing the artifact
+	req.Header.Set("Accept-Encoding", strings.Join([]string{compression.Gzip, compression.Zstd}, ", "))
+	resp, err := u.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	return nil, errors.Errorf("upstream responded %s", resp.Status)
+}
+
+// fetchFromUpstream caches an artifact missing in the storage from the upstream. The artifact
+// is only stored if it matches the digest sent by the upstream.
+func (s *fileServer) fetchFromUpstream(ctx context.Context, buildID string, artifact string) error {
+	key := artifactKey(buildID, artifact)
+	unlock := s.uploads.lock(key)
+	defer unlock()
+	// Another request may have fetched it in the meantime
+	if _, err := s.storage.Stat(ctx, key); err != ErrNotFound {
+		return err
+	}
+
+	resp, err := s.upstream.fetch(ctx, buildID, artifact)
+	if err != nil {
+		upstreamFetchesTotal.WithLabelValues(upstreamResult(err)).Inc()
+		return err
+	}
+	defer resp.Body.Close()
+	md, err := s.storeFromUpstream(ctx, buildID, artifact, resp)
+	upstreamFetchesTotal.WithLabelValues(upstreamResult(err)).Inc()
+	if err != nil {
+		return err
+	}
+	s.publish(eventUploaded, md)
+	log.Printf("Fetched %s from upstream %s", key, s.upstream.url)
+	return nil
+}
+
+// storeFromUpstream stores the artifact sent in a response of the upstream
+func (s *fileServer) storeFromUpstream(ctx context.Context, buildID string, artifact string, resp *http.Response) (*ArtifactMetadata, error) {
+	if resp.Header.Get(digest.Header) == "" {
+		return nil, errNoUpstreamDigest
+	}
+	info, err := parseUploadHeaders(resp.Header)
+	if err != nil {
+		return nil, err
+	}
+	info.Uploader = "upstream " + s.upstream.url
+	if s.maxUploadSize > 0 && resp.ContentLength > s.maxUploadSize {
+		return nil, errUploadTooLarge
+	}
+	md, err := s.storeArtifact(ctx, buildID, artifact, resp.Body, resp.ContentLength, info)
+	if err != nil {
+		return nil, errors.Wrap(err, "storing artifact fetched from upstream")
+	}
+	return md, nil
+}
+
+func upstreamResult(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case err == ErrNotFound:
+		return "not_found"
+	default:
+		return "failure"
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kfsoftware/externalbuilder/cmd/internal/digest"
+	"github.com/kfsoftware/externalbuilder/cmd/internal/signedurl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstream(t *testing.T) {
+	up, cleanup := newTestFileServer(t)
+	defer cleanup()
+	up.secret = []byte("upstream")
+	upServer := httptest.NewServer(up.routes())
+	defer upServer.Close()
+	rec := doRequest(t, up.routes(), "POST", signedPath("/build1/chaincode-output.tar", "upstream", "build1", signedurl.Write),
+		"output", map[string]string{labelHeader: "fabcar_1"})
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	s, cleanup := newTestFileServer(t)
+	defer cleanup()
+	s.upstream = &upstream{url: upServer.URL, secret: []byte("upstream"), client: http.DefaultClient}
+	h := s.routes()
+
+	rec = doRequest(t, h, "GET", "/build1/chaincode-output.tar", "", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "output", rec.Body.String())
+	assert.NotEmpty(t, rec.Header().Get(digest.Header))
+	md, err := readMetadata(context.Background(), s.storage, "build1/chaincode-output.tar")
+	require.NoError(t, err)
+	assert.Equal(t, "fabcar_1", md.Label)
+	assert.NotEmpty(t, md.Digest)
+
+	// Served from the cache once the upstream is gone
+	upServer.Close()
+	rec = doRequest(t, h, "GET", "/build1/chaincode-output.tar", "", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "output", rec.Body.String())
+	rec = doRequest(t, h, "GET", "/build2/chaincode-output.tar", "", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestUpstreamVerification(t *testing.T) {
+	var header map[string]string
+	upServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range header {
+			w.Header().Set(k, v)
+		}
+		w.Write([]byte("tampered"))
+	}))
+	defer upServer.Close()
+	s, cleanup := newTestFileServer(t)
+	defer cleanup()
+	s.upstream = &upstream{url: upServer.URL, client: http.DefaultClient}
+	h := s.routes()
+
+	// The digest doesn't match
+	sum, err := digest.FormatSHA256("8f8ba5a4e4c7ab3ed2b8e28cd1b3a12e1d52b7b9c6ba8e4c3b5b5e3b0cd9d0c1")
+	require.NoError(t, err)
+	header = map[string]string{digest.Header: sum}
+	rec := doRequest(t, h, "GET", "/build1/chaincode-output.tar", "", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	_, err = s.storage.Stat(context.Background(), "build1/chaincode-output.tar")
+	assert.Equal(t, ErrNotFound, err)
+
+	// No digest to verify against
+	header = nil
+	rec = doRequest(t, h, "GET", "/build1/chaincode-output.tar", "", nil)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	_, err = s.storage.Stat(context.Background(), "build1/chaincode-output.tar")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestUpstreamForTenant(t *testing.T) {
+	u := &upstream{url: "https://fileserver.example.com", secret: []byte("upstream")}
+	tu := u.forTenant("Org1MSP", []byte("org1"))
+	assert.Equal(t, "https://fileserver.example.com/tenants/Org1MSP", tu.url)
+	assert.Equal(t, []byte("org1"), tu.secret)
+	assert.Equal(t, "https://fileserver.example.com/tenants/Org1MSP/build1/chaincode-output.tar", (&upstream{url: tu.url}).artifactURL("build1", "chaincode-output.tar"))
+}
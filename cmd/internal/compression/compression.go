@@ -0,0 +1,133 @@
+// Package compression implements the content codings used to transfer and store
+// artifacts, negotiated with the Content-Encoding and Accept-Encoding headers.
+package compression
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Content codings
+const (
+	None = ""
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// Parse returns the content coding named by a Content-Encoding header or a configuration setting
+func Parse(value string) (string, error) {
+	switch encoding := strings.ToLower(strings.TrimSpace(value)); encoding {
+	case "", "identity", "none":
+		return None, nil
+	case Gzip, Zstd:
+		return encoding, nil
+	default:
+		return "", errors.Errorf("unsupported content encoding %q", value)
+	}
+}
+
+// ValidateLevel checks a compression level for an encoding, 0 selects the default level
+func ValidateLevel(encoding string, level int) error {
+	max := 0
+	switch encoding {
+	case Gzip:
+		max = gzip.BestCompression
+	case Zstd:
+		max = 19
+	}
+	if level < 0 || level > max {
+		return errors.Errorf("invalid %s compression level %d", encoding, level)
+	}
+	return nil
+}
+
+// NewWriter returns a writer compressing to w, which must be closed to flush the data
+func NewWriter(w io.Writer, encoding string, level int) (io.WriteCloser, error) {
+	if err := ValidateLevel(encoding, level); err != nil {
+		return nil, err
+	}
+	switch encoding {
+	case None:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case Zstd:
+		opts := []zstd.EOption{}
+		if level > 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	default:
+		return nil, errors.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+// NewReader returns a reader decompressing r
+func NewReader(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case None:
+		return ioutil.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{d}, nil
+	default:
+		return nil, errors.Errorf("unsupported content encoding %q", encoding)
+	}
+}
+
+// Accepts tells whether an Accept-Encoding header allows a response with the encoding
+func Accepts(acceptEncoding string, encoding string) bool {
+	if encoding == None {
+		return true
+	}
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(item, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name != encoding && name != "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		return q > 0
+	}
+	return false
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// zstdReadCloser releases the resources of the decoder on Close
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
@@ -0,0 +1,64 @@
+package compression
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat("node_modules/", 1000))
+	for _, encoding := range []string{None, Gzip, Zstd} {
+		for _, level := range []int{0, 1, 9} {
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf, encoding, level)
+			if encoding == None && level > 0 {
+				assert.Error(t, err)
+				continue
+			}
+			require.NoError(t, err, encoding)
+			_, err = w.Write(data)
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+			if encoding != None {
+				assert.Less(t, buf.Len(), len(data), encoding)
+			}
+
+			r, err := NewReader(&buf, encoding)
+			require.NoError(t, err)
+			decoded, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			assert.Equal(t, data, decoded, encoding)
+		}
+	}
+
+	_, err := NewWriter(ioutil.Discard, Gzip, 10)
+	assert.Error(t, err)
+	_, err = NewReader(strings.NewReader("plain"), Gzip)
+	assert.Error(t, err)
+}
+
+func TestParse(t *testing.T) {
+	for value, expected := range map[string]string{"": None, "identity": None, "none": None, "GZIP": Gzip, " zstd": Zstd} {
+		encoding, err := Parse(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, expected, encoding, value)
+	}
+	_, err := Parse("br")
+	assert.Error(t, err)
+}
+
+func TestAccepts(t *testing.T) {
+	assert.True(t, Accepts("", None))
+	assert.False(t, Accepts("", Gzip))
+	assert.True(t, Accepts("gzip, deflate", Gzip))
+	assert.False(t, Accepts("gzip, deflate", Zstd))
+	assert.True(t, Accepts("zstd;q=0.5", Zstd))
+	assert.False(t, Accepts("zstd;q=0, *", Zstd))
+	assert.True(t, Accepts("*", Zstd))
+}
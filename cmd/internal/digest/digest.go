@@ -0,0 +1,42 @@
+// Package digest formats and parses the RFC 3230 Digest header used by the
+// file server to report the SHA-256 of the artifacts.
+package digest
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Header is the name of the HTTP header carrying the digest
+const Header = "Digest"
+
+const sha256Prefix = "sha-256="
+
+// FormatSHA256 returns the Digest header value of a hex encoded SHA-256
+func FormatSHA256(hexDigest string) (string, error) {
+	sum, err := hex.DecodeString(hexDigest)
+	if err != nil || len(sum) != 32 {
+		return "", errors.Errorf("invalid SHA-256 %q", hexDigest)
+	}
+	return sha256Prefix + base64.StdEncoding.EncodeToString(sum), nil
+}
+
+// ParseSHA256 returns the hex encoded SHA-256 of a Digest header value,
+// which may list several algorithms separated by commas
+func ParseSHA256(value string) (string, error) {
+	for _, d := range strings.Split(value, ",") {
+		d = strings.TrimSpace(d)
+		if len(d) < len(sha256Prefix) || !strings.EqualFold(d[:len(sha256Prefix)], sha256Prefix) {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(d[len(sha256Prefix):])
+		if err != nil || len(sum) != 32 {
+			return "", errors.Errorf("invalid SHA-256 digest %q", d)
+		}
+		return hex.EncodeToString(sum), nil
+	}
+	return "", errors.Errorf("no SHA-256 digest in %q", value)
+}
@@ -0,0 +1,86 @@
+// Package signedurl implements the HMAC signed URLs used to authorize requests
+// against the chaincode file server.
+//
+// A signature is scoped to a single build ID and to one operation (read or write),
+// and is only valid until its expiry time.
+package signedurl
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Operation is the kind of access granted by a signature
+type Operation string
+
+const (
+	// Read grants access to download artifacts of a build
+	Read Operation = "read"
+	// Write grants access to upload artifacts of a build
+	Write Operation = "write"
+)
+
+// Query parameters carrying the signature
+const (
+	ParamOperation = "op"
+	ParamExpires   = "expires"
+	ParamSignature = "signature"
+)
+
+var (
+	// ErrMissingSignature is returned when the request does not carry a signature at all
+	ErrMissingSignature = errors.New("missing signature")
+	// ErrInvalidSignature is returned when the signature does not match the request
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrExpired is returned when the signature is no longer valid
+	ErrExpired = errors.New("signature expired")
+	// ErrOperationNotAllowed is returned when the signature grants a different operation
+	ErrOperationNotAllowed = errors.New("operation not allowed by signature")
+)
+
+// Sign returns the query parameters granting op on buildID until expires
+func Sign(secret []byte, buildID string, op Operation, expires time.Time) url.Values {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	q := url.Values{}
+	q.Set(ParamOperation, string(op))
+	q.Set(ParamExpires, exp)
+	q.Set(ParamSignature, signature(secret, buildID, string(op), exp))
+	return q
+}
+
+// Verify checks that q carries a valid, unexpired signature granting op on buildID
+func Verify(secret []byte, buildID string, op Operation, q url.Values, now time.Time) error {
+	sig := q.Get(ParamSignature)
+	if sig == "" {
+		return ErrMissingSignature
+	}
+	signedOp := q.Get(ParamOperation)
+	exp := q.Get(ParamExpires)
+	expected := signature(secret, buildID, signedOp, exp)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return ErrInvalidSignature
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if now.Unix() > expires {
+		return ErrExpired
+	}
+	if Operation(signedOp) != op {
+		return ErrOperationNotAllowed
+	}
+	return nil
+}
+
+func signature(secret []byte, buildID string, op string, expires string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(op + "\n" + buildID + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,25 @@
+package signedurl
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Now()
+	q := Sign(secret, "build1", Write, now.Add(time.Minute))
+
+	assert.NoError(t, Verify(secret, "build1", Write, q, now))
+	assert.Equal(t, ErrOperationNotAllowed, Verify(secret, "build1", Read, q, now))
+	assert.Equal(t, ErrInvalidSignature, Verify(secret, "build2", Write, q, now))
+	assert.Equal(t, ErrInvalidSignature, Verify([]byte("other"), "build1", Write, q, now))
+	assert.Equal(t, ErrExpired, Verify(secret, "build1", Write, q, now.Add(2*time.Minute)))
+	assert.Equal(t, ErrMissingSignature, Verify(secret, "build1", Write, url.Values{}, now))
+
+	q.Set(ParamOperation, string(Read))
+	assert.Equal(t, ErrInvalidSignature, Verify(secret, "build1", Read, q, now))
+}
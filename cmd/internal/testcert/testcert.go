@@ -0,0 +1,109 @@
+// Package testcert generates the CA and certificates used by the TLS tests of the
+// file server and the launcher.
+package testcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Files are the PEM files of a test CA and the certificates it issued
+type Files struct {
+	CA         string
+	ServerCert string
+	ServerKey  string
+	ClientCert string
+	ClientKey  string
+}
+
+// Generate writes a CA, a server certificate for 127.0.0.1 and localhost and a client
+// certificate to dir
+func Generate(dir string) (*Files, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "generating CA key")
+	}
+	caTemplate := template(1, "Test CA")
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating CA certificate")
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing CA certificate")
+	}
+
+	files := &Files{
+		CA:         filepath.Join(dir, "ca.crt"),
+		ServerCert: filepath.Join(dir, "server.crt"),
+		ServerKey:  filepath.Join(dir, "server.key"),
+		ClientCert: filepath.Join(dir, "client.crt"),
+		ClientKey:  filepath.Join(dir, "client.key"),
+	}
+	if err := writePEM(files.CA, "CERTIFICATE", caDER); err != nil {
+		return nil, err
+	}
+
+	server := template(2, "fileserver")
+	server.DNSNames = []string{"localhost"}
+	server.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	server.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	if err := issue(server, ca, caKey, files.ServerCert, files.ServerKey); err != nil {
+		return nil, err
+	}
+	client := template(3, "launcher")
+	client.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	if err := issue(client, ca, caKey, files.ClientCert, files.ClientKey); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+func template(serial int64, commonName string) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+}
+
+// issue writes a certificate signed by the CA and its key
+func issue(cert *x509.Certificate, ca *x509.Certificate, caKey *ecdsa.PrivateKey, certFile string, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return errors.Wrap(err, "generating key")
+	}
+	der, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return errors.Wrapf(err, "creating certificate of %s", cert.Subject.CommonName)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return errors.Wrap(err, "marshaling key")
+	}
+	if err := writePEM(certFile, "CERTIFICATE", der); err != nil {
+		return err
+	}
+	return writePEM(keyFile, "EC PRIVATE KEY", keyDER)
+}
+
+func writePEM(path string, blockType string, der []byte) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	return errors.Wrapf(ioutil.WriteFile(path, data, 0600), "writing %s", path)
+}
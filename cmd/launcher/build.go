@@ -4,12 +4,17 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"github.com/kfsoftware/externalbuilder/cmd/internal/compression"
+	"github.com/kfsoftware/externalbuilder/cmd/internal/signedurl"
 	cpy "github.com/otiai10/copy"
 	"github.com/pkg/errors"
 	"io"
 	"io/ioutil"
+	batchv1 "k8s.io/api/batch/v1"
 	apiv1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -18,6 +23,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // Build builds a chaincode on Kubernetes
@@ -34,8 +40,8 @@ func Build(ctx context.Context, cfg Config) error {
 	log.Printf("Source dir=%s", sourceDir)
 	log.Printf("Metadata dir=%s", metadataDir)
 	log.Printf("Output dir=%s", outputDir)
-	for _, envKey := range os.Environ() {
-		log.Printf("%s=%s", envKey, os.Getenv(envKey))
+	for _, env := range redactEnvironment(os.Environ()) {
+		log.Print(env)
 	}
 	buildInfoFile := filepath.Join(outputDir, "k8scc_buildinfo.json")
 
@@ -44,48 +50,102 @@ func Build(ctx context.Context, cfg Config) error {
 	if err != nil {
 		return errors.Wrap(err, "getting metadata for chaincode")
 	}
+	// Invalid resources would only fail at run or release
+	if _, err := getChaincodeResources(cfg, metadata.Resources); err != nil {
+		return errors.Wrap(err, "invalid resources in metadata.json")
+	}
+	if isChaincodeServer(metadata.Type) {
+		return buildChaincodeServer(sourceDir, outputDir)
+	}
+	// The timeout covers the whole build, waiting for other peers included
+	if cfg.Builder.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Builder.Timeout)
+		defer cancel()
+	}
 	// /tmp/fabric-fabcar_1-1860815d78bd593aed9728d27eb8bb8c180b7e7e9918057eecb0cf6e4f38223d930256401/src
 	buildID, err := getBuildID(sourceDir)
 	if err != nil {
 		return errors.Wrap(err, "getting buildid for chaincode")
 	}
 	var buf bytes.Buffer
-	err = compress(sourceDir, &buf)
+	encoding := cfg.FileServer.Compression.Algorithm
+	sourceDigest, err := compress(sourceDir, &buf, encoding, cfg.FileServer.Compression.Level)
 	//err = tarDirectory(sourceDir, chaincodeSourceZIP)
 	if err != nil {
 		return errors.Wrap(err, "creating the tar")
 	}
 	log.Printf("Tar created ")
-	fileServerURL := getFileServerURL()
-	basePathURL := fmt.Sprintf("%s/%s", fileServerURL, buildID)
-	postURL := fmt.Sprintf("%s/chaincode-source.tar", basePathURL)
-	log.Printf("Post URL=%s", postURL)
-	resp, err := http.Post(
-		postURL,
-		"application/octet-stream",
-		&buf,
-	)
+	client, err := getFileServerClient(cfg)
 	if err != nil {
-		return err
-	}
-	if resp.StatusCode != 200 {
-		return errors.Errorf("Received %d code from server", resp.StatusCode)
+		return errors.Wrap(err, "creating file server client")
 	}
-	log.Printf("File uploaded %d", resp.StatusCode)
-	// Create builder Pod
-	pod, err := createBuilderJob(ctx, cfg, metadata, basePathURL)
-	if err != nil {
-		return errors.Wrap(err, "creating builder pod")
+
+	// Get builder image
+	image, ok := cfg.Images[strings.ToLower(metadata.Type)]
+	if !ok {
+		return fmt.Errorf("no builder image available for %q", metadata.Type)
 	}
 
-	// Watch builder Pod for completion or failure
-	podSucceeded, err := watchPodUntilCompletion(ctx, pod)
-	if err != nil {
-		return errors.Wrap(err, "watching builder pod")
+	// Peers building the same package share the output through the build cache,
+	// one of them builds it while the others wait
+	outputBuildID := buildID
+	outputDigest := ""
+	if !cfg.Builder.DisableCache {
+		outputBuildID = getBuildCacheKey(getPackageHash(sourceDir), sourceDigest, image, metadata.Type)
+		log.Printf("Build cache key %s", outputBuildID)
+		lookup := func() (string, error) {
+			return lookupBuildCache(ctx, client, getArtifactURL(cfg, outputBuildID, "chaincode-output.tar", signedurl.Read))
+		}
+		clientset, err := getKubernetesClientset()
+		if err != nil {
+			return errors.Wrap(err, "getting kubernetes clientset")
+		}
+		myself, _ := os.Hostname()
+		lease := newBuildLease(clientset, cfg.Namespace, outputBuildID, myself, getBuildLeaseDuration(cfg))
+		var acquired bool
+		outputDigest, acquired, err = waitForCachedBuild(ctx, lease, lookup, buildLeaseRetryPeriod)
+		if err != nil {
+			if ctx.Err() != nil {
+				return errors.Wrap(err, "waiting for build cache")
+			}
+			// De-duplication is an optimization, build the chaincode anyway
+			log.Printf("Waiting for build cache: %s", err)
+		}
+		if acquired {
+			stopRenewal := lease.keepAlive(ctx)
+			defer func() {
+				stopRenewal()
+				// The context may be cancelled already, waiting peers shouldn't wait for the expiry
+				if err := lease.release(context.Background()); err != nil {
+					log.Printf("Releasing build lease: %s", err)
+				}
+			}()
+		}
 	}
 
-	if !podSucceeded {
-		return fmt.Errorf("build of Chaincode %s in Pod %s failed", metadata.Label, pod.Name)
+	if outputDigest != "" {
+		log.Printf("Build cache hit, skipping builder pod")
+	} else {
+		err = runBuilder(ctx, cfg, client, metadata, buildID, outputBuildID, buf.Bytes(), sourceDigest)
+		if err != nil {
+			return err
+		}
+
+		// The builder pod sent the digest of the output along, so the file server verified it
+		outputDigest, err = getArtifactDigest(ctx, client, getArtifactURL(cfg, outputBuildID, "chaincode-output.tar", signedurl.Read))
+		if err != nil {
+			return errors.Wrap(err, "getting digest of chaincode output")
+		}
+	}
+	log.Printf("Chaincode output sha256 %s", outputDigest)
+	chaincodeImage := ""
+	if cfg.OCI.Enabled {
+		chaincodeImage, err = buildChaincodeImage(ctx, cfg, client, outputBuildID, outputDigest, image, metadata.Type)
+		if err != nil {
+			return errors.Wrap(err, "building chaincode image")
+		}
+		log.Printf("Chaincode image %s", chaincodeImage)
 	}
 	transferSrcMeta := filepath.Join(sourceDir, "META-INF")
 
@@ -99,8 +159,13 @@ func Build(ctx context.Context, cfg Config) error {
 
 	// Create build information
 	buildInformation := BuildInformation{
-		Image:    pod.Spec.InitContainers[2].Image,
-		Platform: metadata.Type,
+		Image:          image,
+		Platform:       metadata.Type,
+		SourceDigest:   sourceDigest,
+		OutputDigest:   outputDigest,
+		OutputBuildID:  outputBuildID,
+		ChaincodeImage: chaincodeImage,
+		Resources:      metadata.Resources,
 	}
 
 	bi, err := json.Marshal(buildInformation)
@@ -118,13 +183,81 @@ func Build(ctx context.Context, cfg Config) error {
 	if err != nil {
 		return errors.Wrap(err, "changing permissions of BuildInformation")
 	}
-	cleanupPodSilent(pod)
 	return nil
 }
 
-func compress(src string, buf io.Writer) error {
-	// tar > gzip > buf
-	tw := tar.NewWriter(buf)
+// credentialNames are parts of the names of the environment variables holding credentials,
+// such as FILE_SERVER_SECRET and REGISTRY_PASSWORD
+var credentialNames = []string{"SECRET", "PASSWORD", "TOKEN", "CREDENTIAL"}
+
+// redactEnvironment returns the environment with the values of the credentials replaced,
+// so it can be logged
+func redactEnvironment(environ []string) []string {
+	redacted := make([]string, 0, len(environ))
+	for _, env := range environ {
+		name := strings.SplitN(env, "=", 2)[0]
+		for _, credential := range credentialNames {
+			if strings.Contains(strings.ToUpper(name), credential) {
+				env = name + "=<redacted>"
+				break
+			}
+		}
+		redacted = append(redacted, env)
+	}
+	return redacted
+}
+
+// runBuilder uploads the compressed chaincode source and builds it in a builder pod,
+// which uploads the output under outputBuildID
+func runBuilder(ctx context.Context, cfg Config, client *http.Client, metadata *ChaincodeMetadata, buildID string, outputBuildID string, source []byte, sourceDigest string) error {
+	postURL := getArtifactURL(cfg, buildID, "chaincode-source.tar", signedurl.Write)
+	log.Printf("Uploading chaincode source for build %s", buildID)
+	header, err := getUploadHeader(metadata.Label, sourceDigest, cfg.FileServer.Compression.Algorithm)
+	if err != nil {
+		return err
+	}
+	err = uploadArtifact(ctx, cfg, client, postURL, bytes.NewReader(source), int64(len(source)), header)
+	if err != nil {
+		return errors.Wrap(err, "uploading chaincode source")
+	}
+	log.Printf("File uploaded, sha256 %s", sourceDigest)
+	clientset, err := getKubernetesClientset()
+	if err != nil {
+		return errors.Wrap(err, "getting kubernetes clientset")
+	}
+	err = deleteExpiredJobs(ctx, clientset, cfg.Namespace, time.Now())
+	if err != nil {
+		log.Printf("Deleting expired builder jobs: %q", err)
+	}
+
+	// Create builder Job
+	job, err := createBuilderJob(ctx, cfg, metadata, buildID, outputBuildID, sourceDigest)
+	if err != nil {
+		return errors.Wrap(err, "creating builder job")
+	}
+	succeeded, err := waitForBuilderJob(ctx, clientset, cfg, job, streamPodLogs)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return errors.Errorf("build of Chaincode %s in Job %s timed out after %s", metadata.Label, job.Name, cfg.Builder.Timeout)
+		}
+		return errors.Wrap(err, "watching builder job")
+	}
+	if !succeeded {
+		return fmt.Errorf("build of Chaincode %s in Job %s failed", metadata.Label, job.Name)
+	}
+	return nil
+}
+
+// compress writes the tar of src compressed with encoding to buf, and returns the
+// hex encoded SHA-256 of the tar
+func compress(src string, buf io.Writer, encoding string, level int) (string, error) {
+	// tar > compression > buf
+	cw, err := compression.NewWriter(buf, encoding, level)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	tw := tar.NewWriter(io.MultiWriter(cw, hash))
 
 	// walk through every file in the folder
 	filepath.Walk(src, func(file string, fi os.FileInfo, err error) error {
@@ -164,13 +297,17 @@ func compress(src string, buf io.Writer) error {
 
 	// produce tar
 	if err := tw.Close(); err != nil {
-		return err
+		return "", err
 	}
-	//
-	return nil
+	if err := cw.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-func createBuilderJob(ctx context.Context, cfg Config, metadata *ChaincodeMetadata, basePathURL string) (*apiv1.Pod, error) {
+// createBuilderJob creates the Job building the chaincode. Kubernetes retries the
+// builder pod if it fails or its node is drained.
+func createBuilderJob(ctx context.Context, cfg Config, metadata *ChaincodeMetadata, buildID string, outputBuildID string, sourceDigest string) (*batchv1.Job, error) {
 	// Setup kubernetes client
 	clientset, err := getKubernetesClientset()
 	if err != nil {
@@ -232,18 +369,34 @@ func createBuilderJob(ctx context.Context, cfg Config, metadata *ChaincodeMetada
 	if request := cfg.Builder.Resources.RequestsCPU; request != "" {
 		requests["cpu"] = resource.MustParse(request)
 	}
+	sourceURL := getArtifactURL(cfg, buildID, "chaincode-source.tar", signedurl.Read)
+	outputURL := getArtifactURL(cfg, outputBuildID, "chaincode-output.tar", signedurl.Write)
 	mounts := []apiv1.VolumeMount{
 		{
 			Name:      "chaincode",
 			MountPath: "/chaincode",
 		},
 	}
+	volumes := []apiv1.Volume{
+		{
+			Name: "chaincode",
+		},
+	}
+	// Only the containers talking to the file server get its TLS material
+	fileServerMounts := append([]apiv1.VolumeMount{}, mounts...)
+	if tlsVolume, tlsMount := getFileServerTLSVolume(cfg); tlsVolume != nil {
+		volumes = append(volumes, *tlsVolume)
+		fileServerMounts = append(fileServerMounts, *tlsMount)
+	}
 
-	// Pod
-	podname := fmt.Sprintf("%s-ccbuild-%s", myself, metadata.MetadataID)
-	pod := &apiv1.Pod{
+	// Job
+	jobname := fmt.Sprintf("%s-ccbuild-%s", myself, metadata.MetadataID)
+	labels := map[string]string{
+		"externalcc-type": "builder",
+	}
+	job := &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: podname,
+			Name: jobname,
 			OwnerReferences: []metav1.OwnerReference{
 				{
 					APIVersion:         "v1",
@@ -253,80 +406,86 @@ func createBuilderJob(ctx context.Context, cfg Config, metadata *ChaincodeMetada
 					BlockOwnerDeletion: BoolRef(true),
 				},
 			},
-			Labels: map[string]string{
-				"externalcc-type": "builder",
-			},
+			Labels: labels,
 		},
-		Spec: apiv1.PodSpec{
-			InitContainers: []apiv1.Container{
-				// setup chaincode volume
-				{
-					Image:   initImage,
-					Name:    "setup-chaincode-volume",
-					Command: []string{"/bin/bash"},
-					Args: []string{
-						`-c`,
-						`mkdir -p /chaincode/input /chaincode/output && chmod 777 /chaincode/input /chaincode/output`,
-					},
-					VolumeMounts: mounts,
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            getBuilderBackoffLimit(cfg),
+			ActiveDeadlineSeconds:   getBuilderActiveDeadline(cfg),
+			TTLSecondsAfterFinished: cfg.Builder.Job.TTLSecondsAfterFinished,
+			Template: apiv1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: labels,
 				},
-				// download chaincode source
-				{
-					Image:   initImage,
-					Name:    "download-chaincode-source",
-					Command: []string{"/bin/bash"},
-					Args: []string{
-						"-c",
-						fmt.Sprintf(`curl -s -o- -L '%s/chaincode-source.tar' | tar -C /chaincode/input -xvf - && chmod -R 777 /chaincode/input`, basePathURL),
+				Spec: apiv1.PodSpec{
+					InitContainers: []apiv1.Container{
+						// setup chaincode volume
+						{
+							Image:   initImage,
+							Name:    "setup-chaincode-volume",
+							Command: []string{"/bin/bash"},
+							Args: []string{
+								`-c`,
+								`mkdir -p /chaincode/input /chaincode/output && chmod 777 /chaincode/input /chaincode/output`,
+							},
+							VolumeMounts: mounts,
+						},
+						// download chaincode source
+						{
+							Image:   initImage,
+							Name:    "download-chaincode-source",
+							Command: []string{"/bin/bash"},
+							Args: []string{
+								"-c",
+								fmt.Sprintf(`%s && tar -C /chaincode/input -xvf /chaincode/source.tar && rm /chaincode/source.tar && chmod -R 777 /chaincode/input`,
+									getDownloadScript(cfg, sourceURL, "/chaincode/source.tar", sourceDigest),
+								),
+							},
+							VolumeMounts: fileServerMounts,
+						},
+						// build container
+						{
+							Name:            "builder",
+							Image:           image,
+							ImagePullPolicy: apiv1.PullIfNotPresent,
+							Command: []string{
+								"/bin/sh",
+							},
+							Args: []string{
+								"-c", buildOpts.Cmd,
+							},
+							Env:          envvars,
+							Resources:    apiv1.ResourceRequirements{Limits: limits, Requests: requests},
+							VolumeMounts: mounts,
+						},
 					},
-					VolumeMounts: mounts,
-				},
-				// build container
-				{
-					Name:            "builder",
-					Image:           image,
-					ImagePullPolicy: apiv1.PullIfNotPresent,
-					Command: []string{
-						"/bin/sh",
-					},
-					Args: []string{
-						"-c", buildOpts.Cmd,
+					Containers: []apiv1.Container{
+						{
+							Name:            "upload-chaincode-output",
+							Image:           initImage,
+							ImagePullPolicy: apiv1.PullIfNotPresent,
+							VolumeMounts:    fileServerMounts,
+							Command:         []string{"/bin/bash"},
+							Args: []string{
+								"-c",
+								//"sleep 600000",
+								fmt.Sprintf(
+									`
+		cp -r ./chaincode/input/META-INF ./chaincode/output/ || echo "META-INF doesn't exist" &&
+		cd /chaincode/output &&
+		tar cvf /chaincode/output.tar $(ls -A) &&
+		%s`,
+									getUploadScript(cfg, "/chaincode/output.tar", outputURL, metadata.Label),
+								),
+							},
+						},
 					},
-					Env:          envvars,
-					Resources:    apiv1.ResourceRequirements{Limits: limits, Requests: requests},
-					VolumeMounts: mounts,
-				},
-			},
-			Containers: []apiv1.Container{
-				{
-					Name:            "upload-chaincode-output",
-					Image:           initImage,
-					ImagePullPolicy: apiv1.PullIfNotPresent,
-					VolumeMounts:    mounts,
-					Command:         []string{"/bin/bash"},
-					Args: []string{
-						"-c",
-						//"sleep 600000",
-						fmt.Sprintf(
-							`
-cp -r ./chaincode/input/META-INF ./chaincode/output/ || echo "META-INF doesn't exist" &&
-cd /chaincode/output &&
-tar cvf /chaincode/output.tar $(ls -A) &&
-curl -X POST -s --upload-file /chaincode/output.tar '%s/chaincode-output.tar'`,
-							basePathURL,
-						),
-					},
-				},
-			},
-			EnableServiceLinks: BoolRef(false),
-			RestartPolicy:      apiv1.RestartPolicyNever,
-			Volumes: []apiv1.Volume{
-				{
-					Name: "chaincode",
+					EnableServiceLinks: BoolRef(false),
+					RestartPolicy:      apiv1.RestartPolicyNever,
+					Volumes:            volumes,
 				},
 			},
 		},
 	}
 
-	return clientset.CoreV1().Pods(cfg.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+	return createOrReplaceJob(ctx, clientset, cfg.Namespace, job, jobDeletionPollPeriod)
 }
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactEnvironment(t *testing.T) {
+	environ := []string{
+		"CORE_PEER_ID=peer0",
+		"FILE_SERVER_SECRET=secret",
+		"REGISTRY_USERNAME=user",
+		"REGISTRY_PASSWORD=pa=ss",
+		"ADMIN_TOKEN=token",
+		"AWS_Secret_Access_Key=key",
+	}
+	assert.Equal(t, []string{
+		"CORE_PEER_ID=peer0",
+		"FILE_SERVER_SECRET=<redacted>",
+		"REGISTRY_USERNAME=user",
+		"REGISTRY_PASSWORD=<redacted>",
+		"ADMIN_TOKEN=<redacted>",
+		"AWS_Secret_Access_Key=<redacted>",
+	}, redactEnvironment(environ))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/kfsoftware/externalbuilder/cmd/internal/digest"
+	"github.com/pkg/errors"
+)
+
+// packageHashPattern matches the hash of the package ID at the start of the last part of the
+// build directory, Fabric names it fabric-<label>-<hash><random suffix>
+var packageHashPattern = regexp.MustCompile(`^[0-9a-f]{64}`)
+
+// getPackageHash returns the hash of the chaincode package ID from the build directory,
+// or an empty string if it can't be found
+func getPackageHash(sourceDir string) string {
+	folderName := filepath.Base(filepath.Dir(sourceDir))
+	chunks := strings.Split(folderName, "-")
+	return packageHashPattern.FindString(chunks[len(chunks)-1])
+}
+
+// getBuildCacheKey returns the key of the output of a build in the build cache. Peers installing
+// the same package, or uploading the same source, with the same builder image and platform
+// share the output. The key is a valid build ID on the file server.
+func getBuildCacheKey(packageHash string, sourceDigest string, image string, platform string) string {
+	input := packageHash
+	if input == "" {
+		input = "source:" + sourceDigest
+	}
+	h := sha256.New()
+	for _, part := range []string{input, image, strings.ToLower(platform)} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// lookupBuildCache returns the hex encoded SHA-256 of the cached output of a build, or an
+// empty string if there is none. Outputs without a digest are not used, as the chaincode
+// pods couldn't verify them.
+func lookupBuildCache(ctx context.Context, client *http.Client, outputURL string) (string, error) {
+	req, err := http.NewRequest(http.MethodHead, outputURL, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "creating request")
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", nil
+	case resp.StatusCode != http.StatusOK:
+		return "", errors.Errorf("Received %d code from server", resp.StatusCode)
+	case resp.Header.Get(digest.Header) == "":
+		return "", nil
+	}
+	return digest.ParseSHA256(resp.Header.Get(digest.Header))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kfsoftware/externalbuilder/cmd/internal/digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetPackageHash(t *testing.T) {
+	folder := "/tmp/fabric-ip-register-cc-ea2aaf81f5d991a883563c349e793ef0a642d577ceebb9a6778832c7fca23882425116466/src"
+	assert.Equal(t, "ea2aaf81f5d991a883563c349e793ef0a642d577ceebb9a6778832c7fca23882", getPackageHash(folder))
+	assert.Empty(t, getPackageHash("/tmp/fabric-mycc-1234/src"))
+}
+
+func TestGetBuildCacheKey(t *testing.T) {
+	packageHash := strings.Repeat("a", 64)
+	key := getBuildCacheKey(packageHash, "source", "hyperledger/fabric-ccenv:2.2.0", "golang")
+	assert.Len(t, key, 64)
+	assert.Equal(t, key, getBuildCacheKey(packageHash, "other source", "hyperledger/fabric-ccenv:2.2.0", "GOLANG"))
+	assert.NotEqual(t, key, getBuildCacheKey(packageHash, "source", "hyperledger/fabric-ccenv:2.3.0", "golang"))
+	assert.NotEqual(t, key, getBuildCacheKey(packageHash, "source", "hyperledger/fabric-ccenv:2.2.0", "node"))
+	assert.NotEqual(t, key, getBuildCacheKey("", "source", "hyperledger/fabric-ccenv:2.2.0", "golang"))
+	assert.NotEqual(t,
+		getBuildCacheKey("", "source", "hyperledger/fabric-ccenv:2.2.0", "golang"),
+		getBuildCacheKey("", "other source", "hyperledger/fabric-ccenv:2.2.0", "golang"),
+	)
+}
+
+func TestLookupBuildCache(t *testing.T) {
+	sha := strings.Repeat("ab", 32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodHead, r.Method)
+		switch r.URL.Path {
+		case "/hit/chaincode-output.tar":
+			value, _ := digest.FormatSHA256(sha)
+			w.Header().Set(digest.Header, value)
+		case "/nodigest/chaincode-output.tar":
+		case "/error/chaincode-output.tar":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	got, err := lookupBuildCache(ctx, server.Client(), server.URL+"/hit/chaincode-output.tar")
+	require.NoError(t, err)
+	assert.Equal(t, sha, got)
+
+	got, err = lookupBuildCache(ctx, server.Client(), server.URL+"/miss/chaincode-output.tar")
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	got, err = lookupBuildCache(ctx, server.Client(), server.URL+"/nodigest/chaincode-output.tar")
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	_, err = lookupBuildCache(ctx, server.Client(), server.URL+"/error/chaincode-output.tar")
+	assert.Error(t, err)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	cpy "github.com/otiai10/copy"
+	"github.com/pkg/errors"
+)
+
+const connectionFile = "connection.json"
+
+// chaincodeServerTypes are the package types of chaincodes running as a service, the peer
+// dials the chaincode server described by connection.json instead of launching it
+var chaincodeServerTypes = map[string]bool{
+	"ccaas":    true,
+	"external": true,
+}
+
+// isChaincodeServer returns whether packages of ccType run as a chaincode server
+func isChaincodeServer(ccType string) bool {
+	return chaincodeServerTypes[strings.ToLower(ccType)]
+}
+
+// ChaincodeServerConnection is based on
+// https://github.com/hyperledger/fabric/blob/v2.4.1/core/container/externalbuilder/instance.go#L30
+type ChaincodeServerConnection struct {
+	Address            string `json:"address"`
+	DialTimeout        string `json:"dial_timeout"`
+	TLSRequired        bool   `json:"tls_required"`
+	ClientAuthRequired bool   `json:"client_auth_required"`
+	ClientKey          string `json:"client_key"`  // PEM encoded client key
+	ClientCert         string `json:"client_cert"` // PEM encoded client certificate
+	RootCert           string `json:"root_cert"`   // PEM encoded chaincode server CA
+}
+
+// Validate checks that the peer can dial the chaincode server with the connection
+func (c *ChaincodeServerConnection) Validate() error {
+	if c.Address == "" {
+		return errors.New("chaincode server address is required")
+	}
+	if c.DialTimeout != "" {
+		if _, err := time.ParseDuration(c.DialTimeout); err != nil {
+			return errors.Wrapf(err, "invalid dial_timeout %q", c.DialTimeout)
+		}
+	}
+	if !c.TLSRequired {
+		return nil
+	}
+	if c.RootCert == "" {
+		return errors.New("root_cert is required with tls_required")
+	}
+	if c.ClientAuthRequired && (c.ClientKey == "" || c.ClientCert == "") {
+		return errors.New("client_key and client_cert are required with client_auth_required")
+	}
+	return nil
+}
+
+// readConnection reads and validates the connection.json in dir
+func readConnection(dir string) (*ChaincodeServerConnection, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, connectionFile))
+	if err != nil {
+		return nil, errors.Wrap(err, "Reading connection.json")
+	}
+	connection := ChaincodeServerConnection{}
+	err = json.Unmarshal(data, &connection)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unmarshaling connection.json")
+	}
+	if err := connection.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating connection.json")
+	}
+	return &connection, nil
+}
+
+// buildChaincodeServer copies connection.json and META-INF of a chaincode server package
+// from the source to the output dir, there's nothing to compile
+func buildChaincodeServer(sourceDir string, outputDir string) error {
+	connection, err := readConnection(sourceDir)
+	if err != nil {
+		return err
+	}
+	log.Printf("Chaincode server at %s", connection.Address)
+
+	err = cpy.Copy(filepath.Join(sourceDir, connectionFile), filepath.Join(outputDir, connectionFile))
+	if err != nil {
+		return errors.Wrap(err, "copy connection.json to output dir")
+	}
+	// Copy META-INF like other builds, so release finds the statedb indexes
+	transferSrcMeta := filepath.Join(sourceDir, "META-INF")
+	if _, err := os.Stat(transferSrcMeta); !os.IsNotExist(err) {
+		err = cpy.Copy(transferSrcMeta, outputDir)
+		if err != nil {
+			return errors.Wrap(err, "copy META-INF to output dir")
+		}
+	}
+	return nil
+}
+
+// releaseChaincodeServer copies connection.json from the build dir to chaincode/server
+// in the release dir, if the build is a chaincode server. The peer then dials it
+// instead of calling run.
+func releaseChaincodeServer(buildDir string, releaseDir string) error {
+	src := filepath.Join(buildDir, connectionFile)
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return nil
+	}
+	err := cpy.Copy(src, filepath.Join(releaseDir, "chaincode", "server", connectionFile))
+	return errors.Wrap(err, "copy connection.json to release dir")
+}
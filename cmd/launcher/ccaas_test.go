@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsChaincodeServer(t *testing.T) {
+	assert.True(t, isChaincodeServer("ccaas"))
+	assert.True(t, isChaincodeServer("External"))
+	assert.False(t, isChaincodeServer("golang"))
+}
+
+func TestChaincodeServerConnectionValidate(t *testing.T) {
+	assert.NoError(t, (&ChaincodeServerConnection{Address: "mycc:7052", DialTimeout: "10s"}).Validate())
+	assert.Error(t, (&ChaincodeServerConnection{}).Validate())
+	assert.Error(t, (&ChaincodeServerConnection{Address: "mycc:7052", DialTimeout: "10"}).Validate())
+	assert.Error(t, (&ChaincodeServerConnection{Address: "mycc:7052", TLSRequired: true}).Validate())
+	assert.NoError(t, (&ChaincodeServerConnection{Address: "mycc:7052", TLSRequired: true, RootCert: "ca"}).Validate())
+	assert.Error(t, (&ChaincodeServerConnection{Address: "mycc:7052", TLSRequired: true, ClientAuthRequired: true, RootCert: "ca"}).Validate())
+}
+
+func TestBuildAndReleaseChaincodeServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ccaas")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	sourceDir := filepath.Join(dir, "src")
+	outputDir := filepath.Join(dir, "bld")
+	releaseDir := filepath.Join(dir, "release")
+	for _, d := range []string{filepath.Join(sourceDir, "META-INF", "statedb"), outputDir, releaseDir} {
+		require.NoError(t, os.MkdirAll(d, 0755))
+	}
+	connection := `{"address": "mycc:7052", "dial_timeout": "10s", "tls_required": false}`
+	require.NoError(t, ioutil.WriteFile(filepath.Join(sourceDir, connectionFile), []byte(connection), 0644))
+
+	require.NoError(t, buildChaincodeServer(sourceDir, outputDir))
+	assert.FileExists(t, filepath.Join(outputDir, connectionFile))
+	assert.DirExists(t, filepath.Join(outputDir, "statedb"))
+
+	require.NoError(t, releaseChaincodeServer(outputDir, releaseDir))
+	data, err := ioutil.ReadFile(filepath.Join(releaseDir, "chaincode", "server", connectionFile))
+	require.NoError(t, err)
+	assert.JSONEq(t, connection, string(data))
+
+	// Other builds have no connection.json to release
+	otherReleaseDir := filepath.Join(dir, "other")
+	require.NoError(t, releaseChaincodeServer(sourceDir+"-missing", otherReleaseDir))
+	assert.NoFileExists(t, filepath.Join(otherReleaseDir, "chaincode", "server", connectionFile))
+
+	// connection.json is required
+	require.NoError(t, os.Remove(filepath.Join(sourceDir, connectionFile)))
+	assert.Error(t, buildChaincodeServer(sourceDir, outputDir))
+}
@@ -25,6 +25,11 @@ func Detect(ctx context.Context, cfg Config) error {
 		return errors.Wrap(err, "getting metadata for chaincode")
 	}
 
+	// Chaincode servers are not built nor launched, the peer dials them
+	if isChaincodeServer(metadata.Type) {
+		return nil
+	}
+
 	// Check if there is a valid image configured
 	_, ok := cfg.Images[strings.ToLower(metadata.Type)]
 	if !ok {
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kfsoftware/externalbuilder/cmd/internal/compression"
+	"github.com/kfsoftware/externalbuilder/cmd/internal/digest"
+	"github.com/kfsoftware/externalbuilder/cmd/internal/signedurl"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+const (
+	defaultURLExpiry    = 2 * time.Hour
+	defaultRunURLExpiry = 7 * 24 * time.Hour
+
+	// chaincodeLabelHeader tells the file server the label of the chaincode an artifact belongs to
+	chaincodeLabelHeader = "X-Chaincode-Label"
+
+	fileServerTLSVolume = "fileserver-tls"
+	fileServerTLSDir    = "/fileserver-tls"
+)
+
+// getFileServerURL returns the base URL of the artifacts of a tenant on the file server,
+// or of the shared ones if tenant is empty
+func getFileServerURL(cfg Config, tenant string) string {
+	scheme := "http"
+	if cfg.FileServer.TLS.Enabled {
+		scheme = "https"
+	}
+	fileServerIP := os.Getenv("FILE_SERVER_BASE_IP")
+	fileServerURL := fmt.Sprintf("%s://%s:8080", scheme, fileServerIP)
+	if tenant != "" {
+		fileServerURL += "/tenants/" + url.PathEscape(tenant)
+	}
+	log.Printf("File Server URL=%s", fileServerURL)
+	return fileServerURL
+}
+
+// getArtifactURL returns the URL of an artifact of a build on the file server.
+// If FILE_SERVER_SECRET is set, the URL is signed for the given operation.
+func getArtifactURL(cfg Config, buildID string, artifact string, op signedurl.Operation) string {
+	expiry := cfg.FileServer.URLExpiry
+	if expiry <= 0 {
+		expiry = defaultURLExpiry
+	}
+	return signArtifactURL(cfg, buildID, artifact, op, expiry)
+}
+
+// getRunArtifactURL returns the URL of an artifact for the chaincode pods, which may download
+// it again long after they were created
+func getRunArtifactURL(cfg Config, buildID string, artifact string) string {
+	expiry := cfg.FileServer.RunURLExpiry
+	if expiry <= 0 {
+		expiry = defaultRunURLExpiry
+	}
+	return signArtifactURL(cfg, buildID, artifact, signedurl.Read, expiry)
+}
+
+func signArtifactURL(cfg Config, buildID string, artifact string, op signedurl.Operation, expiry time.Duration) string {
+	artifactURL := fmt.Sprintf("%s/%s/%s", getFileServerURL(cfg, cfg.FileServer.Tenant), buildID, artifact)
+	secret := os.Getenv("FILE_SERVER_SECRET")
+	if secret == "" {
+		return artifactURL
+	}
+
+	q := signedurl.Sign([]byte(secret), buildID, op, time.Now().Add(expiry))
+	return fmt.Sprintf("%s?%s", artifactURL, q.Encode())
+}
+
+// getFileServerClient returns the HTTP client used by the launcher to talk to the file server
+func getFileServerClient(cfg Config) (*http.Client, error) {
+	tlsCfg := cfg.FileServer.TLS
+	if !tlsCfg.Enabled {
+		return http.DefaultClient, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if tlsCfg.CAFile != "" {
+		caData, err := ioutil.ReadFile(tlsCfg.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading file server CA file")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, errors.Errorf("no certificates found in %s", tlsCfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if tlsCfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCfg.CertFile, tlsCfg.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "loading file server client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// getCurlTLSFlags returns the curl flags used by the init containers to reach the file server
+func getCurlTLSFlags(cfg Config) string {
+	tlsCfg := cfg.FileServer.TLS
+	if !tlsCfg.Enabled || tlsCfg.SecretName == "" {
+		return ""
+	}
+
+	flags := []string{fmt.Sprintf("--cacert %s/ca.crt", fileServerTLSDir)}
+	if tlsCfg.CertFile != "" {
+		flags = append(flags,
+			fmt.Sprintf("--cert %s/tls.crt", fileServerTLSDir),
+			fmt.Sprintf("--key %s/tls.key", fileServerTLSDir),
+		)
+	}
+	return strings.Join(flags, " ")
+}
+
+// getFileServerTLSVolume returns the volume and mount with the file server TLS material
+// for the builder and chaincode pods, or nil if it's not configured
+func getFileServerTLSVolume(cfg Config) (*apiv1.Volume, *apiv1.VolumeMount) {
+	tlsCfg := cfg.FileServer.TLS
+	if !tlsCfg.Enabled || tlsCfg.SecretName == "" {
+		return nil, nil
+	}
+
+	volume := &apiv1.Volume{
+		Name: fileServerTLSVolume,
+		VolumeSource: apiv1.VolumeSource{
+			Secret: &apiv1.SecretVolumeSource{
+				SecretName: tlsCfg.SecretName,
+			},
+		},
+	}
+	mount := &apiv1.VolumeMount{
+		Name:      fileServerTLSVolume,
+		MountPath: fileServerTLSDir,
+		ReadOnly:  true,
+	}
+	return volume, mount
+}
+
+// getUploadHeader returns the headers sent along with the upload of an artifact
+// compressed with encoding
+func getUploadHeader(label string, sha256 string, encoding string) (http.Header, error) {
+	header := http.Header{}
+	if label != "" {
+		header.Set(chaincodeLabelHeader, label)
+	}
+	if encoding != compression.None {
+		header.Set("Content-Encoding", encoding)
+	}
+	value, err := digest.FormatSHA256(sha256)
+	if err != nil {
+		return nil, err
+	}
+	header.Set(digest.Header, value)
+	return header, nil
+}
+
+var (
+	compressionExtensions = map[string]string{
+		compression.Gzip: ".gz",
+		compression.Zstd: ".zst",
+	}
+	// decompressCommands decompress stdin to stdout in the builder and chaincode pods
+	decompressCommands = map[string]string{
+		compression.Gzip: "gzip -dc",
+		compression.Zstd: "zstd -dcq",
+	}
+)
+
+// validateCompression normalizes the compression settings of the configuration
+func validateCompression(cfg *Config) error {
+	encoding, err := compression.Parse(cfg.FileServer.Compression.Algorithm)
+	if err != nil {
+		return err
+	}
+	cfg.FileServer.Compression.Algorithm = encoding
+	return compression.ValidateLevel(encoding, cfg.FileServer.Compression.Level)
+}
+
+// getCompressCommand returns the command compressing stdin to stdout in the builder pods
+func getCompressCommand(cfg Config) string {
+	level := ""
+	if l := cfg.FileServer.Compression.Level; l > 0 {
+		level = fmt.Sprintf(" -%d", l)
+	}
+	switch cfg.FileServer.Compression.Algorithm {
+	case compression.Gzip:
+		return "gzip -c" + level
+	case compression.Zstd:
+		return "zstd -cq" + level
+	default:
+		return "cat"
+	}
+}
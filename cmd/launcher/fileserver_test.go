@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kfsoftware/externalbuilder/cmd/internal/signedurl"
+	"github.com/kfsoftware/externalbuilder/cmd/internal/testcert"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetRunArtifactURL(t *testing.T) {
+	secret := "secret"
+	previous, ok := os.LookupEnv("FILE_SERVER_SECRET")
+	os.Setenv("FILE_SERVER_SECRET", secret)
+	defer func() {
+		if ok {
+			os.Setenv("FILE_SERVER_SECRET", previous)
+		} else {
+			os.Unsetenv("FILE_SERVER_SECRET")
+		}
+	}()
+	cfg := Config{}
+	verify := func(artifactURL string, now time.Time) error {
+		u, err := url.Parse(artifactURL)
+		require.NoError(t, err)
+		return signedurl.Verify([]byte(secret), "build", signedurl.Read, u.Query(), now)
+	}
+
+	// The chaincode pods can download the output long after the builder URLs expired
+	later := time.Now().Add(defaultURLExpiry + time.Hour)
+	assert.Error(t, verify(getArtifactURL(cfg, "build", "chaincode-output.tar", signedurl.Read), later))
+	assert.NoError(t, verify(getRunArtifactURL(cfg, "build", "chaincode-output.tar"), later))
+	assert.Error(t, verify(getRunArtifactURL(cfg, "build", "chaincode-output.tar"), time.Now().Add(defaultRunURLExpiry+time.Hour)))
+
+	cfg.FileServer.RunURLExpiry = time.Minute
+	assert.Error(t, verify(getRunArtifactURL(cfg, "build", "chaincode-output.tar"), later))
+}
+
+func TestGetFileServerClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	files, err := testcert.Generate(dir)
+	require.NoError(t, err)
+
+	// A file server requiring client certificates of the CA
+	serverCert, err := tls.LoadX509KeyPair(files.ServerCert, files.ServerKey)
+	require.NoError(t, err)
+	caData, err := ioutil.ReadFile(files.CA)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	require.True(t, pool.AppendCertsFromPEM(caData))
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(cfg Config) error {
+		client, err := getFileServerClient(cfg)
+		require.NoError(t, err)
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		return nil
+	}
+
+	cfg := Config{}
+	cfg.FileServer.TLS.Enabled = true
+	cfg.FileServer.TLS.CAFile = files.CA
+	cfg.FileServer.TLS.CertFile = files.ClientCert
+	cfg.FileServer.TLS.KeyFile = files.ClientKey
+	assert.NoError(t, get(cfg))
+
+	// The file server rejects the launcher without a client certificate
+	noCert := cfg
+	noCert.FileServer.TLS.CertFile = ""
+	noCert.FileServer.TLS.KeyFile = ""
+	assert.Error(t, get(noCert))
+
+	// The launcher rejects a file server it can't verify
+	noCA := cfg
+	noCA.FileServer.TLS.CAFile = ""
+	assert.Error(t, get(noCA))
+
+	invalidCA := filepath.Join(dir, "invalid.crt")
+	require.NoError(t, ioutil.WriteFile(invalidCA, []byte("not a certificate"), 0600))
+	for _, caFile := range []string{invalidCA, filepath.Join(dir, "none.crt")} {
+		invalid := cfg
+		invalid.FileServer.TLS.CAFile = caFile
+		_, err = getFileServerClient(invalid)
+		assert.Error(t, err, caFile)
+	}
+	invalid := cfg
+	invalid.FileServer.TLS.KeyFile = files.ServerKey
+	_, err = getFileServerClient(invalid)
+	assert.Error(t, err)
+}
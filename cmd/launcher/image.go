@@ -0,0 +1,295 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/kfsoftware/externalbuilder/cmd/internal/signedurl"
+	"github.com/pkg/errors"
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// imageLayer is a gzipped layer of an image, stored in a temporary file
+type imageLayer struct {
+	File *os.File
+	Size int64
+	// Digest is the SHA-256 of the gzipped layer, DiffID the one of the uncompressed tar
+	Digest string
+	DiffID string
+}
+
+// Reader returns a reader of the gzipped layer
+func (l *imageLayer) Reader() *io.SectionReader {
+	return io.NewSectionReader(l.File, 0, l.Size)
+}
+
+// Close removes the temporary file of the layer
+func (l *imageLayer) Close() error {
+	l.File.Close()
+	return os.Remove(l.File.Name())
+}
+
+// buildChaincodeLayer returns a layer with the files of the output tar under mountDir,
+// where the chaincode pods find the build output. The layer is written to a temporary file
+// while its digests are computed, the caller must close it.
+func buildChaincodeLayer(output io.Reader, mountDir string) (*imageLayer, error) {
+	f, err := ioutil.TempFile("", "chaincode-layer-")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating layer file")
+	}
+	layer := &imageLayer{File: f}
+	err = writeChaincodeLayer(layer, output, mountDir)
+	if err != nil {
+		layer.Close()
+		return nil, err
+	}
+	return layer, nil
+}
+
+func writeChaincodeLayer(layer *imageLayer, output io.Reader, mountDir string) error {
+	digest := sha256.New()
+	counter := &countingWriter{}
+	gw := gzip.NewWriter(io.MultiWriter(layer.File, digest, counter))
+	diffID := sha256.New()
+	tw := tar.NewWriter(io.MultiWriter(gw, diffID))
+
+	// Parent directories of the mount dir
+	prefix := strings.Trim(mountDir, "/")
+	dir := ""
+	for _, part := range strings.Split(prefix, "/") {
+		dir = path.Join(dir, part)
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     dir + "/",
+			Mode:     0755,
+			ModTime:  time.Unix(0, 0),
+		})
+		if err != nil {
+			return errors.Wrap(err, "writing layer")
+		}
+	}
+
+	tr := tar.NewReader(output)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "reading chaincode output")
+		}
+		name := path.Clean(header.Name)
+		if name == "." || strings.HasPrefix(name, "../") || path.IsAbs(name) {
+			continue
+		}
+		header.Name = path.Join(prefix, name)
+		if header.Typeflag == tar.TypeDir {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return errors.Wrap(err, "writing layer")
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return errors.Wrap(err, "writing layer")
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return errors.Wrap(err, "writing layer")
+	}
+	if err := gw.Close(); err != nil {
+		return errors.Wrap(err, "compressing layer")
+	}
+	layer.Size = counter.n
+	layer.Digest = "sha256:" + hex.EncodeToString(digest.Sum(nil))
+	layer.DiffID = "sha256:" + hex.EncodeToString(diffID.Sum(nil))
+	return nil
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// pushChaincodeImage pushes an image made of base and layer to target, and returns the
+// digest of its manifest. workingDir becomes the working directory of the image.
+func pushChaincodeImage(ctx context.Context, registry *registryClient, base imageReference, target imageReference, layer *imageLayer, workingDir string) (string, error) {
+	manifest, err := registry.getManifest(ctx, base)
+	if err != nil {
+		return "", err
+	}
+
+	// Add the layer to the configuration of the base image, keeping the fields we don't know
+	configData, err := registry.getBlob(ctx, base, manifest.Config.Digest)
+	if err != nil {
+		return "", err
+	}
+	config := map[string]interface{}{}
+	err = json.NewDecoder(configData).Decode(&config)
+	configData.Close()
+	if err != nil {
+		return "", errors.Wrapf(err, "decoding configuration of %s", base)
+	}
+	rootfs, _ := config["rootfs"].(map[string]interface{})
+	if rootfs == nil {
+		return "", errors.Errorf("no rootfs in configuration of %s", base)
+	}
+	diffIDs, _ := rootfs["diff_ids"].([]interface{})
+	rootfs["diff_ids"] = append(diffIDs, layer.DiffID)
+	history, _ := config["history"].([]interface{})
+	config["history"] = append(history, map[string]interface{}{
+		"created":    time.Now().UTC().Format(time.RFC3339),
+		"created_by": "externalbuilder: chaincode build output",
+	})
+	containerConfig, _ := config["config"].(map[string]interface{})
+	if containerConfig == nil {
+		containerConfig = map[string]interface{}{}
+		config["config"] = containerConfig
+	}
+	containerConfig["WorkingDir"] = workingDir
+	newConfig, err := json.Marshal(config)
+	if err != nil {
+		return "", errors.Wrap(err, "marshaling image configuration")
+	}
+	configSum := sha256.Sum256(newConfig)
+	manifest.Config.Digest = "sha256:" + hex.EncodeToString(configSum[:])
+	manifest.Config.Size = int64(len(newConfig))
+
+	// Copy the layers of the base image, then add ours
+	for _, baseLayer := range manifest.Layers {
+		if err := registry.copyBlob(ctx, base, target, baseLayer); err != nil {
+			return "", err
+		}
+	}
+	layerMediaType := mediaTypeOCILayer
+	if manifest.MediaType == mediaTypeDockerManifest {
+		layerMediaType = mediaTypeDockerLayer
+	}
+	manifest.Layers = append(manifest.Layers, registryDescriptor{
+		MediaType: layerMediaType,
+		Digest:    layer.Digest,
+		Size:      layer.Size,
+	})
+	if exists, err := registry.hasBlob(ctx, target, layer.Digest); err != nil {
+		return "", err
+	} else if !exists {
+		if err := registry.putBlob(ctx, target, layer.Digest, layer.Reader(), layer.Size); err != nil {
+			return "", err
+		}
+	}
+	if err := registry.putBlob(ctx, target, manifest.Config.Digest, bytes.NewReader(newConfig), int64(len(newConfig))); err != nil {
+		return "", err
+	}
+
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return "", errors.Wrap(err, "marshaling image manifest")
+	}
+	if err := registry.putManifest(ctx, target, manifest.MediaType, manifestData); err != nil {
+		return "", err
+	}
+	manifestSum := sha256.Sum256(manifestData)
+	return "sha256:" + hex.EncodeToString(manifestSum[:]), nil
+}
+
+// getImagePullSecrets returns the secrets of the chaincode pods to pull the chaincode images
+func getImagePullSecrets(cfg Config) []apiv1.LocalObjectReference {
+	if !cfg.OCI.Enabled || cfg.OCI.PullSecret == "" {
+		return nil
+	}
+	return []apiv1.LocalObjectReference{{Name: cfg.OCI.PullSecret}}
+}
+
+// getRegistryClient returns the client pushing the chaincode images, with the credentials of
+// REGISTRY_USERNAME and REGISTRY_PASSWORD for the registry of repository
+func getRegistryClient(cfg Config, repository imageReference) *registryClient {
+	return newRegistryClient(
+		http.DefaultClient,
+		cfg.OCI.Insecure,
+		repository.Registry,
+		os.Getenv("REGISTRY_USERNAME"),
+		os.Getenv("REGISTRY_PASSWORD"),
+	)
+}
+
+// buildChaincodeImage adds the build output of outputBuildID to the runtime base image of the
+// platform and pushes it to the configured repository, tagged with the build ID. It returns the
+// image referenced by digest. An image pushed before for the build ID is reused.
+func buildChaincodeImage(ctx context.Context, cfg Config, client *http.Client, outputBuildID string, outputDigest string, builderImage string, platform string) (string, error) {
+	target, err := parseImageReference(cfg.OCI.Repository)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing image repository")
+	}
+	target.Reference = outputBuildID
+	registry := getRegistryClient(cfg, target)
+
+	if digest, err := registry.headManifest(ctx, target); err != nil {
+		return "", err
+	} else if digest != "" {
+		log.Printf("Chaincode image %s exists already", target)
+		target.Reference = digest
+		return target.String(), nil
+	}
+
+	baseImage := cfg.OCI.BaseImages[strings.ToLower(platform)]
+	if baseImage == "" {
+		baseImage = builderImage
+	}
+	base, err := parseImageReference(baseImage)
+	if err != nil {
+		return "", errors.Wrap(err, "parsing base image")
+	}
+
+	// Download the build output decompressed, and verify it against the digest of the build
+	req, err := http.NewRequest(http.MethodGet, getArtifactURL(cfg, outputBuildID, "chaincode-output.tar", signedurl.Read), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "creating request")
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.Wrap(err, "downloading chaincode output")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("Received %d code from server", resp.StatusCode)
+	}
+	hash := sha256.New()
+	layer, err := buildChaincodeLayer(io.TeeReader(resp.Body, hash), GetCCMountDir(platform))
+	if err != nil {
+		return "", err
+	}
+	defer layer.Close()
+	// Consume the end of the tar, so the digest covers the whole file
+	if _, err := io.Copy(hash, resp.Body); err != nil {
+		return "", errors.Wrap(err, "downloading chaincode output")
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != outputDigest {
+		return "", errors.Errorf("digest mismatch: chaincode output has sha256 %s, expected %s", got, outputDigest)
+	}
+
+	log.Printf("Pushing chaincode image %s based on %s", target, base)
+	digest, err := pushChaincodeImage(ctx, registry, base, target, layer, GetCCMountDir(platform))
+	if err != nil {
+		return "", errors.Wrap(err, "pushing chaincode image")
+	}
+	target.Reference = digest
+	return target.String(), nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRegistry is an in-process stand-in for a registry implementing the parts of the
+// Docker Registry HTTP API V2 used by the launcher, behind basic authentication
+type testRegistry struct {
+	username string
+	password string
+
+	mutex     sync.Mutex
+	blobs     map[string][]byte // by repository and digest
+	manifests map[string][]byte // by repository and reference
+	types     map[string]string // media type of the manifests
+	uploads   int
+}
+
+func newTestRegistry() *testRegistry {
+	return &testRegistry{
+		username:  "user",
+		password:  "secret",
+		blobs:     map[string][]byte{},
+		manifests: map[string][]byte{},
+		types:     map[string]string{},
+	}
+}
+
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (r *testRegistry) addBlob(repository string, data []byte) string {
+	digest := sha256Digest(data)
+	r.blobs[repository+"@"+digest] = data
+	return digest
+}
+
+func (r *testRegistry) addManifest(repository string, reference string, mediaType string, data []byte) {
+	for _, ref := range []string{reference, sha256Digest(data)} {
+		r.manifests[repository+"@"+ref] = data
+		r.types[repository+"@"+ref] = mediaType
+	}
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if username, password, ok := req.BasicAuth(); !ok || username != r.username || password != r.password {
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case strings.Contains(path, "/blobs/uploads/"):
+		i := strings.Index(path, "/blobs/uploads/")
+		repository := path[:i]
+		if req.Method == http.MethodPost {
+			r.uploads++
+			w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%d", repository, r.uploads))
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		data, _ := ioutil.ReadAll(req.Body)
+		digest := req.URL.Query().Get("digest")
+		if sha256Digest(data) != digest {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.blobs[repository+"@"+digest] = data
+		w.WriteHeader(http.StatusCreated)
+	case strings.Contains(path, "/blobs/"):
+		i := strings.Index(path, "/blobs/")
+		data, ok := r.blobs[path[:i]+"@"+path[i+len("/blobs/"):]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case strings.Contains(path, "/manifests/"):
+		i := strings.Index(path, "/manifests/")
+		key := path[:i] + "@" + path[i+len("/manifests/"):]
+		if req.Method == http.MethodPut {
+			data, _ := ioutil.ReadAll(req.Body)
+			r.addManifest(path[:i], path[i+len("/manifests/"):], req.Header.Get("Content-Type"), data)
+			w.Header().Set(contentDigestHeader, sha256Digest(data))
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		data, ok := r.manifests[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", r.types[key])
+		w.Header().Set(contentDigestHeader, sha256Digest(data))
+		w.Write(data)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestParseImageReference(t *testing.T) {
+	ref, err := parseImageReference("hyperledger/fabric-ccenv:2.2.0")
+	require.NoError(t, err)
+	assert.Equal(t, imageReference{Registry: dockerHubRegistry, Repository: "hyperledger/fabric-ccenv", Reference: "2.2.0"}, ref)
+
+	ref, err = parseImageReference("alpine")
+	require.NoError(t, err)
+	assert.Equal(t, imageReference{Registry: dockerHubRegistry, Repository: "library/alpine", Reference: "latest"}, ref)
+
+	ref, err = parseImageReference("localhost:5000/fabric/chaincode@sha256:abcd")
+	require.NoError(t, err)
+	assert.Equal(t, imageReference{Registry: "localhost:5000", Repository: "fabric/chaincode", Reference: "sha256:abcd"}, ref)
+	assert.Equal(t, "localhost:5000/fabric/chaincode@sha256:abcd", ref.String())
+
+	_, err = parseImageReference("registry.example.com/")
+	assert.Error(t, err)
+}
+
+func TestBuildChaincodeLayer(t *testing.T) {
+	var output bytes.Buffer
+	tw := tar.NewWriter(&output)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "META-INF/", Typeflag: tar.TypeDir, Mode: 0755}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "./chaincode", Mode: 0755, Size: 4}))
+	_, err := tw.Write([]byte("ELF!"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	layer, err := buildChaincodeLayer(bytes.NewReader(output.Bytes()), "/usr/local/bin")
+	require.NoError(t, err)
+	data := readLayer(t, layer)
+	assert.EqualValues(t, len(data), layer.Size)
+	assert.Equal(t, sha256Digest(data), layer.Digest)
+
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	uncompressed, err := ioutil.ReadAll(gr)
+	require.NoError(t, err)
+	assert.Equal(t, sha256Digest(uncompressed), layer.DiffID)
+
+	names := []string{}
+	tr := tar.NewReader(bytes.NewReader(uncompressed))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, header.Name)
+	}
+	assert.Equal(t, []string{"usr/", "usr/local/", "usr/local/bin/", "usr/local/bin/META-INF/", "usr/local/bin/chaincode"}, names)
+
+	// Closing the layer removes its file
+	require.NoError(t, layer.Close())
+	_, err = os.Stat(layer.File.Name())
+	assert.True(t, os.IsNotExist(err))
+}
+
+// readLayer returns the gzipped content of a layer
+func readLayer(t *testing.T, layer *imageLayer) []byte {
+	data, err := ioutil.ReadAll(layer.Reader())
+	require.NoError(t, err)
+	return data
+}
+
+// newTestLayer returns a layer holding data, removed when the test ends
+func newTestLayer(t *testing.T, data []byte) *imageLayer {
+	f, err := ioutil.TempFile("", "chaincode-layer-")
+	require.NoError(t, err)
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	layer := &imageLayer{File: f, Size: int64(len(data)), Digest: sha256Digest(data), DiffID: "sha256:chaincode"}
+	t.Cleanup(func() { layer.Close() })
+	return layer
+}
+
+func TestPushChaincodeImage(t *testing.T) {
+	testRegistry := newTestRegistry()
+	server := httptest.NewServer(testRegistry)
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	host := serverURL.Host
+
+	// Base image
+	baseLayer := testRegistry.addBlob("hyperledger/fabric-ccenv", []byte("base layer"))
+	baseConfig, err := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config":       map[string]interface{}{"Env": []string{"PATH=/usr/bin"}},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{"sha256:base"}},
+		"history":      []interface{}{map[string]interface{}{"created_by": "base"}},
+	})
+	require.NoError(t, err)
+	baseConfigDigest := testRegistry.addBlob("hyperledger/fabric-ccenv", baseConfig)
+	baseManifest, err := json.Marshal(registryManifest{
+		SchemaVersion: 2,
+		MediaType:     mediaTypeDockerManifest,
+		Config:        registryDescriptor{MediaType: "application/vnd.docker.container.image.v1+json", Digest: baseConfigDigest, Size: int64(len(baseConfig))},
+		Layers:        []registryDescriptor{{MediaType: mediaTypeDockerLayer, Digest: baseLayer, Size: 10}},
+	})
+	require.NoError(t, err)
+	testRegistry.addManifest("hyperledger/fabric-ccenv", "2.2.0", mediaTypeDockerManifest, baseManifest)
+
+	layer := newTestLayer(t, []byte("chaincode layer"))
+	base := imageReference{Registry: host, Repository: "hyperledger/fabric-ccenv", Reference: "2.2.0"}
+	target := imageReference{Registry: host, Repository: "fabric/chaincode", Reference: "buildid"}
+	ctx := context.Background()
+
+	// Without credentials the registry refuses the requests
+	_, err = pushChaincodeImage(ctx, newRegistryClient(server.Client(), true, host, "", ""), base, target, layer, "/usr/local/bin")
+	assert.Error(t, err)
+
+	registry := newRegistryClient(server.Client(), true, host, "user", "secret")
+	digest, err := registry.headManifest(ctx, target)
+	require.NoError(t, err)
+	assert.Empty(t, digest)
+
+	digest, err = pushChaincodeImage(ctx, registry, base, target, layer, "/usr/local/bin")
+	require.NoError(t, err)
+	head, err := registry.headManifest(ctx, target)
+	require.NoError(t, err)
+	assert.Equal(t, digest, head)
+
+	manifest, err := registry.getManifest(ctx, target)
+	require.NoError(t, err)
+	assert.Equal(t, mediaTypeDockerManifest, manifest.MediaType)
+	require.Len(t, manifest.Layers, 2)
+	assert.Equal(t, baseLayer, manifest.Layers[0].Digest)
+	assert.Equal(t, layer.Digest, manifest.Layers[1].Digest)
+	assert.Equal(t, mediaTypeDockerLayer, manifest.Layers[1].MediaType)
+	assert.Contains(t, testRegistry.blobs, "fabric/chaincode@"+baseLayer)
+	assert.Equal(t, []byte("chaincode layer"), testRegistry.blobs["fabric/chaincode@"+layer.Digest])
+
+	config := struct {
+		Config struct {
+			Env        []string
+			WorkingDir string
+		} `json:"config"`
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+		History []interface{} `json:"history"`
+	}{}
+	require.NoError(t, json.Unmarshal(testRegistry.blobs["fabric/chaincode@"+manifest.Config.Digest], &config))
+	assert.Equal(t, []string{"sha256:base", "sha256:chaincode"}, config.RootFS.DiffIDs)
+	assert.Equal(t, "/usr/local/bin", config.Config.WorkingDir)
+	assert.Equal(t, []string{"PATH=/usr/bin"}, config.Config.Env)
+	assert.Len(t, config.History, 2)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// defaultBuilderBackoffLimit is the number of retries of a failed builder pod
+	defaultBuilderBackoffLimit = 2
+	// keepUntilAnnotation holds the end of the retention of a failed builder Job
+	keepUntilAnnotation   = "externalcc/keep-until"
+	jobDeletionPollPeriod = time.Second
+)
+
+func getBuilderBackoffLimit(cfg Config) *int32 {
+	if cfg.Builder.Job.BackoffLimit != nil {
+		return cfg.Builder.Job.BackoffLimit
+	}
+	return Int32Ref(defaultBuilderBackoffLimit)
+}
+
+// getBuilderActiveDeadline returns the deadline of the builder Jobs, the build timeout
+// unless it's configured, so Jobs don't outlive the builds. It's unlimited without both.
+func getBuilderActiveDeadline(cfg Config) *int64 {
+	if cfg.Builder.Job.ActiveDeadlineSeconds != nil {
+		return cfg.Builder.Job.ActiveDeadlineSeconds
+	}
+	if cfg.Builder.Timeout > 0 {
+		return Int64Ref(int64((cfg.Builder.Timeout + time.Second - 1) / time.Second))
+	}
+	return nil
+}
+
+// getJobResult returns whether the Job finished and whether it succeeded
+func getJobResult(job *batchv1.Job) (bool, bool) {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != apiv1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			return true, true
+		case batchv1.JobFailed:
+			log.Printf("Job %s failed: %s %s", job.Name, condition.Reason, condition.Message)
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// watchJobUntilCompletion waits for the Job to complete or fail, and returns whether it
+// succeeded along with the pod whose logs tell how, if there's any
+func watchJobUntilCompletion(ctx context.Context, clientset kubernetes.Interface, job *batchv1.Job) (bool, *apiv1.Pod, error) {
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithNamespace(job.Namespace))
+	informer := factory.Batch().V1().Jobs().Informer()
+	res, err := watchUntilCompletion(ctx, informer, job.Name, func(obj interface{}) (bool, bool) {
+		j := obj.(*batchv1.Job)
+		log.Printf("Received update on job %s, active %d, succeeded %d, failed %d", j.Name, j.Status.Active, j.Status.Succeeded, j.Status.Failed)
+		return getJobResult(j)
+	})
+	if err != nil {
+		return false, nil, err
+	}
+
+	pod, err := getJobPod(ctx, clientset, job, res)
+	if err != nil {
+		log.Printf("Getting pod of job %s: %q", job.Name, err)
+	}
+	return res, pod, nil
+}
+
+// getJobPod returns the pod of the Job that succeeded, or the last one that failed.
+// It returns nil if the Job has no pods left.
+func getJobPod(ctx context.Context, clientset kubernetes.Interface, job *batchv1.Job, succeeded bool) (*apiv1.Pod, error) {
+	pods, err := clientset.CoreV1().Pods(job.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: "controller-uid=" + string(job.UID),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "listing job pods")
+	}
+
+	wanted := apiv1.PodFailed
+	if succeeded {
+		wanted = apiv1.PodSucceeded
+	}
+	var latest, latestWanted *apiv1.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if latest == nil || latest.CreationTimestamp.Before(&pod.CreationTimestamp) {
+			latest = pod
+		}
+		if pod.Status.Phase == wanted && (latestWanted == nil || latestWanted.CreationTimestamp.Before(&pod.CreationTimestamp)) {
+			latestWanted = pod
+		}
+	}
+	if latestWanted != nil {
+		return latestWanted, nil
+	}
+	return latest, nil
+}
+
+// waitForBuilderJob waits for the builder Job to complete or fail, passes the pod whose logs
+// tell how to logs, then cleans the Job up. Jobs whose watch ended before they finished, e.g.
+// because the build timed out or was cancelled, count as failed.
+func waitForBuilderJob(ctx context.Context, clientset kubernetes.Interface, cfg Config, job *batchv1.Job, logs func(context.Context, *apiv1.Pod) error) (bool, error) {
+	succeeded := false
+	// Clean up on every way out, including timeouts and cancellation
+	defer func() {
+		cleanupBuilderJob(clientset, cfg, job, !succeeded)
+	}()
+
+	succeeded, pod, err := watchJobUntilCompletion(ctx, clientset, job)
+	if err != nil {
+		return false, err
+	}
+	if pod != nil {
+		err = logs(ctx, pod)
+		if err != nil {
+			log.Printf("While streaming pod logs: %q", err)
+		}
+	}
+	return succeeded, nil
+}
+
+// createOrReplaceJob creates the Job, deleting a Job with the same name left by a previous
+// attempt first, e.g. a failed build kept for debugging
+func createOrReplaceJob(ctx context.Context, clientset kubernetes.Interface, namespace string, job *batchv1.Job, pollPeriod time.Duration) (*batchv1.Job, error) {
+	jobs := clientset.BatchV1().Jobs(namespace)
+	created, err := jobs.Create(ctx, job, metav1.CreateOptions{})
+	if !k8serrors.IsAlreadyExists(err) {
+		return created, err
+	}
+
+	log.Printf("Replacing job %s of a previous build", job.Name)
+	err = deleteJob(ctx, clientset, namespace, job.Name)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return nil, errors.Wrap(err, "deleting previous job")
+	}
+	err = wait.PollImmediateUntil(pollPeriod, func() (bool, error) {
+		_, err := jobs.Get(ctx, job.Name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}, ctx.Done())
+	if err != nil {
+		return nil, errors.Wrap(err, "waiting for deletion of previous job")
+	}
+	return jobs.Create(ctx, job, metav1.CreateOptions{})
+}
+
+// cleanupBuilderJob deletes the builder Job along with its pods. Failed Jobs are kept instead
+// if the configuration retains them for debugging.
+func cleanupBuilderJob(clientset kubernetes.Interface, cfg Config, job *batchv1.Job, failed bool) {
+	// The context of the build may be cancelled already
+	ctx := context.Background()
+	if failed && cfg.Builder.KeepFailed > 0 {
+		keepUntil := time.Now().Add(cfg.Builder.KeepFailed)
+		err := keepJob(ctx, clientset, job, keepUntil)
+		if err == nil {
+			log.Printf("Keeping failed job %s until %s", job.Name, keepUntil.Format(time.RFC3339))
+			return
+		}
+		log.Printf("Keeping failed job %s: %q", job.Name, err)
+	}
+	err := deleteJob(ctx, clientset, job.Namespace, job.Name)
+	if err != nil && !k8serrors.IsNotFound(err) {
+		log.Printf("Deleting job %s: %q", job.Name, err)
+	}
+}
+
+// keepJob annotates the Job with the time it can be deleted after. A Job still running,
+// because the build timed out or was cancelled, gets a deadline that's already over, so
+// Kubernetes fails it and stops its pods.
+func keepJob(ctx context.Context, clientset kubernetes.Interface, job *batchv1.Job, keepUntil time.Time) error {
+	jobs := clientset.BatchV1().Jobs(job.Namespace)
+	existing, err := jobs.Get(ctx, job.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if existing.Annotations == nil {
+		existing.Annotations = map[string]string{}
+	}
+	existing.Annotations[keepUntilAnnotation] = keepUntil.UTC().Format(time.RFC3339)
+	if done, _ := getJobResult(existing); !done {
+		log.Printf("Stopping job %s", job.Name)
+		existing.Spec.ActiveDeadlineSeconds = Int64Ref(1)
+	}
+	_, err = jobs.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+// deleteExpiredJobs deletes the failed builder Jobs of all peers of the namespace whose
+// retention ended
+func deleteExpiredJobs(ctx context.Context, clientset kubernetes.Interface, namespace string, now time.Time) error {
+	jobs, err := clientset.BatchV1().Jobs(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: "externalcc-type=builder",
+	})
+	if err != nil {
+		return errors.Wrap(err, "listing builder jobs")
+	}
+	for _, job := range jobs.Items {
+		value, ok := job.Annotations[keepUntilAnnotation]
+		if !ok {
+			continue
+		}
+		keepUntil, err := time.Parse(time.RFC3339, value)
+		if err == nil && now.Before(keepUntil) {
+			continue
+		}
+		log.Printf("Deleting failed job %s kept until %s", job.Name, value)
+		err = deleteJob(ctx, clientset, namespace, job.Name)
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return errors.Wrapf(err, "deleting job %s", job.Name)
+		}
+	}
+	return nil
+}
+
+// deleteJob deletes the Job along with its pods
+func deleteJob(ctx context.Context, clientset kubernetes.Interface, namespace string, name string) error {
+	propagation := metav1.DeletePropagationBackground
+	return clientset.BatchV1().Jobs(namespace).Delete(ctx, name, metav1.DeleteOptions{
+		PropagationPolicy: &propagation,
+	})
+}
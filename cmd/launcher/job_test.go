@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testJob(conditions ...batchv1.JobCondition) *batchv1.Job {
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "peer0-ccbuild-mycc",
+			Namespace: "default",
+			UID:       types.UID("job-uid"),
+		},
+		Status: batchv1.JobStatus{Conditions: conditions},
+	}
+}
+
+func testJobPod(name string, phase apiv1.PodPhase, created time.Time) *apiv1.Pod {
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         "default",
+			Labels:            map[string]string{"controller-uid": "job-uid"},
+			CreationTimestamp: metav1.NewTime(created),
+		},
+		Status: apiv1.PodStatus{Phase: phase},
+	}
+}
+
+func TestGetJobResult(t *testing.T) {
+	done, _ := getJobResult(testJob())
+	assert.False(t, done)
+
+	done, succeeded := getJobResult(testJob(batchv1.JobCondition{Type: batchv1.JobComplete, Status: apiv1.ConditionTrue}))
+	assert.True(t, done)
+	assert.True(t, succeeded)
+
+	done, succeeded = getJobResult(testJob(batchv1.JobCondition{Type: batchv1.JobFailed, Status: apiv1.ConditionTrue, Reason: "BackoffLimitExceeded"}))
+	assert.True(t, done)
+	assert.False(t, succeeded)
+
+	done, _ = getJobResult(testJob(batchv1.JobCondition{Type: batchv1.JobFailed, Status: apiv1.ConditionFalse}))
+	assert.False(t, done)
+}
+
+func TestGetJobPod(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	other := testJobPod("other", apiv1.PodFailed, now)
+	other.Labels["controller-uid"] = "other-uid"
+	clientset := fake.NewSimpleClientset(
+		testJobPod("first", apiv1.PodFailed, now.Add(-3*time.Minute)),
+		testJobPod("second", apiv1.PodFailed, now.Add(-2*time.Minute)),
+		testJobPod("third", apiv1.PodSucceeded, now.Add(-time.Minute)),
+		other,
+	)
+
+	pod, err := getJobPod(ctx, clientset, testJob(), true)
+	require.NoError(t, err)
+	assert.Equal(t, "third", pod.Name)
+
+	pod, err = getJobPod(ctx, clientset, testJob(), false)
+	require.NoError(t, err)
+	assert.Equal(t, "second", pod.Name)
+
+	pod, err = getJobPod(ctx, fake.NewSimpleClientset(), testJob(), false)
+	require.NoError(t, err)
+	assert.Nil(t, pod)
+}
+
+func TestWatchJobUntilCompletion(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	job := testJob()
+	clientset := fake.NewSimpleClientset(job, testJobPod("builder", apiv1.PodFailed, time.Now()))
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		failed := testJob(batchv1.JobCondition{Type: batchv1.JobFailed, Status: apiv1.ConditionTrue})
+		_, _ = clientset.BatchV1().Jobs("default").Update(context.Background(), failed, metav1.UpdateOptions{})
+	}()
+
+	succeeded, pod, err := watchJobUntilCompletion(ctx, clientset, job)
+	require.NoError(t, err)
+	assert.False(t, succeeded)
+	require.NotNil(t, pod)
+	assert.Equal(t, "builder", pod.Name)
+}
+
+func TestWatchJobUntilCompletionDeleted(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	job := testJob()
+	clientset := fake.NewSimpleClientset(job)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = clientset.BatchV1().Jobs("default").Delete(context.Background(), job.Name, metav1.DeleteOptions{})
+	}()
+
+	succeeded, pod, err := watchJobUntilCompletion(ctx, clientset, job)
+	require.NoError(t, err)
+	assert.False(t, succeeded)
+	assert.Nil(t, pod)
+}
+
+func TestWaitForBuilderJob(t *testing.T) {
+	cfg := Config{}
+	cfg.Builder.KeepFailed = time.Hour
+	noLogs := func(context.Context, *apiv1.Pod) error { return nil }
+	keepUntil := func(clientset *fake.Clientset) string {
+		job, err := clientset.BatchV1().Jobs("default").Get(context.Background(), testJob().Name, metav1.GetOptions{})
+		require.NoError(t, err)
+		return job.Annotations[keepUntilAnnotation]
+	}
+
+	// Succeeded Jobs are deleted after their logs were streamed
+	done := testJob(batchv1.JobCondition{Type: batchv1.JobComplete, Status: apiv1.ConditionTrue})
+	clientset := fake.NewSimpleClientset(done, testJobPod("builder", apiv1.PodSucceeded, time.Now()))
+	var streamed []string
+	succeeded, err := waitForBuilderJob(context.Background(), clientset, cfg, done, func(_ context.Context, pod *apiv1.Pod) error {
+		streamed = append(streamed, pod.Name)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.True(t, succeeded)
+	assert.Equal(t, []string{"builder"}, streamed)
+	_, err = clientset.BatchV1().Jobs("default").Get(context.Background(), done.Name, metav1.GetOptions{})
+	assert.True(t, k8serrors.IsNotFound(err))
+
+	// Timed out Jobs are kept like failed ones
+	clientset = fake.NewSimpleClientset(testJob())
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	succeeded, err = waitForBuilderJob(ctx, clientset, cfg, testJob(), noLogs)
+	require.Error(t, err)
+	assert.False(t, succeeded)
+	assert.NotEmpty(t, keepUntil(clientset))
+
+	// So are cancelled ones
+	clientset = fake.NewSimpleClientset(testJob())
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	_, err = waitForBuilderJob(ctx, clientset, cfg, testJob(), noLogs)
+	require.Error(t, err)
+	assert.NotEmpty(t, keepUntil(clientset))
+}
+
+func TestGetBuilderActiveDeadline(t *testing.T) {
+	cfg := Config{}
+	assert.Nil(t, getBuilderActiveDeadline(cfg))
+
+	cfg.Builder.Timeout = 90*time.Second + time.Millisecond
+	assert.Equal(t, Int64Ref(91), getBuilderActiveDeadline(cfg))
+
+	cfg.Builder.Job.ActiveDeadlineSeconds = Int64Ref(600)
+	assert.Equal(t, Int64Ref(600), getBuilderActiveDeadline(cfg))
+}
+
+func TestCreateOrReplaceJob(t *testing.T) {
+	ctx := context.Background()
+	previous := testJob(batchv1.JobCondition{Type: batchv1.JobFailed, Status: apiv1.ConditionTrue})
+	clientset := fake.NewSimpleClientset(previous)
+
+	job := testJob()
+	job.UID = types.UID("new-uid")
+	created, err := createOrReplaceJob(ctx, clientset, "default", job, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, types.UID("new-uid"), created.UID)
+	assert.Empty(t, created.Status.Conditions)
+}
+
+func TestCleanupBuilderJob(t *testing.T) {
+	ctx := context.Background()
+	cfg := Config{}
+
+	// Deleted after success, failure and cancellation by default
+	clientset := fake.NewSimpleClientset(testJob())
+	cleanupBuilderJob(clientset, cfg, testJob(), true)
+	_, err := clientset.BatchV1().Jobs("default").Get(ctx, testJob().Name, metav1.GetOptions{})
+	assert.True(t, k8serrors.IsNotFound(err))
+
+	// Failed Jobs are kept during the retention
+	cfg.Builder.KeepFailed = time.Hour
+	clientset = fake.NewSimpleClientset(testJob())
+	cleanupBuilderJob(clientset, cfg, testJob(), true)
+	job, err := clientset.BatchV1().Jobs("default").Get(ctx, testJob().Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	keepUntil, err := time.Parse(time.RFC3339, job.Annotations[keepUntilAnnotation])
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), keepUntil, time.Minute)
+
+	// The Job of a build that timed out or was cancelled is stopped
+	assert.Equal(t, Int64Ref(1), job.Spec.ActiveDeadlineSeconds)
+
+	// Finished Jobs are left as they are
+	failed := testJob(batchv1.JobCondition{Type: batchv1.JobFailed, Status: apiv1.ConditionTrue})
+	failed.Spec.ActiveDeadlineSeconds = Int64Ref(600)
+	clientset = fake.NewSimpleClientset(failed)
+	cleanupBuilderJob(clientset, cfg, testJob(), true)
+	job, err = clientset.BatchV1().Jobs("default").Get(ctx, testJob().Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotEmpty(t, job.Annotations[keepUntilAnnotation])
+	assert.Equal(t, Int64Ref(600), job.Spec.ActiveDeadlineSeconds)
+
+	// Only failed ones
+	clientset = fake.NewSimpleClientset(testJob())
+	cleanupBuilderJob(clientset, cfg, testJob(), false)
+	_, err = clientset.BatchV1().Jobs("default").Get(ctx, testJob().Name, metav1.GetOptions{})
+	assert.True(t, k8serrors.IsNotFound(err))
+}
+
+func TestDeleteExpiredJobs(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	builderJob := func(name string, keepUntil string) *batchv1.Job {
+		job := &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+				Labels:    map[string]string{"externalcc-type": "builder"},
+			},
+		}
+		if keepUntil != "" {
+			job.Annotations = map[string]string{keepUntilAnnotation: keepUntil}
+		}
+		return job
+	}
+	clientset := fake.NewSimpleClientset(
+		builderJob("expired", now.Add(-time.Minute).Format(time.RFC3339)),
+		builderJob("kept", now.Add(time.Minute).Format(time.RFC3339)),
+		builderJob("invalid", "tomorrow"),
+		builderJob("running", ""),
+	)
+
+	require.NoError(t, deleteExpiredJobs(ctx, clientset, "default", now))
+	jobs, err := clientset.BatchV1().Jobs("default").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	names := []string{}
+	for _, job := range jobs.Items {
+		names = append(names, job.Name)
+	}
+	assert.ElementsMatch(t, []string{"kept", "running"}, names)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	defaultBuildLeaseDuration = 30 * time.Second
+	// buildLeaseRetryPeriod is the interval at which peers waiting for a build check the
+	// build cache and the lease
+	buildLeaseRetryPeriod = 5 * time.Second
+)
+
+func getBuildLeaseDuration(cfg Config) time.Duration {
+	if cfg.Builder.LeaseDuration > 0 {
+		return cfg.Builder.LeaseDuration
+	}
+	return defaultBuildLeaseDuration
+}
+
+// buildLease is a Kubernetes Lease held by the peer building the chaincode of a build cache key,
+// while the other peers wait for the output. The holder renews it during the build, so it
+// expires if the peer dies and another peer takes over.
+type buildLease struct {
+	clientset kubernetes.Interface
+	namespace string
+	name      string
+	holder    string
+	duration  time.Duration
+}
+
+func newBuildLease(clientset kubernetes.Interface, namespace string, cacheKey string, holder string, duration time.Duration) *buildLease {
+	return &buildLease{
+		clientset: clientset,
+		namespace: namespace,
+		name:      "ccbuild-" + cacheKey,
+		holder:    holder,
+		duration:  duration,
+	}
+}
+
+// tryAcquire takes the lease if nobody holds it or it expired, and returns whether this peer holds it
+func (l *buildLease) tryAcquire(ctx context.Context) (bool, error) {
+	leases := l.clientset.CoordinationV1().Leases(l.namespace)
+	now := metav1.NewMicroTime(time.Now())
+	lease, err := leases.Get(ctx, l.name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: l.name,
+				Labels: map[string]string{
+					"externalcc-type": "build-lease",
+				},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &l.holder,
+				LeaseDurationSeconds: l.durationSeconds(),
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		_, err = leases.Create(ctx, lease, metav1.CreateOptions{})
+		if k8serrors.IsAlreadyExists(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, errors.Wrap(err, "creating build lease")
+		}
+		return true, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "getting build lease")
+	}
+
+	if holder := lease.Spec.HolderIdentity; holder != nil && *holder != l.holder {
+		if !leaseExpired(lease, now.Time) {
+			return false, nil
+		}
+		log.Printf("Build lease %s of %s expired, taking it over", l.name, *holder)
+		transitions := int32(1)
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions + 1
+		}
+		lease.Spec.LeaseTransitions = &transitions
+		lease.Spec.AcquireTime = &now
+	}
+	lease.Spec.HolderIdentity = &l.holder
+	lease.Spec.LeaseDurationSeconds = l.durationSeconds()
+	lease.Spec.RenewTime = &now
+	// The update fails if another peer changed the lease since we read it
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	if k8serrors.IsConflict(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "updating build lease")
+	}
+	return true, nil
+}
+
+// renew extends the lease, failing if another peer took it over
+func (l *buildLease) renew(ctx context.Context) error {
+	leases := l.clientset.CoordinationV1().Leases(l.namespace)
+	lease, err := leases.Get(ctx, l.name, metav1.GetOptions{})
+	if err != nil {
+		return errors.Wrap(err, "getting build lease")
+	}
+	if holder := lease.Spec.HolderIdentity; holder == nil || *holder != l.holder {
+		return errors.Errorf("build lease %s lost", l.name)
+	}
+	now := metav1.NewMicroTime(time.Now())
+	lease.Spec.RenewTime = &now
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	return errors.Wrap(err, "renewing build lease")
+}
+
+// keepAlive renews the lease until the returned function is called or ctx is done
+func (l *buildLease) keepAlive(ctx context.Context) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(l.duration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := l.renew(ctx); err != nil && ctx.Err() == nil {
+					log.Printf("Renewing build lease: %s", err)
+				}
+			}
+		}
+	}()
+	return cancel
+}
+
+// release deletes the lease if this peer still holds it, so waiting peers don't wait for it to expire
+func (l *buildLease) release(ctx context.Context) error {
+	leases := l.clientset.CoordinationV1().Leases(l.namespace)
+	lease, err := leases.Get(ctx, l.name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "getting build lease")
+	}
+	if holder := lease.Spec.HolderIdentity; holder == nil || *holder != l.holder {
+		return nil
+	}
+	err = leases.Delete(ctx, l.name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &lease.UID},
+	})
+	if k8serrors.IsNotFound(err) {
+		return nil
+	}
+	return errors.Wrap(err, "deleting build lease")
+}
+
+func (l *buildLease) durationSeconds() *int32 {
+	seconds := int32(l.duration / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return &seconds
+}
+
+// leaseExpired returns whether the holder of lease missed its renewal
+func leaseExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	expiry := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+	return now.After(expiry)
+}
+
+// waitForCachedBuild returns the digest of the cached output of the build as soon as lookup
+// finds it, or takes the lease to build it. The returned bool tells whether this peer holds
+// the lease and must build the chaincode. Failed lookups count as misses.
+func waitForCachedBuild(ctx context.Context, lease *buildLease, lookup func() (string, error), retryPeriod time.Duration) (string, bool, error) {
+	cached := func() string {
+		outputDigest, err := lookup()
+		if err != nil {
+			log.Printf("Looking up build cache: %s", err)
+			return ""
+		}
+		return outputDigest
+	}
+
+	for {
+		if outputDigest := cached(); outputDigest != "" {
+			return outputDigest, false, nil
+		}
+		acquired, err := lease.tryAcquire(ctx)
+		if err != nil {
+			return "", false, err
+		}
+		if acquired {
+			// The previous holder may have finished between the lookup and taking the lease
+			if outputDigest := cached(); outputDigest != "" {
+				if err := lease.release(ctx); err != nil {
+					log.Printf("Releasing build lease: %s", err)
+				}
+				return outputDigest, false, nil
+			}
+			return "", true, nil
+		}
+		log.Printf("Build lease %s held by another peer, waiting for its build", lease.name)
+		select {
+		case <-ctx.Done():
+			return "", false, ctx.Err()
+		case <-time.After(retryPeriod):
+		}
+	}
+}
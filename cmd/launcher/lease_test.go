@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testCacheKey = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestBuildLeaseSingleHolder(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	peer0 := newBuildLease(clientset, "default", testCacheKey, "peer0", time.Minute)
+	peer1 := newBuildLease(clientset, "default", testCacheKey, "peer1", time.Minute)
+
+	acquired, err := peer0.tryAcquire(ctx)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	acquired, err = peer1.tryAcquire(ctx)
+	require.NoError(t, err)
+	assert.False(t, acquired)
+
+	// The holder can take it again
+	acquired, err = peer0.tryAcquire(ctx)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+	require.NoError(t, peer0.renew(ctx))
+	assert.Error(t, peer1.renew(ctx))
+
+	// Only the holder releases it
+	require.NoError(t, peer1.release(ctx))
+	_, err = clientset.CoordinationV1().Leases("default").Get(ctx, peer0.name, metav1.GetOptions{})
+	require.NoError(t, err)
+	require.NoError(t, peer0.release(ctx))
+	_, err = clientset.CoordinationV1().Leases("default").Get(ctx, peer0.name, metav1.GetOptions{})
+	assert.True(t, k8serrors.IsNotFound(err))
+
+	acquired, err = peer1.tryAcquire(ctx)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+}
+
+func TestBuildLeaseExpiry(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	peer0 := newBuildLease(clientset, "default", testCacheKey, "peer0", time.Second)
+	peer1 := newBuildLease(clientset, "default", testCacheKey, "peer1", time.Second)
+
+	acquired, err := peer0.tryAcquire(ctx)
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	// peer0 dies without renewing the lease
+	leases := clientset.CoordinationV1().Leases("default")
+	lease, err := leases.Get(ctx, peer0.name, metav1.GetOptions{})
+	require.NoError(t, err)
+	renewTime := metav1.NewMicroTime(time.Now().Add(-time.Minute))
+	lease.Spec.RenewTime = &renewTime
+	_, err = leases.Update(ctx, lease, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	acquired, err = peer1.tryAcquire(ctx)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+	lease, err = leases.Get(ctx, peer0.name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "peer1", *lease.Spec.HolderIdentity)
+	assert.Equal(t, int32(1), *lease.Spec.LeaseTransitions)
+	assert.Error(t, peer0.renew(ctx))
+}
+
+func TestWaitForCachedBuild(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	builder := newBuildLease(clientset, "default", testCacheKey, "peer0", time.Minute)
+	waiter := newBuildLease(clientset, "default", testCacheKey, "peer1", time.Minute)
+
+	uploaded := make(chan struct{})
+	lookup := func() (string, error) {
+		select {
+		case <-uploaded:
+			return "digest", nil
+		default:
+			return "", nil
+		}
+	}
+
+	got, acquired, err := waitForCachedBuild(ctx, builder, lookup, time.Millisecond)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+	assert.Empty(t, got)
+
+	// The waiter gets the output once the builder uploaded it and released the lease
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(uploaded)
+		builder.release(ctx)
+	}()
+	got, acquired, err = waitForCachedBuild(ctx, waiter, lookup, time.Millisecond)
+	require.NoError(t, err)
+	assert.False(t, acquired)
+	assert.Equal(t, "digest", got)
+}
+
+func TestWaitForCachedBuildFailedBuilder(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	builder := newBuildLease(clientset, "default", testCacheKey, "peer0", time.Minute)
+	waiter := newBuildLease(clientset, "default", testCacheKey, "peer1", time.Minute)
+	lookup := func() (string, error) { return "", nil }
+
+	_, acquired, err := waitForCachedBuild(ctx, builder, lookup, time.Millisecond)
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	// The build failed, so the waiter builds the chaincode itself
+	require.NoError(t, builder.release(ctx))
+	_, acquired, err = waitForCachedBuild(ctx, waiter, lookup, time.Millisecond)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, _, err = waitForCachedBuild(ctx, builder, lookup, time.Millisecond)
+	assert.Error(t, err)
+}
@@ -15,6 +15,7 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"gopkg.in/yaml.v2"
 
@@ -65,6 +66,16 @@ func main() {
 	if err != nil {
 		log.Fatalf("Parsing configuration: %s", err)
 	}
+	err = validateCompression(&cfg)
+	if err != nil {
+		log.Fatalf("Parsing configuration: %s", err)
+	}
+	if cfg.OCI.Enabled && cfg.OCI.Repository == "" {
+		log.Fatalf("Parsing configuration: oci.repository is required")
+	}
+	if cfg.Launcher.Server.Enabled && !cfg.OCI.Enabled {
+		log.Fatalf("Parsing configuration: launcher.server requires oci.enabled")
+	}
 
 	// Read namespace
 	namespace, err := ioutil.ReadFile(namespaceFile)
@@ -121,12 +132,81 @@ type Config struct {
 			Name  string `yaml:"name"`
 			Value string `yaml:"value"`
 		} `yaml:"env"`
+		// DisableCache builds every package in a builder pod, instead of reusing the
+		// output of a previous build of the same package with the same image
+		DisableCache bool `yaml:"disable_cache"`
+
+		// Job configures the Jobs running the builder pods
+		Job struct {
+			BackoffLimit            *int32 `yaml:"backoff_limit"`              // Retries of failed builder pods, 2 by default
+			ActiveDeadlineSeconds   *int64 `yaml:"active_deadline_seconds"`    // Maximum duration of a build, the timeout by default
+			TTLSecondsAfterFinished *int32 `yaml:"ttl_seconds_after_finished"` // Kubernetes deletes finished Jobs after it
+		} `yaml:"job"`
+		// Timeout cancels and deletes the builds taking longer, there's no timeout by default
+		Timeout time.Duration `yaml:"timeout"`
+		// KeepFailed keeps the Jobs of failed builds during the given time for debugging,
+		// they are deleted right away by default
+		KeepFailed time.Duration `yaml:"keep_failed"`
+		// LeaseDuration is the validity of the Lease held by the peer building a package,
+		// the build is taken over by another peer if it isn't renewed in time
+		LeaseDuration time.Duration `yaml:"lease_duration"`
 	} `yaml:"builder"`
 
 	Launcher struct {
 		Resources ResourcesConfig `yaml:"resources"`
+
+		// Server deploys the chaincodes as chaincode servers during release, instead of
+		// launching them in run. It requires the chaincodes to be built into images.
+		Server struct {
+			Enabled bool  `yaml:"enabled"`
+			Port    int32 `yaml:"port"` // 7052 by default
+		} `yaml:"server"`
 	} `yaml:"launcher"`
 
+	// OCI builds the chaincodes into images pushed to a registry, which the chaincode pods
+	// run instead of downloading the build output
+	OCI struct {
+		Enabled bool `yaml:"enabled"`
+		// Repository the images are pushed to, e.g. registry.example.com/fabric/chaincode.
+		// REGISTRY_USERNAME and REGISTRY_PASSWORD are its credentials.
+		Repository string `yaml:"repository"`
+		// BaseImages are the runtime images the build output is added to, map[technology]image.
+		// The builder image is used for technologies without one.
+		BaseImages map[string]string `yaml:"base_images"`
+		Insecure   bool              `yaml:"insecure"`    // Talk plain HTTP to the registries
+		PullSecret string            `yaml:"pull_secret"` // Secret used by the chaincode pods to pull the images
+	} `yaml:"oci"`
+
+	FileServer struct {
+		// URLExpiry is the validity of the signed URLs handed out to the builder pods
+		URLExpiry time.Duration `yaml:"url_expiry"`
+		// RunURLExpiry is the validity of the signed URLs the chaincode pods download the build
+		// output with, it must outlast the restarts of their init containers
+		RunURLExpiry time.Duration `yaml:"run_url_expiry"`
+		// ChunkSize is the size in bytes of the chunks of resumable uploads
+		ChunkSize int64 `yaml:"chunk_size"`
+		// Tenant is the partition of the file server used by this peer, such as its MSP ID.
+		// FILE_SERVER_SECRET must then be the secret of the tenant.
+		Tenant string `yaml:"tenant"`
+
+		// Compression of the artifacts, the builder and chaincode pods need the
+		// command line tool of the algorithm
+		Compression struct {
+			Algorithm string `yaml:"algorithm"` // gzip, zstd or none (default)
+			Level     int    `yaml:"level"`     // 0 selects the default level of the algorithm
+		} `yaml:"compression"`
+
+		TLS struct {
+			Enabled  bool   `yaml:"enabled"`
+			CAFile   string `yaml:"ca_file"`   // CA bundle used by the launcher to verify the file server
+			CertFile string `yaml:"cert_file"` // Client certificate of the launcher, enables mutual TLS
+			KeyFile  string `yaml:"key_file"`
+			// SecretName is a Secret with ca.crt (and tls.crt/tls.key for mutual TLS)
+			// mounted in the builder and chaincode pods to reach the file server
+			SecretName string `yaml:"secret_name"`
+		} `yaml:"tls"`
+	} `yaml:"fileserver"`
+
 	// Internal configurations
 	Namespace string `yaml:"-"`
 }
@@ -135,6 +215,17 @@ type Config struct {
 type BuildInformation struct {
 	Image    string
 	Platform string
+	// Hex encoded SHA-256 of the chaincode source and build output tarballs
+	SourceDigest string
+	OutputDigest string
+	// OutputBuildID is the build ID the output is stored under on the file server,
+	// the build cache key for cached builds
+	OutputBuildID string
+	// ChaincodeImage is the image with the build output, referenced by digest, if the
+	// chaincode was built into an image
+	ChaincodeImage string `json:",omitempty"`
+	// Resources are the resources of the chaincode requested by its metadata.json
+	Resources ResourcesConfig
 }
 
 // ChaincodeMetadata is based on
@@ -159,9 +250,12 @@ type ChaincodeRunConfig struct {
 	Resources   ResourcesConfig `json:"resources"`
 
 	// Custom fields
-	ShortName string
-	Image     string
-	Platform  string
+	ShortName      string
+	Image          string
+	Platform       string
+	OutputDigest   string
+	OutputBuildID  string
+	ChaincodeImage string
 }
 
 func streamPodLogs(ctx context.Context, pod *apiv1.Pod) error {
@@ -218,57 +312,27 @@ func watchPodUntilCompletion(ctx context.Context, pod *apiv1.Pod) (bool, error)
 		return false, errors.Wrap(err, "getting kubernetes clientset")
 	}
 
-	/* Create log attacher
-	var attachOnce sync.Once
-	attachLogs := func() {
-		go func() {
-			err := streamPodLogs(pod)
-			if err != nil {
-				log.Printf("While streaming pod logs: %q", err)
-			}
-		}()
-	}*/
-
 	// Create informer
 	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithNamespace(pod.Namespace))
 	informer := factory.Core().V1().Pods().Informer()
-	c := make(chan struct{})
-	defer close(c)
-
-	podSuccessfull := make(chan bool)
-	defer close(podSuccessfull)
-	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		UpdateFunc: func(oldPod, newPod interface{}) {
-			p := newPod.(*apiv1.Pod)
-			if p.Name == pod.Name {
-				log.Printf("Received update on pod %s, phase %s", p.Name, p.Status.Phase)
-				// TODO: Can we miss an update, so not getting logs?
-
-				switch p.Status.Phase {
-				case apiv1.PodSucceeded:
-					podSuccessfull <- true
-				case apiv1.PodFailed, apiv1.PodUnknown:
-					podSuccessfull <- false
-				case apiv1.PodPending, apiv1.PodRunning:
-					// Do nothing as this state is good
-				default:
-					podSuccessfull <- false // Unknown phase
-				}
-			}
-		},
-		DeleteFunc: func(oldPod interface{}) {
-			p := oldPod.(*apiv1.Pod)
-			if p.Name == pod.Name {
-				log.Printf("Pod %s, phase %s got deleted", p.Name, p.Status.Phase)
-				podSuccessfull <- false
-			}
-		},
+	res, err := watchUntilCompletion(ctx, informer, pod.Name, func(obj interface{}) (bool, bool) {
+		p := obj.(*apiv1.Pod)
+		log.Printf("Received update on pod %s, phase %s", p.Name, p.Status.Phase)
+		switch p.Status.Phase {
+		case apiv1.PodSucceeded:
+			return true, true
+		case apiv1.PodFailed, apiv1.PodUnknown:
+			return true, false
+		case apiv1.PodPending, apiv1.PodRunning:
+			// Do nothing as this state is good
+			return false, false
+		default:
+			return true, false // Unknown phase
+		}
 	})
-	go informer.Run(c)
-
-	// Wait for result of informer and stop it afterwards.
-	res := <-podSuccessfull
-	c <- struct{}{}
+	if err != nil {
+		return false, err
+	}
 
 	// Stream logs
 	// TODO: This should be done as soon as the pod is running or has an result
@@ -280,6 +344,55 @@ func watchPodUntilCompletion(ctx context.Context, pod *apiv1.Pod) (bool, error)
 	return res, nil
 }
 
+// watchUntilCompletion runs informer until completed reports the object name as done,
+// and returns whether it succeeded. The deletion of the object counts as a failure.
+func watchUntilCompletion(ctx context.Context, informer cache.SharedIndexInformer, name string, completed func(obj interface{}) (bool, bool)) (bool, error) {
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// Handlers may report several updates before we stop the informer, only the first counts
+	result := make(chan bool, 1)
+	report := func(succeeded bool) {
+		select {
+		case result <- succeeded:
+		default:
+		}
+	}
+	update := func(obj interface{}) {
+		if o, ok := obj.(metav1.Object); !ok || o.GetName() != name {
+			return
+		}
+		if done, succeeded := completed(obj); done {
+			report(succeeded)
+		}
+	}
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		// The initial list of the informer adds objects that may have completed already
+		AddFunc: update,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			update(newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if o, ok := obj.(metav1.Object); ok && o.GetName() == name {
+				log.Printf("%s got deleted", name)
+				report(false)
+			}
+		},
+	})
+	go informer.Run(stop)
+
+	// Wait for result of informer and stop it afterwards.
+	select {
+	case res := <-result:
+		return res, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
 func getMetadata(metadataDir string) (*ChaincodeMetadata, error) {
 	metadataFile := filepath.Join(metadataDir, "metadata.json")
 	metadataData, err := ioutil.ReadFile(metadataFile)
@@ -310,6 +423,16 @@ func BoolRef(b bool) *bool {
 	return &b
 }
 
+// Int32Ref returns the reference to an int32
+func Int32Ref(i int32) *int32 {
+	return &i
+}
+
+// Int64Ref returns the reference to an int64
+func Int64Ref(i int64) *int64 {
+	return &i
+}
+
 func getKubernetesClientset() (*kubernetes.Clientset, error) {
 	// Setup kubernetes client
 	config, err := rest.InClusterConfig()
@@ -347,10 +470,3 @@ func TempFileName(prefix, suffix string) string {
 	rand.Read(randBytes)
 	return filepath.Join(os.TempDir(), prefix+hex.EncodeToString(randBytes)+suffix)
 }
-
-func getFileServerURL() string {
-	fileServerIP := os.Getenv("FILE_SERVER_BASE_IP")
-	fileServerURL := fmt.Sprintf("http://%s:8080", fileServerIP)
-	log.Printf("File Server URL=%s", fileServerURL)
-	return fileServerURL
-}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	dockerHubRegistry = "registry-1.docker.io"
+
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerLayer        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCILayer           = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	contentDigestHeader = "Docker-Content-Digest"
+)
+
+// imageReference is a parsed image name such as registry.example.com/fabric/mycc:1.0
+type imageReference struct {
+	Registry   string
+	Repository string
+	// Reference is the tag or digest of the image
+	Reference string
+}
+
+// parseImageReference parses an image name, defaulting to Docker Hub and the latest tag
+func parseImageReference(name string) (imageReference, error) {
+	ref := imageReference{Registry: dockerHubRegistry}
+	rest := name
+	if i := strings.Index(rest, "/"); i > 0 {
+		host := rest[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.Registry = host
+			rest = rest[i+1:]
+		}
+	}
+	if i := strings.Index(rest, "@"); i >= 0 {
+		ref.Repository, ref.Reference = rest[:i], rest[i+1:]
+	} else if i := strings.LastIndex(rest, ":"); i >= 0 && !strings.Contains(rest[i:], "/") {
+		ref.Repository, ref.Reference = rest[:i], rest[i+1:]
+	} else {
+		ref.Repository, ref.Reference = rest, "latest"
+	}
+	if ref.Repository == "" || ref.Reference == "" {
+		return imageReference{}, errors.Errorf("invalid image reference %q", name)
+	}
+	if ref.Registry == dockerHubRegistry && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = "library/" + ref.Repository
+	}
+	return ref, nil
+}
+
+// Name returns the image name with the registry and repository, without the reference
+func (r imageReference) Name() string {
+	return r.Registry + "/" + r.Repository
+}
+
+// String returns the full image name, referencing a digest with @
+func (r imageReference) String() string {
+	if strings.Contains(r.Reference, ":") {
+		return r.Name() + "@" + r.Reference
+	}
+	return r.Name() + ":" + r.Reference
+}
+
+// registryDescriptor describes a blob or manifest in a manifest or index
+type registryDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	Platform  *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+// registryManifest is an image manifest or index in the Docker v2 schema 2 or OCI format
+type registryManifest struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	MediaType     string               `json:"mediaType,omitempty"`
+	Config        registryDescriptor   `json:"config"`
+	Layers        []registryDescriptor `json:"layers"`
+	Manifests     []registryDescriptor `json:"manifests,omitempty"`
+}
+
+// registryClient talks the Docker Registry HTTP API V2 to pull and push images.
+// It answers the Basic and Bearer token challenges of the registries, sending the
+// credentials only to the registry they're configured for.
+type registryClient struct {
+	client   *http.Client
+	insecure bool // plain HTTP
+
+	credentialsRegistry string
+	username            string
+	password            string
+
+	mutex  sync.Mutex
+	tokens map[string]string // by registry and scope
+}
+
+func newRegistryClient(client *http.Client, insecure bool, credentialsRegistry string, username string, password string) *registryClient {
+	return &registryClient{
+		client:              client,
+		insecure:            insecure,
+		credentialsRegistry: credentialsRegistry,
+		username:            username,
+		password:            password,
+		tokens:              map[string]string{},
+	}
+}
+
+func (c *registryClient) url(ref imageReference, path string) string {
+	scheme := "https"
+	if c.insecure {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s/%s", scheme, ref.Registry, ref.Repository, path)
+}
+
+// do sends req to the registry of ref, authorizing it for scope. Requests with a body
+// are only retried after a challenge if the body can be rewound.
+func (c *registryClient) do(ctx context.Context, ref imageReference, scope string, req *http.Request) (*http.Response, error) {
+	req = req.WithContext(ctx)
+	tokenKey := ref.Registry + " " + scope
+	c.mutex.Lock()
+	authorization := c.tokens[tokenKey]
+	c.mutex.Unlock()
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	authorization, err = c.authorize(ctx, ref, scope, challenge)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.tokens[tokenKey] = authorization
+	c.mutex.Unlock()
+
+	retry := req.Clone(ctx)
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, errors.Errorf("registry %s asked for authorization while streaming a request", ref.Registry)
+		}
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	retry.Header.Set("Authorization", authorization)
+	return c.client.Do(retry)
+}
+
+// authorize answers a WWW-Authenticate challenge and returns the Authorization header value
+func (c *registryClient) authorize(ctx context.Context, ref imageReference, scope string, challenge string) (string, error) {
+	hasCredentials := c.username != "" && ref.Registry == c.credentialsRegistry
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if !hasCredentials {
+			return "", errors.Errorf("registry %s requires credentials", ref.Registry)
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password)), nil
+	case "bearer":
+	default:
+		return "", errors.Errorf("unsupported authorization challenge %q from registry %s", challenge, ref.Registry)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", errors.Errorf("invalid token realm in challenge %q", challenge)
+	}
+	q := realm.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	q.Set("scope", scope)
+	realm.RawQuery = q.Encode()
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "creating token request")
+	}
+	if hasCredentials {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.Wrap(err, "requesting registry token")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("Received %d code from token server %s", resp.StatusCode, realm.Host)
+	}
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", errors.Wrap(err, "decoding registry token")
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	return "Bearer " + token.Token, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header such as
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) == 2 {
+		for _, param := range strings.Split(parts[1], ",") {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 {
+				params[strings.ToLower(kv[0])] = strings.Trim(kv[1], `"`)
+			}
+		}
+	}
+	return parts[0], params
+}
+
+func pullScope(ref imageReference) string {
+	return fmt.Sprintf("repository:%s:pull", ref.Repository)
+}
+
+func pushScope(ref imageReference) string {
+	return fmt.Sprintf("repository:%s:pull,push", ref.Repository)
+}
+
+// getManifest returns the image manifest of ref. Indexes are resolved to the
+// manifest of the linux platform of the launcher.
+func (c *registryClient) getManifest(ctx context.Context, ref imageReference) (*registryManifest, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url(ref, "manifests/"+ref.Reference), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating manifest request")
+	}
+	req.Header.Set("Accept", strings.Join([]string{mediaTypeOCIManifest, mediaTypeDockerManifest, mediaTypeOCIIndex, mediaTypeDockerManifestList}, ", "))
+	resp, err := c.do(ctx, ref, pullScope(ref), req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting manifest of %s", ref)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Received %d code getting manifest of %s", resp.StatusCode, ref)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading manifest of %s", ref)
+	}
+	manifest := &registryManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, errors.Wrapf(err, "decoding manifest of %s", ref)
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = resp.Header.Get("Content-Type")
+	}
+
+	switch manifest.MediaType {
+	case mediaTypeOCIManifest, mediaTypeDockerManifest:
+		return manifest, nil
+	case mediaTypeOCIIndex, mediaTypeDockerManifestList:
+		for _, m := range manifest.Manifests {
+			if m.Platform != nil && m.Platform.OS == "linux" && m.Platform.Architecture == runtime.GOARCH {
+				platformRef := ref
+				platformRef.Reference = m.Digest
+				return c.getManifest(ctx, platformRef)
+			}
+		}
+		return nil, errors.Errorf("no linux/%s image in %s", runtime.GOARCH, ref)
+	default:
+		return nil, errors.Errorf("unsupported manifest type %q of %s", manifest.MediaType, ref)
+	}
+}
+
+// headManifest returns the digest of the manifest of ref, or an empty string if it doesn't exist
+func (c *registryClient) headManifest(ctx context.Context, ref imageReference) (string, error) {
+	req, err := http.NewRequest(http.MethodHead, c.url(ref, "manifests/"+ref.Reference), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "creating manifest request")
+	}
+	req.Header.Set("Accept", strings.Join([]string{mediaTypeOCIManifest, mediaTypeDockerManifest}, ", "))
+	resp, err := c.do(ctx, ref, pushScope(ref), req)
+	if err != nil {
+		return "", errors.Wrapf(err, "getting manifest of %s", ref)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Header.Get(contentDigestHeader), nil
+	case http.StatusNotFound:
+		return "", nil
+	default:
+		return "", errors.Errorf("Received %d code getting manifest of %s", resp.StatusCode, ref)
+	}
+}
+
+// putManifest uploads a manifest under the reference of ref
+func (c *registryClient) putManifest(ctx context.Context, ref imageReference, mediaType string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPut, c.url(ref, "manifests/"+ref.Reference), bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "creating manifest request")
+	}
+	req.Header.Set("Content-Type", mediaType)
+	resp, err := c.do(ctx, ref, pushScope(ref), req)
+	if err != nil {
+		return errors.Wrapf(err, "pushing manifest of %s", ref)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return errors.Errorf("Received %d code pushing manifest of %s", resp.StatusCode, ref)
+	}
+	return nil
+}
+
+// getBlob opens a blob of the repository of ref
+func (c *registryClient) getBlob(ctx context.Context, ref imageReference, digest string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url(ref, "blobs/"+digest), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating blob request")
+	}
+	resp, err := c.do(ctx, ref, pullScope(ref), req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting blob %s of %s", digest, ref.Name())
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.Errorf("Received %d code getting blob %s of %s", resp.StatusCode, digest, ref.Name())
+	}
+	return resp.Body, nil
+}
+
+// hasBlob returns whether the repository of ref has a blob
+func (c *registryClient) hasBlob(ctx context.Context, ref imageReference, digest string) (bool, error) {
+	req, err := http.NewRequest(http.MethodHead, c.url(ref, "blobs/"+digest), nil)
+	if err != nil {
+		return false, errors.Wrap(err, "creating blob request")
+	}
+	resp, err := c.do(ctx, ref, pushScope(ref), req)
+	if err != nil {
+		return false, errors.Wrapf(err, "checking blob %s of %s", digest, ref.Name())
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, errors.Errorf("Received %d code checking blob %s of %s", resp.StatusCode, digest, ref.Name())
+	}
+}
+
+// putBlob uploads a blob of size bytes to the repository of ref in a single request
+func (c *registryClient) putBlob(ctx context.Context, ref imageReference, digest string, data io.Reader, size int64) error {
+	req, err := http.NewRequest(http.MethodPost, c.url(ref, "blobs/uploads/"), nil)
+	if err != nil {
+		return errors.Wrap(err, "creating upload request")
+	}
+	resp, err := c.do(ctx, ref, pushScope(ref), req)
+	if err != nil {
+		return errors.Wrapf(err, "starting upload of blob %s to %s", digest, ref.Name())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return errors.Errorf("Received %d code starting upload of blob %s to %s", resp.StatusCode, digest, ref.Name())
+	}
+	location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return errors.Wrap(err, "parsing upload location")
+	}
+	q := location.Query()
+	q.Set("digest", digest)
+	location.RawQuery = q.Encode()
+
+	req, err = http.NewRequest(http.MethodPut, location.String(), data)
+	if err != nil {
+		return errors.Wrap(err, "creating upload request")
+	}
+	req.ContentLength = size
+	if rs, ok := data.(io.ReadSeeker); ok && req.GetBody == nil {
+		// Blobs read from files can be sent again after an authorization challenge too
+		req.GetBody = func() (io.ReadCloser, error) {
+			_, err := rs.Seek(0, io.SeekStart)
+			return ioutil.NopCloser(rs), err
+		}
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err = c.do(ctx, ref, pushScope(ref), req)
+	if err != nil {
+		return errors.Wrapf(err, "uploading blob %s to %s", digest, ref.Name())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return errors.Errorf("Received %d code uploading blob %s to %s", resp.StatusCode, digest, ref.Name())
+	}
+	return nil
+}
+
+// copyBlob copies a blob from the repository of src to the one of dst, unless dst has it already
+func (c *registryClient) copyBlob(ctx context.Context, src imageReference, dst imageReference, blob registryDescriptor) error {
+	exists, err := c.hasBlob(ctx, dst, blob.Digest)
+	if err != nil || exists {
+		return err
+	}
+	data, err := c.getBlob(ctx, src, blob.Digest)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	return c.putBlob(ctx, dst, blob.Digest, data, blob.Size)
+}
@@ -11,7 +11,8 @@ import (
 )
 
 // Release copies the META-INF data from the chaincode source to the release directory
-// on the peer
+// on the peer, and the connection.json of chaincode servers. If the launcher manages chaincode
+// servers, it deploys the chaincode and writes the connection.json of its Service.
 func Release(ctx context.Context, cfg Config) error {
 	log.Println("Procedure: release")
 
@@ -32,5 +33,9 @@ func Release(ctx context.Context, cfg Config) error {
 			return errors.Wrap(err, "accessing statedb folder")
 		}
 	}
-	return nil
+	// Chaincode server packages bring their own connection.json
+	if _, err := os.Stat(filepath.Join(sourceDir, connectionFile)); os.IsNotExist(err) && cfg.Launcher.Server.Enabled {
+		return releaseManagedChaincodeServer(ctx, cfg, sourceDir, outputDir)
+	}
+	return releaseChaincodeServer(sourceDir, outputDir)
 }
@@ -30,6 +30,9 @@ func Run(ctx context.Context, cfg Config) error {
 	metadataDir := os.Args[2]
 	log.Printf("RUN Output dir=%s", outputDir)
 	log.Printf("RUN Metadata dir=%s", metadataDir)
+	if _, err := os.Stat(filepath.Join(outputDir, connectionFile)); err == nil {
+		return errors.New("chaincode servers are dialed by the peer, not launched")
+	}
 	buildID, err := getBuildIDForRun(outputDir)
 	if err != nil {
 		return errors.Wrap(err, fmt.Sprintf("getting build id from output dir=%s", outputDir))
@@ -40,6 +43,10 @@ func Run(ctx context.Context, cfg Config) error {
 	if err != nil {
 		return errors.Wrap(err, "getting run config for chaincode")
 	}
+	// Builds before the build cache stored the output under the build ID of the peer
+	if runConfig.OutputBuildID != "" {
+		buildID = runConfig.OutputBuildID
+	}
 	// Create chaincode pod
 	pod, err := createChaincodePod(
 		ctx,
@@ -97,6 +104,25 @@ func getChaincodeRunConfig(metadataDir string, outputDir string) (*ChaincodeRunC
 	metadata.ShortName = fmt.Sprintf("%s-%s", name, hash[0:8])
 
 	// Read BuildInformation
+	buildInformation, err := getBuildInformation(outputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata.Image = buildInformation.Image
+	metadata.Platform = buildInformation.Platform
+	metadata.OutputDigest = buildInformation.OutputDigest
+	metadata.OutputBuildID = buildInformation.OutputBuildID
+	metadata.ChaincodeImage = buildInformation.ChaincodeImage
+	if metadata.Resources == (ResourcesConfig{}) {
+		metadata.Resources = buildInformation.Resources
+	}
+
+	return &metadata, nil
+}
+
+// getBuildInformation reads the k8scc_buildinfo.json written by build to outputDir
+func getBuildInformation(outputDir string) (*BuildInformation, error) {
 	buildInfoFile := filepath.Join(outputDir, "k8scc_buildinfo.json")
 	buildInfoData, err := ioutil.ReadFile(buildInfoFile)
 	if err != nil {
@@ -112,11 +138,7 @@ func getChaincodeRunConfig(metadataDir string, outputDir string) (*ChaincodeRunC
 	if buildInformation.Image == "" {
 		return nil, errors.New("No image found in buildinfo")
 	}
-
-	metadata.Image = buildInformation.Image
-	metadata.Platform = buildInformation.Platform
-
-	return &metadata, nil
+	return &buildInformation, nil
 }
 
 func createChaincodePod(ctx context.Context, cfg Config, runConfig *ChaincodeRunConfig, buildID string) (*apiv1.Pod, error) {
@@ -137,41 +159,16 @@ func createChaincodePod(ctx context.Context, cfg Config, runConfig *ChaincodeRun
 			return nil, err
 		}
 	}
+	resources, err := getChaincodeResources(cfg, runConfig.Resources)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting chaincode resources")
+	}
 	// Get peer Pod
 	myselfPod, err := clientset.CoreV1().Pods(cfg.Namespace).Get(ctx, myself, metav1.GetOptions{})
 	if err != nil {
 		return nil, errors.Wrap(err, "getting myself Pod")
 	}
 
-	// Set resources
-	limits := apiv1.ResourceList{}
-	if limit := cfg.Launcher.Resources.LimitMemory; limit != "" {
-		limits["memory"] = resource.MustParse(limit)
-	}
-	if limit := cfg.Launcher.Resources.LimitCPU; limit != "" {
-		limits["cpu"] = resource.MustParse(limit)
-	}
-	requests := apiv1.ResourceList{}
-	if request := cfg.Launcher.Resources.RequestsMemory; request != "" {
-		requests["memory"] = resource.MustParse(request)
-	}
-	if request := cfg.Launcher.Resources.RequestsCPU; request != "" {
-		requests["cpu"] = resource.MustParse(request)
-	}
-
-	if limit := runConfig.Resources.LimitMemory; limit != "" {
-		limits["memory"] = resource.MustParse(limit)
-	}
-	if limit := runConfig.Resources.LimitCPU; limit != "" {
-		limits["cpu"] = resource.MustParse(limit)
-	}
-	if request := runConfig.Resources.RequestsMemory; request != "" {
-		requests["memory"] = resource.MustParse(request)
-	}
-	if request := runConfig.Resources.RequestsCPU; request != "" {
-		requests["cpu"] = resource.MustParse(request)
-	}
-
 	// Configuration
 	hasTLS := "true"
 	if runConfig.ClientCert == "" {
@@ -179,17 +176,39 @@ func createChaincodePod(ctx context.Context, cfg Config, runConfig *ChaincodeRun
 	}
 	initImage := "dviejo/fabric-init:amd64-2.2.0"
 
-	// file server URL
-	fileServerURL := getFileServerURL()
-	basePathURL := fmt.Sprintf("%s/%s", fileServerURL, buildID)
-	log.Printf("Chaincode base path URL=%s", basePathURL)
-	chaincodeOutputURL := fmt.Sprintf("%s/chaincode-output.tar", basePathURL)
 	initVolumeMounts := []apiv1.VolumeMount{
 		{
 			Name:      "chaincode",
 			MountPath: "/chaincode",
 		},
 	}
+	chaincodeVolumeMounts := []apiv1.VolumeMount{
+		{
+			Name:      "chaincode",
+			MountPath: "/chaincode/artifacts",
+			SubPath:   "artifacts",
+		},
+	}
+	image := runConfig.Image
+	initContainers := []apiv1.Container{}
+	volumes := []apiv1.Volume{
+		{
+			Name: "chaincode",
+		},
+	}
+	if runConfig.ChaincodeImage != "" {
+		// The build output is part of the chaincode image
+		image = runConfig.ChaincodeImage
+	} else {
+		var downloadContainer apiv1.Container
+		downloadContainer, volumes = getChaincodeOutputDownload(cfg, buildID, runConfig.OutputDigest)
+		initContainers = append(initContainers, downloadContainer)
+		chaincodeVolumeMounts = append(chaincodeVolumeMounts, apiv1.VolumeMount{
+			Name:      "chaincode",
+			MountPath: GetCCMountDir(runConfig.Platform),
+			SubPath:   "output",
+		})
+	}
 
 	// Pod
 	pod := &apiv1.Pod{
@@ -210,20 +229,8 @@ func createChaincodePod(ctx context.Context, cfg Config, runConfig *ChaincodeRun
 		},
 		Spec: apiv1.PodSpec{
 
-			InitContainers: []apiv1.Container{
-				{
-					Name:    "download-chaincode-output",
-					Image:   initImage,
-					Command: []string{"/bin/bash"},
-					Args: []string{
-						"-c",
-						fmt.Sprintf(`
-mkdir -p /chaincode/output && chmod -R 777 /chaincode/output && curl -s -o- -L '%s' | tar -C /chaincode/output -xvf -
-`, chaincodeOutputURL),
-					},
-					VolumeMounts: initVolumeMounts,
-				},
-				{
+			InitContainers: append(initContainers,
+				apiv1.Container{
 					Name:    "populate-chaincode-artifacts",
 					Image:   initImage,
 					Command: []string{"/bin/bash"},
@@ -258,11 +265,11 @@ EOF_5
 					},
 					VolumeMounts: initVolumeMounts,
 				},
-			},
+			),
 			Containers: []apiv1.Container{
 				{
 					Name:            "chaincode",
-					Image:           runConfig.Image,
+					Image:           image,
 					ImagePullPolicy: apiv1.PullIfNotPresent,
 					Env: []apiv1.EnvVar{
 						{
@@ -302,32 +309,93 @@ EOF_5
 							Value: hasTLS,
 						},
 					},
-					WorkingDir: GetCCMountDir(runConfig.Platform), // Set the CWD to the path where the chaincode is
-					Command:    GetRunArgs(runConfig.Platform, runConfig.PeerAddress),
-					Resources:  apiv1.ResourceRequirements{Limits: limits, Requests: requests},
-					VolumeMounts: []apiv1.VolumeMount{
-						{
-							Name:      "chaincode",
-							MountPath: "/chaincode/artifacts",
-							SubPath:   "artifacts",
-						},
-						{
-							Name:      "chaincode",
-							MountPath: GetCCMountDir(runConfig.Platform),
-							SubPath:   "output",
-						},
-					},
+					WorkingDir:   GetCCMountDir(runConfig.Platform), // Set the CWD to the path where the chaincode is
+					Command:      GetRunArgs(runConfig.Platform, runConfig.PeerAddress),
+					Resources:    resources,
+					VolumeMounts: chaincodeVolumeMounts,
 				},
 			},
 			EnableServiceLinks: BoolRef(false),
 			RestartPolicy:      apiv1.RestartPolicyAlways,
-			Volumes: []apiv1.Volume{
-				{
-					Name: "chaincode",
-				},
-			},
+			Volumes:            volumes,
+			ImagePullSecrets:   getImagePullSecrets(cfg),
 		},
 	}
 
 	return clientset.CoreV1().Pods(cfg.Namespace).Create(ctx, pod, metav1.CreateOptions{})
 }
+
+// getChaincodeResources returns the resources of a chaincode container, the resources
+// of the chaincode override the ones of the launcher configuration.
+// The resources of the chaincode come from its package, so they're parsed without panicking.
+func getChaincodeResources(cfg Config, resources ResourcesConfig) (apiv1.ResourceRequirements, error) {
+	limits := apiv1.ResourceList{}
+	requests := apiv1.ResourceList{}
+	for _, r := range []ResourcesConfig{cfg.Launcher.Resources, resources} {
+		for _, q := range []struct {
+			list  apiv1.ResourceList
+			name  apiv1.ResourceName
+			value string
+			field string
+		}{
+			{limits, apiv1.ResourceMemory, r.LimitMemory, "memory_limit"},
+			{limits, apiv1.ResourceCPU, r.LimitCPU, "cpu_limit"},
+			{requests, apiv1.ResourceMemory, r.RequestsMemory, "memory_requests"},
+			{requests, apiv1.ResourceCPU, r.RequestsCPU, "cpu_requests"},
+		} {
+			if q.value == "" {
+				continue
+			}
+			quantity, err := resource.ParseQuantity(q.value)
+			if err != nil {
+				return apiv1.ResourceRequirements{}, errors.Wrapf(err, "parsing %s %q", q.field, q.value)
+			}
+			q.list[q.name] = quantity
+		}
+	}
+	return apiv1.ResourceRequirements{Limits: limits, Requests: requests}, nil
+}
+
+// getChaincodeOutputDownload returns the init container downloading the build output to
+// the output directory of the chaincode volume, and the volumes it needs.
+// The volume outlives the restarts of the pod, so the output is only downloaded once.
+func getChaincodeOutputDownload(cfg Config, buildID string, outputDigest string) (apiv1.Container, []apiv1.Volume) {
+	initImage := "dviejo/fabric-init:amd64-2.2.0"
+
+	// file server URL
+	chaincodeOutputURL := getRunArtifactURL(cfg, buildID, "chaincode-output.tar")
+	volumeMounts := []apiv1.VolumeMount{
+		{
+			Name:      "chaincode",
+			MountPath: "/chaincode",
+		},
+	}
+	volumes := []apiv1.Volume{
+		{
+			Name: "chaincode",
+		},
+	}
+	// Only the download container gets the file server TLS material
+	if tlsVolume, tlsMount := getFileServerTLSVolume(cfg); tlsVolume != nil {
+		volumes = append(volumes, *tlsVolume)
+		volumeMounts = append(volumeMounts, *tlsMount)
+	}
+
+	container := apiv1.Container{
+		Name:    "download-chaincode-output",
+		Image:   initImage,
+		Command: []string{"/bin/bash"},
+		Args: []string{
+			"-c",
+			fmt.Sprintf(`
+if [ -f /chaincode/output.done ]; then echo "build output already downloaded"; exit 0; fi
+mkdir -p /chaincode/output && chmod -R 777 /chaincode/output &&
+%s &&
+tar -C /chaincode/output -xvf /chaincode/output.tar && rm /chaincode/output.tar &&
+touch /chaincode/output.done
+`, getDownloadScript(cfg, chaincodeOutputURL, "/chaincode/output.tar", outputDigest)),
+		},
+		VolumeMounts: volumeMounts,
+	}
+	return container, volumes
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	defaultChaincodeServerPort = 7052
+	chaincodeServerDialTimeout = "10s"
+)
+
+func getChaincodeServerPort(cfg Config) int32 {
+	if cfg.Launcher.Server.Port > 0 {
+		return cfg.Launcher.Server.Port
+	}
+	return defaultChaincodeServerPort
+}
+
+// getPackageID returns the chaincode package ID from the build directory, or an empty string
+// if it can't be found. Fabric names it fabric-<label>-<hash><random suffix>.
+func getPackageID(buildDir string) string {
+	folderName := strings.TrimPrefix(filepath.Base(filepath.Dir(buildDir)), "fabric-")
+	i := strings.LastIndex(folderName, "-")
+	if i <= 0 {
+		return ""
+	}
+	hash := packageHashPattern.FindString(folderName[i+1:])
+	if hash == "" {
+		return ""
+	}
+	return folderName[:i] + ":" + hash
+}
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// getChaincodeServerName returns the name of the Deployment and Service of a chaincode server,
+// a valid DNS label ending with the start of the package hash
+func getChaincodeServerName(peerName string, packageID string) string {
+	parts := strings.SplitN(packageID, ":", 2)
+	hash := parts[len(parts)-1]
+	if len(hash) > 8 {
+		hash = hash[:8]
+	}
+	prefix := invalidNameChars.ReplaceAllString(strings.ToLower(fmt.Sprintf("%s-ccs-%s", peerName, parts[0])), "-")
+	if max := 63 - len(hash) - 1; len(prefix) > max {
+		prefix = prefix[:max]
+	}
+	return strings.Trim(prefix, "-") + "-" + hash
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+// getLabelValue returns a valid label value for value
+func getLabelValue(value string) string {
+	value = invalidLabelChars.ReplaceAllString(value, "-")
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return strings.Trim(value, "-_.")
+}
+
+// getChaincodeServerLabels returns the labels of the chaincode servers of a peer for the label of a package
+func getChaincodeServerLabels(peerName string, packageID string) map[string]string {
+	return map[string]string{
+		"externalcc-peer":  getLabelValue(peerName),
+		"externalcc-label": getLabelValue(strings.SplitN(packageID, ":", 2)[0]),
+	}
+}
+
+// deleteStaleChaincodeServers deletes the Deployments and Services of the chaincode servers the peer
+// deployed for other packages with the label of packageID, e.g. the previous version of a chaincode
+func deleteStaleChaincodeServers(ctx context.Context, clientset kubernetes.Interface, namespace string, peerName string, packageID string) error {
+	name := getChaincodeServerName(peerName, packageID)
+	selector := "externalcc-type=server"
+	for k, v := range getChaincodeServerLabels(peerName, packageID) {
+		selector += fmt.Sprintf(",%s=%s", k, v)
+	}
+	propagation := metav1.DeletePropagationBackground
+	deleteOptions := metav1.DeleteOptions{PropagationPolicy: &propagation}
+
+	deployments := clientset.AppsV1().Deployments(namespace)
+	deploymentList, err := deployments.List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return errors.Wrap(err, "listing chaincode server deployments")
+	}
+	for _, deployment := range deploymentList.Items {
+		if deployment.Name == name {
+			continue
+		}
+		log.Printf("Deleting chaincode server deployment %s", deployment.Name)
+		err := deployments.Delete(ctx, deployment.Name, deleteOptions)
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return errors.Wrapf(err, "deleting chaincode server deployment %s", deployment.Name)
+		}
+	}
+
+	services := clientset.CoreV1().Services(namespace)
+	serviceList, err := services.List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return errors.Wrap(err, "listing chaincode server services")
+	}
+	for _, service := range serviceList.Items {
+		if service.Name == name {
+			continue
+		}
+		log.Printf("Deleting chaincode server service %s", service.Name)
+		err := services.Delete(ctx, service.Name, deleteOptions)
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return errors.Wrapf(err, "deleting chaincode server service %s", service.Name)
+		}
+	}
+	return nil
+}
+
+// releaseManagedChaincodeServer deploys the built chaincode as a chaincode server and writes
+// the connection.json of its Service to chaincode/server in the release dir
+func releaseManagedChaincodeServer(ctx context.Context, cfg Config, buildDir string, releaseDir string) error {
+	buildInformation, err := getBuildInformation(buildDir)
+	if err != nil {
+		return err
+	}
+	packageID := getPackageID(buildDir)
+	if packageID == "" {
+		return errors.Errorf("getting package id from build dir=%s", buildDir)
+	}
+
+	clientset, err := getKubernetesClientset()
+	if err != nil {
+		return errors.Wrap(err, "getting kubernetes clientset")
+	}
+	myself, _ := os.Hostname()
+	connection, err := deployChaincodeServer(ctx, clientset, cfg, myself, packageID, buildInformation)
+	if err != nil {
+		return errors.Wrap(err, "deploying chaincode server")
+	}
+	log.Printf("Chaincode server at %s", connection.Address)
+	// The new package replaces the previous ones with the same label
+	err = deleteStaleChaincodeServers(ctx, clientset, cfg.Namespace, myself, packageID)
+	if err != nil {
+		log.Printf("Deleting previous chaincode servers: %q", err)
+	}
+
+	data, err := json.Marshal(connection)
+	if err != nil {
+		return errors.Wrap(err, "marshaling connection.json")
+	}
+	serverDir := filepath.Join(releaseDir, "chaincode", "server")
+	err = os.MkdirAll(serverDir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "creating chaincode server release dir")
+	}
+	err = ioutil.WriteFile(filepath.Join(serverDir, connectionFile), data, 0644)
+	return errors.Wrap(err, "writing connection.json")
+}
+
+// deployChaincodeServer creates or updates the Deployment and Service running the image
+// a build output was built into as a chaincode server, and returns the connection the peer dials.
+// They are not owned by the peer Pod, so they outlive peer restarts. The pods don't download
+// the build output, so they don't depend on signed URLs nor on the artifacts of the file server.
+func deployChaincodeServer(ctx context.Context, clientset kubernetes.Interface, cfg Config, peerName string, packageID string, buildInformation *BuildInformation) (*ChaincodeServerConnection, error) {
+	if buildInformation.ChaincodeImage == "" {
+		return nil, errors.Errorf("chaincode %s was not built into an image, chaincode servers require oci.enabled", packageID)
+	}
+	resources, err := getChaincodeResources(cfg, buildInformation.Resources)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting chaincode resources")
+	}
+	name := getChaincodeServerName(peerName, packageID)
+	port := getChaincodeServerPort(cfg)
+	// The selector of existing Deployments can't change, the other labels find the
+	// chaincode servers of the same peer and label
+	selector := map[string]string{
+		"externalcc-type":   "server",
+		"externalcc-server": name,
+	}
+	labels := getChaincodeServerLabels(peerName, packageID)
+	for k, v := range selector {
+		labels[k] = v
+	}
+
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: Int32Ref(1),
+			Selector: &metav1.LabelSelector{MatchLabels: selector},
+			Template: apiv1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: apiv1.PodSpec{
+					Containers: []apiv1.Container{
+						{
+							Name:            "chaincode",
+							Image:           buildInformation.ChaincodeImage,
+							ImagePullPolicy: apiv1.PullIfNotPresent,
+							Env: []apiv1.EnvVar{
+								{
+									Name:  "CHAINCODE_SERVER_ADDRESS",
+									Value: fmt.Sprintf("0.0.0.0:%d", port),
+								},
+								{
+									Name:  "CHAINCODE_ID",
+									Value: packageID,
+								},
+								{
+									Name:  "CORE_CHAINCODE_ID_NAME",
+									Value: packageID,
+								},
+							},
+							Ports: []apiv1.ContainerPort{
+								{
+									Name:          "chaincode",
+									ContainerPort: port,
+								},
+							},
+							WorkingDir: GetCCMountDir(buildInformation.Platform), // Set the CWD to the path where the chaincode is
+							Command:    GetRunArgs(buildInformation.Platform, ""),
+							Resources:  resources,
+						},
+					},
+					EnableServiceLinks: BoolRef(false),
+					ImagePullSecrets:   getImagePullSecrets(cfg),
+				},
+			},
+		},
+	}
+	deployments := clientset.AppsV1().Deployments(cfg.Namespace)
+	_, err = deployments.Create(ctx, deployment, metav1.CreateOptions{})
+	if k8serrors.IsAlreadyExists(err) {
+		log.Printf("Updating chaincode server deployment %s", name)
+		var existing *appsv1.Deployment
+		existing, err = deployments.Get(ctx, name, metav1.GetOptions{})
+		if err == nil {
+			existing.Labels = deployment.Labels
+			existing.Spec = deployment.Spec
+			_, err = deployments.Update(ctx, existing, metav1.UpdateOptions{})
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "creating chaincode server deployment")
+	}
+
+	service := &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+		Spec: apiv1.ServiceSpec{
+			Selector: selector,
+			Ports: []apiv1.ServicePort{
+				{
+					Name:       "chaincode",
+					Port:       port,
+					TargetPort: intstr.FromString("chaincode"),
+				},
+			},
+		},
+	}
+	services := clientset.CoreV1().Services(cfg.Namespace)
+	_, err = services.Create(ctx, service, metav1.CreateOptions{})
+	if k8serrors.IsAlreadyExists(err) {
+		var existing *apiv1.Service
+		existing, err = services.Get(ctx, name, metav1.GetOptions{})
+		if err == nil {
+			// Keep the cluster IP allocated to the existing Service
+			existing.Labels = service.Labels
+			existing.Spec.Selector = service.Spec.Selector
+			existing.Spec.Ports = service.Spec.Ports
+			_, err = services.Update(ctx, existing, metav1.UpdateOptions{})
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "creating chaincode server service")
+	}
+
+	return &ChaincodeServerConnection{
+		Address:     fmt.Sprintf("%s.%s.svc:%d", name, cfg.Namespace, port),
+		DialTimeout: chaincodeServerDialTimeout,
+	}, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGetPackageID(t *testing.T) {
+	folder := "/tmp/fabric-ip-register-cc-ea2aaf81f5d991a883563c349e793ef0a642d577ceebb9a6778832c7fca23882425116466/bld"
+	assert.Equal(t, "ip-register-cc:ea2aaf81f5d991a883563c349e793ef0a642d577ceebb9a6778832c7fca23882", getPackageID(folder))
+	assert.Empty(t, getPackageID("/tmp/fabric-run123/bld"))
+}
+
+func TestGetChaincodeServerName(t *testing.T) {
+	packageID := "ip_register.cc:ea2aaf81f5d991a883563c349e793ef0a642d577ceebb9a6778832c7fca23882"
+	assert.Equal(t, "org1-peer0-0-ccs-ip-register-cc-ea2aaf81", getChaincodeServerName("org1-peer0-0", packageID))
+
+	name := getChaincodeServerName("org1-peer0-0", strings.Repeat("label", 20)+":ea2aaf81f5d991a8")
+	assert.Len(t, name, 63)
+	assert.True(t, strings.HasSuffix(name, "-ea2aaf81"))
+}
+
+func TestDeployChaincodeServer(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	cfg := Config{Namespace: "fabric"}
+	cfg.Launcher.Resources.LimitMemory = "1G"
+	packageID := "mycc:ea2aaf81f5d991a883563c349e793ef0a642d577ceebb9a6778832c7fca23882"
+	buildInformation := &BuildInformation{
+		Image:          "hyperledger/fabric-ccenv:2.2.0",
+		Platform:       "golang",
+		OutputDigest:   strings.Repeat("ab", 32),
+		ChaincodeImage: "registry.example.com/chaincode@sha256:" + strings.Repeat("cd", 32),
+		Resources:      ResourcesConfig{LimitCPU: "500m"},
+	}
+
+	connection, err := deployChaincodeServer(ctx, clientset, cfg, "peer0", packageID, buildInformation)
+	require.NoError(t, err)
+	assert.Equal(t, "peer0-ccs-mycc-ea2aaf81.fabric.svc:7052", connection.Address)
+	assert.NoError(t, connection.Validate())
+
+	deployment, err := clientset.AppsV1().Deployments("fabric").Get(ctx, "peer0-ccs-mycc-ea2aaf81", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, deployment.OwnerReferences)
+	pod := deployment.Spec.Template.Spec
+	// The build output is part of the image, no URL is handed to the pods
+	assert.Empty(t, pod.InitContainers)
+	assert.Empty(t, pod.Volumes)
+	require.Len(t, pod.Containers, 1)
+	assert.Equal(t, buildInformation.ChaincodeImage, pod.Containers[0].Image)
+	assert.Equal(t, "CHAINCODE_SERVER_ADDRESS", pod.Containers[0].Env[0].Name)
+	assert.Equal(t, "0.0.0.0:7052", pod.Containers[0].Env[0].Value)
+	assert.Equal(t, "1G", pod.Containers[0].Resources.Limits.Memory().String())
+	assert.Equal(t, "500m", pod.Containers[0].Resources.Limits.Cpu().String())
+
+	service, err := clientset.CoreV1().Services("fabric").Get(ctx, "peer0-ccs-mycc-ea2aaf81", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, deployment.Spec.Selector.MatchLabels, service.Spec.Selector)
+	assert.Equal(t, int32(7052), service.Spec.Ports[0].Port)
+
+	// Releasing again updates the existing resources
+	service.Spec.ClusterIP = "10.0.0.10"
+	_, err = clientset.CoreV1().Services("fabric").Update(ctx, service, metav1.UpdateOptions{})
+	require.NoError(t, err)
+	cfg.Launcher.Server.Port = 9999
+	buildInformation.ChaincodeImage = "registry.example.com/chaincode@sha256:" + strings.Repeat("ef", 32)
+	connection, err = deployChaincodeServer(ctx, clientset, cfg, "peer0", packageID, buildInformation)
+	require.NoError(t, err)
+	assert.Equal(t, "peer0-ccs-mycc-ea2aaf81.fabric.svc:9999", connection.Address)
+	deployment, err = clientset.AppsV1().Deployments("fabric").Get(ctx, "peer0-ccs-mycc-ea2aaf81", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, buildInformation.ChaincodeImage, deployment.Spec.Template.Spec.Containers[0].Image)
+	service, err = clientset.CoreV1().Services("fabric").Get(ctx, "peer0-ccs-mycc-ea2aaf81", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int32(9999), service.Spec.Ports[0].Port)
+	assert.Equal(t, "10.0.0.10", service.Spec.ClusterIP)
+	assert.Equal(t, "peer0", service.Labels["externalcc-peer"])
+	assert.Equal(t, "mycc", service.Labels["externalcc-label"])
+
+	// Build outputs that weren't built into an image can't be deployed
+	buildInformation.ChaincodeImage = ""
+	_, err = deployChaincodeServer(ctx, clientset, cfg, "peer0", packageID, buildInformation)
+	assert.Error(t, err)
+}
+
+func TestDeleteStaleChaincodeServers(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	cfg := Config{Namespace: "fabric"}
+	buildInformation := &BuildInformation{
+		Platform:       "golang",
+		ChaincodeImage: "registry.example.com/chaincode@sha256:" + strings.Repeat("cd", 32),
+	}
+	previous := "mycc:" + strings.Repeat("1", 64)
+	current := "mycc:" + strings.Repeat("2", 64)
+	other := "othercc:" + strings.Repeat("3", 64)
+	for _, server := range []struct{ peer, packageID string }{
+		{"peer0", previous}, {"peer0", current}, {"peer0", other}, {"peer1", previous},
+	} {
+		_, err := deployChaincodeServer(ctx, clientset, cfg, server.peer, server.packageID, buildInformation)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, deleteStaleChaincodeServers(ctx, clientset, "fabric", "peer0", current))
+	deployments, err := clientset.AppsV1().Deployments("fabric").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	names := []string{}
+	for _, deployment := range deployments.Items {
+		names = append(names, deployment.Name)
+	}
+	expected := []string{
+		getChaincodeServerName("peer0", current),
+		getChaincodeServerName("peer0", other),
+		getChaincodeServerName("peer1", previous),
+	}
+	assert.ElementsMatch(t, expected, names)
+	services, err := clientset.CoreV1().Services("fabric").List(ctx, metav1.ListOptions{})
+	require.NoError(t, err)
+	names = []string{}
+	for _, service := range services.Items {
+		names = append(names, service.Name)
+	}
+	assert.ElementsMatch(t, expected, names)
+}
+
+func TestGetChaincodeResources(t *testing.T) {
+	cfg := Config{}
+	cfg.Launcher.Resources = ResourcesConfig{LimitMemory: "1G", RequestsCPU: "100m"}
+	resources, err := getChaincodeResources(cfg, ResourcesConfig{LimitMemory: "2G"})
+	require.NoError(t, err)
+	assert.Equal(t, "2G", resources.Limits.Memory().String())
+	assert.Equal(t, "100m", resources.Requests.Cpu().String())
+
+	// Resources from metadata.json are not trusted
+	_, err = getChaincodeResources(cfg, ResourcesConfig{RequestsMemory: "lots"})
+	assert.Error(t, err)
+	_, err = deployChaincodeServer(context.Background(), fake.NewSimpleClientset(), cfg, "peer0", "mycc:ea2aaf81f5d991a8", &BuildInformation{
+		ChaincodeImage: "registry.example.com/chaincode@sha256:" + strings.Repeat("cd", 32),
+		Resources:      ResourcesConfig{LimitCPU: "1 core"},
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kfsoftware/externalbuilder/cmd/internal/compression"
+	"github.com/kfsoftware/externalbuilder/cmd/internal/digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultChunkSize = 8 << 20 // 8 MiB
+
+	// maxTransferAttempts is the number of consecutive failures after which a transfer is given up
+	maxTransferAttempts = 5
+
+	uploadOffsetHeader = "Upload-Offset"
+)
+
+// transferRetryDelay is the pause before resuming a failed transfer
+var transferRetryDelay = 2 * time.Second
+
+func getChunkSize(cfg Config) int64 {
+	if cfg.FileServer.ChunkSize > 0 {
+		return cfg.FileServer.ChunkSize
+	}
+	return defaultChunkSize
+}
+
+// uploadArtifact uploads data to the file server in chunks, resuming from the offset
+// reported by the server if a chunk fails. header is sent along with every request.
+func uploadArtifact(ctx context.Context, cfg Config, client *http.Client, artifactURL string, data io.ReaderAt, size int64, header http.Header) error {
+	if size == 0 {
+		// Resumable uploads need content, an empty file is sent at once
+		resp, err := sendUploadRequest(ctx, client, http.MethodPost, artifactURL, http.NoBody, 0, "", header)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return errors.Errorf("Received %d code from server", resp.StatusCode)
+		}
+		return nil
+	}
+
+	chunkSize := getChunkSize(cfg)
+	// Failures only reset once the upload gets further than before, so an upload the
+	// server keeps discarding ends
+	var offset, progress int64
+	failures := 0
+	for offset < size {
+		end := offset + chunkSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		chunk := io.NewSectionReader(data, offset, end-offset+1)
+		contentRange := fmt.Sprintf("bytes %d-%d/%d", offset, end, size)
+		newOffset, err := putChunk(ctx, client, artifactURL, chunk, end-offset+1, contentRange, header)
+		if err == nil {
+			offset = newOffset
+			if offset > progress {
+				progress = offset
+				failures = 0
+			}
+			continue
+		}
+
+		failures++
+		if failures >= maxTransferAttempts {
+			return errors.Wrapf(err, "uploading chunk at offset %d", offset)
+		}
+		log.Printf("Upload interrupted at offset %d, retrying: %s", offset, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(transferRetryDelay):
+		}
+		// Ask the server how much it received
+		serverOffset, err := putChunk(ctx, client, artifactURL, http.NoBody, 0, fmt.Sprintf("bytes */%d", size), header)
+		if err == nil {
+			offset = serverOffset
+		}
+	}
+	return nil
+}
+
+// putChunk sends a chunk of a resumable upload and returns the offset reported by the server
+func putChunk(ctx context.Context, client *http.Client, artifactURL string, body io.Reader, length int64, contentRange string, header http.Header) (int64, error) {
+	resp, err := sendUploadRequest(ctx, client, http.MethodPut, artifactURL, body, length, contentRange, header)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted, http.StatusConflict:
+		// Conflicts report the offset to resume from
+		offset, err := strconv.ParseInt(resp.Header.Get(uploadOffsetHeader), 10, 64)
+		if err != nil {
+			return 0, errors.Errorf("invalid %s header in response", uploadOffsetHeader)
+		}
+		return offset, nil
+	default:
+		return 0, errors.Errorf("Received %d code from server", resp.StatusCode)
+	}
+}
+
+func sendUploadRequest(ctx context.Context, client *http.Client, method string, artifactURL string, body io.Reader, length int64, contentRange string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, artifactURL, body)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating upload request")
+	}
+	req = req.WithContext(ctx)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = length
+	if length == 0 {
+		req.Body = http.NoBody
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if contentRange != "" {
+		req.Header.Set("Content-Range", contentRange)
+	}
+	return client.Do(req)
+}
+
+// getArtifactDigest returns the hex encoded SHA-256 of an artifact as reported by the file server
+func getArtifactDigest(ctx context.Context, client *http.Client, artifactURL string) (string, error) {
+	req, err := http.NewRequest(http.MethodHead, artifactURL, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "creating request")
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("Received %d code from server", resp.StatusCode)
+	}
+	return digest.ParseSHA256(resp.Header.Get(digest.Header))
+}
+
+// getDownloadScript returns a shell snippet downloading an artifact to file with curl,
+// resuming the download with a range request if it's interrupted.
+// With compression configured, the artifact is transferred compressed and decompressed afterwards.
+// If sha256 is not empty, the downloaded file must match it.
+func getDownloadScript(cfg Config, artifactURL string, file string, sha256 string) string {
+	verify := ""
+	if sha256 != "" {
+		verify = fmt.Sprintf(`
+if ! echo '%[1]s  %[2]s' | sha256sum -c -; then
+  echo "digest mismatch: %[2]s does not match sha256 %[1]s" >&2
+  exit 1
+fi`, sha256, file)
+	}
+
+	encoding := cfg.FileServer.Compression.Algorithm
+	download := file
+	curlFlags := ""
+	decompress := ""
+	if encoding != compression.None {
+		// The file server sends the artifact compressed only if it's stored that way
+		download = file + ".download"
+		curlFlags = fmt.Sprintf(" -H 'Accept-Encoding: %[1]s' -D %[2]s.headers", encoding, download)
+		decompress = fmt.Sprintf(`
+encoding=$(tr -d '\r' < %[1]s.headers | awk -F': ' 'tolower($1) == "content-encoding" {print tolower($2)}' | tail -n 1)
+if [ "$encoding" = "%[2]s" ]; then
+  %[3]s < %[1]s > %[4]s || exit 1
+  rm %[1]s
+else
+  mv %[1]s %[4]s
+fi
+rm -f %[1]s.headers`, download, encoding, decompressCommands[encoding], file)
+	}
+	return fmt.Sprintf(`(
+rm -f %[3]s %[7]s
+for attempt in $(seq 1 %[1]d); do
+  curl -s -f %[2]s%[8]s -L -C - -o %[7]s '%[4]s' && break
+  if [ "$attempt" -eq %[1]d ]; then echo "download of %[3]s failed" >&2; exit 1; fi
+  sleep %[5]d
+done%[9]s%[6]s
+)`,
+		maxTransferAttempts,
+		getCurlTLSFlags(cfg),
+		file,
+		artifactURL,
+		int(transferRetryDelay.Seconds()),
+		verify,
+		download,
+		curlFlags,
+		decompress,
+	)
+}
+
+// getUploadScript returns a shell snippet uploading file to the file server with curl
+// in chunks, resuming from the offset reported by the server if a chunk fails.
+// The SHA-256 of the file is sent along, so the server rejects corrupted uploads.
+// With compression configured, the file is compressed before being uploaded.
+func getUploadScript(cfg Config, file string, artifactURL string, label string) string {
+	headerFlags := fmt.Sprintf(`-H "%s: sha-256=$digest"`, digest.Header)
+	if label != "" {
+		headerFlags += fmt.Sprintf(" -H '%s: %s'", chaincodeLabelHeader, label)
+	}
+
+	encoding := cfg.FileServer.Compression.Algorithm
+	upload := file
+	compress := ""
+	if encoding != compression.None {
+		upload = file + compressionExtensions[encoding]
+		compress = fmt.Sprintf("\n%s < %s > %s || exit 1", getCompressCommand(cfg), file, upload)
+		headerFlags += fmt.Sprintf(" -H 'Content-Encoding: %s'", encoding)
+	}
+	return fmt.Sprintf(`(
+digest=$(printf "$(sha256sum %[9]s | cut -d' ' -f1 | sed 's/../\\x&/g')" | base64)%[10]s
+size=$(stat -c %%s %[1]s)
+if [ "$size" -eq 0 ]; then
+  curl -s -f %[2]s -X POST %[3]s --upload-file %[1]s '%[4]s'
+  exit $?
+fi
+offset=0
+progress=0
+failures=0
+while [ "$offset" -lt "$size" ]; do
+  end=$((offset + %[5]d - 1))
+  if [ "$end" -ge "$size" ]; then end=$((size - 1)); fi
+  if tail -c +$((offset + 1)) %[1]s | head -c $((end - offset + 1)) | curl -s -f %[2]s -X PUT %[3]s -H "Content-Range: bytes $offset-$end/$size" --data-binary @- '%[4]s' > /dev/null; then
+    offset=$((end + 1))
+    if [ "$offset" -gt "$progress" ]; then progress=$offset; failures=0; fi
+  else
+    failures=$((failures + 1))
+    if [ "$failures" -ge %[6]d ]; then echo "upload of %[1]s failed" >&2; exit 1; fi
+    sleep %[7]d
+    offset=$(curl -s %[2]s -X PUT %[3]s -H "Content-Range: bytes */$size" -D - -o /dev/null '%[4]s' | tr -d '\r' | awk -F': ' 'tolower($1) == "%[8]s" {print $2}')
+    offset=${offset:-0}
+  fi
+done
+)`,
+		upload,
+		getCurlTLSFlags(cfg),
+		headerFlags,
+		artifactURL,
+		getChunkSize(cfg),
+		maxTransferAttempts,
+		int(transferRetryDelay.Seconds()),
+		"upload-offset",
+		file,
+		compress,
+	)
+}
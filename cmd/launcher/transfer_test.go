@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingUploadServer answers resumable uploads like the file server whose storage fails,
+// discarding the upload once the last chunk arrives
+func failingUploadServer() *httptest.Server {
+	var mu sync.Mutex
+	var received int64
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		contentRange := r.Header.Get("Content-Range")
+		total, _ := strconv.ParseInt(contentRange[strings.LastIndex(contentRange, "/")+1:], 10, 64)
+		if strings.HasPrefix(contentRange, "bytes */") {
+			w.Header().Set(uploadOffsetHeader, strconv.FormatInt(received, 10))
+			return
+		}
+		received += int64(len(body))
+		if received < total {
+			w.Header().Set(uploadOffsetHeader, strconv.FormatInt(received, 10))
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		received = 0
+		w.Header().Set(uploadOffsetHeader, "0")
+		http.Error(w, "storing file failed", http.StatusInternalServerError)
+	}))
+}
+
+func TestUploadArtifactStorageFailure(t *testing.T) {
+	defer func(delay time.Duration) { transferRetryDelay = delay }(transferRetryDelay)
+	transferRetryDelay = time.Millisecond
+	server := failingUploadServer()
+	defer server.Close()
+
+	cfg := Config{}
+	cfg.FileServer.ChunkSize = 4
+	data := []byte("0123456789")
+	err := uploadArtifact(context.Background(), cfg, server.Client(), server.URL+"/build1/chaincode-output.tar", bytes.NewReader(data), int64(len(data)), http.Header{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "500")
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"github.com/kfsoftware/externalbuilder/cmd/internal/compression"
 	"github.com/mholt/archiver"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
@@ -14,7 +15,7 @@ func TestFoo(t *testing.T) {
 	err := archiver.Archive([]string{sourceDir}, zipFile)
 	assert.NoError(t, err)
 	var buf bytes.Buffer
-	err = compress(sourceDir, &buf)
+	_, err = compress(sourceDir, &buf, compression.None, 0)
 	assert.NoError(t, err)
 	err = ioutil.WriteFile(zipFile, buf.Bytes(), 0777)
 	assert.NoError(t, err)
@@ -14,12 +14,14 @@ require (
 	github.com/hyperledger/fabric v2.1.1+incompatible
 	github.com/hyperledger/fabric-amcl v0.0.0-20200424173818-327c9e2cf77a // indirect
 	github.com/hyperledger/fabric-protos-go v0.0.0-20200923192742-3897341ac036
+	github.com/klauspost/compress v1.11.0
 	github.com/lithammer/shortuuid/v3 v3.0.4
 	github.com/mholt/archiver v3.1.1+incompatible
 	github.com/miekg/pkcs11 v1.0.3 // indirect
 	github.com/nwaples/rardecode v1.1.0 // indirect
 	github.com/otiai10/copy v1.2.0
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.7.1
 	github.com/spf13/viper v1.7.1 // indirect
 	github.com/stretchr/testify v1.6.1
 	github.com/sykesm/zap-logfmt v0.0.4 // indirect